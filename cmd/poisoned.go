@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/cobolbaby/log-agent/utils"
+	"github.com/cobolbaby/log-agent/watchdog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	http.HandleFunc("/poisoned", poisonedHandler)
+}
+
+// GET列出超过重试上限的事件，POST action=requeue|discard&path=...人工处理
+func poisonedHandler(w http.ResponseWriter, r *http.Request) {
+	if agent == nil {
+		http.Error(w, "WatchDog is not running", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		letters, err := agent.PoisonedLetters()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(letters)
+	case http.MethodPost:
+		if !adminAuthorized(r) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		path := r.FormValue("path")
+		if path == "" {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch action := r.FormValue("action"); action {
+		case "requeue":
+			err = agent.RequeuePoisoned(path)
+		case "discard":
+			err = agent.DiscardPoisoned(path)
+		default:
+			http.Error(w, fmt.Sprintf("unknown action %q", action), http.StatusBadRequest)
+			return
+		}
+		if err == watchdog.ErrLetterNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	default:
+		http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+	}
+}
+
+func fetchPoisoned(client *http.Client) ([]*watchdog.PoisonedLetter, error) {
+	resp, err := client.Get("http://" + adminAddr() + "/poisoned")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin endpoint respond %s", resp.Status)
+	}
+	var letters []*watchdog.PoisonedLetter
+	if err := json.NewDecoder(resp.Body).Decode(&letters); err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+func printPoisoned(out io.Writer, letters []*watchdog.PoisonedLetter) {
+	if len(letters) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "\n[Poisoned]\n")
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, l := range letters {
+		fmt.Fprintf(tw, "  %s\t%s %s\t%d attempts\t%s\t%s\n",
+			l.Path, l.Biz, l.Op, l.Attempts, l.LastFailed.Format(time.RFC3339), l.LastError)
+	}
+	tw.Flush()
+}
+
+// 人工处理超过重试上限的事件，action为requeue或discard
+// e.g. logagent poisoned requeue /data/log/a.txt -c conf/logagent.ini
+func Poisoned(action string, path string) error {
+	form := url.Values{
+		"action": {action},
+		"path":   {path},
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+adminAddr()+"/poisoned", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token := ConfigMgr().Section("").Key("admin_token").Value(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("admin endpoint respond %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
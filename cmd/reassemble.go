@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	. "github.com/cobolbaby/log-agent/utils"
+	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/cobolbaby/log-agent/watchdog/lib/avro"
+	"github.com/cobolbaby/log-agent/watchdog/lib/chunk"
+	"github.com/cobolbaby/log-agent/watchdog/lib/compress"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	REASSEMBLE_IDLE_TIMEOUT = 10 * time.Second // 分区内无新消息时停止读取，避免压实后的Topic末尾存在空洞时无法结束
+)
+
+// 从Kafka消息中还原出的文件
+type fileMessage struct {
+	Folder     string
+	Pack       string
+	Name       string
+	Content    []byte
+	Compress   bool
+	Checksum   string
+	ModifyTime int64
+}
+
+type reassembler struct {
+	output    string
+	registry  *avro.HTTPRegistry
+	assembler *chunk.Assembler
+	files     int
+	skipped   int
+	failures  int
+}
+
+// 读取Topic中现有的文件消息并还原至output目录，分片的消息按Header重组后校验
+// e.g. logagent reassemble topic-bsilog ./restore -c conf/logagent.ini
+func Reassemble(topic string, output string) error {
+	cfg := ConfigMgr().Section("KAFKA")
+	brokers := cfg.Key("brokers").Value()
+	if brokers == "" {
+		return fmt.Errorf("brokers of [KAFKA] is not set")
+	}
+	r := &reassembler{
+		output:    output,
+		assembler: chunk.NewAssembler(),
+	}
+	// Avro格式的消息需依据Schema ID获取Schema
+	if urls := cfg.Key("schema_registry").Value(); urls != "" {
+		registry, err := avro.NewHTTPRegistry(urls)
+		if err != nil {
+			return err
+		}
+		r.registry = registry
+	}
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_0_1_0
+	client, err := sarama.NewClient(strings.Split(brokers, ","), config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		if err := r.consume(client, consumer, topic, partition); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Reassembled %d files into %s, skipped %d messages, %d failures\n", r.files, output, r.skipped, r.failures)
+	if pending := r.assembler.Pending(); len(pending) > 0 {
+		fmt.Printf("%d files are incomplete: %s\n", len(pending), strings.Join(pending, ", "))
+	}
+	if r.failures > 0 {
+		return fmt.Errorf("%d messages failed to reassemble", r.failures)
+	}
+	return nil
+}
+
+// 读取分区中已有的消息，读至启动时的最新位置为止
+func (this *reassembler) consume(client sarama.Client, consumer sarama.Consumer, topic string, partition int32) error {
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return err
+	}
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+	if newest <= oldest {
+		return nil
+	}
+	pc, err := consumer.ConsumePartition(topic, partition, oldest)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	for {
+		select {
+		case msg := <-pc.Messages():
+			if err := this.handle(msg); err != nil {
+				this.failures++
+				fmt.Fprintf(os.Stderr, "partition %d offset %d: %s\n", partition, msg.Offset, err)
+			}
+			if msg.Offset >= newest-1 {
+				return nil
+			}
+		case err := <-pc.Errors():
+			return err
+		case <-time.After(REASSEMBLE_IDLE_TIMEOUT):
+			return nil
+		}
+	}
+}
+
+func (this *reassembler) handle(msg *sarama.ConsumerMessage) error {
+	// 删除文件时的空消息(tombstone)
+	if msg.Value == nil {
+		this.skipped++
+		return nil
+	}
+	file, err := this.decode(msg.Value)
+	if err != nil {
+		return err
+	}
+	// tail模式下的单行记录
+	if file == nil {
+		this.skipped++
+		return nil
+	}
+
+	headers := make(map[string]string)
+	for _, h := range msg.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	c, err := chunk.ParseHeaders(headers)
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		content, ok, err := this.assembler.Add(c, file.Content)
+		if err != nil || !ok {
+			return err
+		}
+		file.Content = content
+	}
+	return this.write(file)
+}
+
+// 依据首字节区分JSON以及Confluent格式的Avro消息，非文件消息返回nil
+func (this *reassembler) decode(value []byte) (*fileMessage, error) {
+	if len(value) > 5 && value[0] == 0 {
+		return this.decodeAvro(value)
+	}
+
+	var msg struct {
+		Payload *handler.LogfileEncoder `json:"payload"`
+	}
+	if err := json.Unmarshal(value, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Payload == nil || msg.Payload.Content == "" {
+		return nil, nil
+	}
+	content, err := hex.DecodeString(strings.TrimPrefix(msg.Payload.Content, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	return &fileMessage{
+		Folder:     msg.Payload.SubDir,
+		Pack:       msg.Payload.Pack,
+		Name:       msg.Payload.Filename,
+		Content:    content,
+		Compress:   msg.Payload.Compress,
+		Checksum:   msg.Payload.Checksum,
+		ModifyTime: msg.Payload.ModifyTime,
+	}, nil
+}
+
+func (this *reassembler) decodeAvro(value []byte) (*fileMessage, error) {
+	if this.registry == nil {
+		return nil, fmt.Errorf("schema_registry of [KAFKA] is required to decode avro messages")
+	}
+	schema, err := this.registry.Lookup(int(binary.BigEndian.Uint32(value[1:5])))
+	if err != nil {
+		return nil, err
+	}
+	record, err := schema.Decode(value[5:])
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := record["content"]; !ok {
+		return nil, nil
+	}
+	file := new(fileMessage)
+	file.Folder, _ = record["folder"].(string)
+	file.Pack, _ = record["pack"].(string)
+	file.Name, _ = record["name"].(string)
+	file.Content, _ = record["content"].([]byte)
+	file.Compress, _ = record["compress"].(bool)
+	file.Checksum, _ = record["checksum"].(string)
+	file.ModifyTime, _ = record["modify_time"].(int64)
+	return file, nil
+}
+
+// 解压并校验后写入<output>/<folder>/[<pack>/]<name>
+func (this *reassembler) write(file *fileMessage) error {
+	content := file.Content
+	if file.Compress {
+		var err error
+		if content, err = compress.GunzipContent(content); err != nil {
+			return fmt.Errorf("%s/%s: %s", file.Folder, file.Name, err)
+		}
+	}
+	if err := chunk.Verify(content, file.Checksum); err != nil {
+		return fmt.Errorf("%s/%s: %s", file.Folder, file.Name, err)
+	}
+
+	path := filepath.Join(this.output, filepath.FromSlash(file.Folder), file.Pack, filepath.FromSlash(file.Name))
+	if rel, err := filepath.Rel(this.output, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s/%s is outside of %s", file.Folder, file.Name, this.output)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	if file.ModifyTime > 0 {
+		mtime := time.Unix(0, file.ModifyTime*int64(time.Millisecond))
+		os.Chtimes(path, mtime, mtime)
+	}
+	this.files++
+	return nil
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"github.com/cobolbaby/log-agent/plugins"
+	. "github.com/cobolbaby/log-agent/utils"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	CONFIG_CHECK_INTERVAL = 10 * time.Second // 配置文件变更检测间隔
+)
+
+var (
+	reloadLock sync.Mutex
+)
+
+func init() {
+	http.HandleFunc("/reload", reloadHandler)
+}
+
+// 重新读取配置并热加载插件
+func Reload() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if agent == nil {
+		return nil
+	}
+	agent.Logger.Warnf("Reload configuration %s", ConfigPath())
+	if _, err := ReloadConfig(); err != nil {
+		agent.Logger.Errorf("Fail to reload configuration: %s", err)
+		return err
+	}
+	plugins, err := plugins.Load()
+	if err != nil {
+		agent.Logger.Errorf("Fail to load plugins: %s", err)
+		return err
+	}
+	if err := agent.Reload(plugins); err != nil {
+		agent.Logger.Errorf("Fail to reload plugins: %s", err)
+		return err
+	}
+	return nil
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !adminAuthorized(r) {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	if err := Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
+
+// 通过SIGHUP信号触发热加载(Windows下无此信号)
+func watchSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		Reload()
+	}
+}
+
+// 轮询配置文件的修改时间，变更后自动热加载
+func watchConfigFile() {
+	var modTime time.Time
+	if fi, err := os.Stat(ConfigPath()); err == nil {
+		modTime = fi.ModTime()
+	}
+	for {
+		time.Sleep(CONFIG_CHECK_INTERVAL)
+		fi, err := os.Stat(ConfigPath())
+		if err != nil || fi.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = fi.ModTime()
+		Reload()
+	}
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"fmt"
 	"github.com/cobolbaby/log-agent/plugins"
 	. "github.com/cobolbaby/log-agent/utils"
 	"github.com/cobolbaby/log-agent/watchdog"
@@ -9,6 +10,21 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"path/filepath"
+	"time"
+)
+
+const (
+	SHUTDOWN_TIMEOUT = 15 * time.Second // 停机时等待事件处理完毕的最长时间
+	HEARTBEAT_TOPIC  = "logagent-heartbeat"
+	// 心跳发送目标
+	HEARTBEAT_SINK_KAFKA = "kafka"
+	HEARTBEAT_SINK_LOG   = "log"
+	HEARTBEAT_SINK_NONE  = "none"
+)
+
+var (
+	agent  *watchdog.Watchdog
+	server *http.Server
 )
 
 func Run() {
@@ -34,15 +50,96 @@ func Run() {
 		logPath = filepath.Join(execdir, "logs")
 	}
 
-	watchdog.NewWatchdog().
+	// 失败重试策略，时间单位为毫秒
+	retryPolicy := watchdog.RetryPolicy{
+		MaxAttempts: cfg.Section("").Key("retry_max_attempts").MustUint(watchdog.RETRY_MAX_ATTEMPTS),
+		Backoff:     time.Duration(cfg.Section("").Key("retry_backoff").MustUint(uint(watchdog.RETRY_BACKOFF/time.Millisecond))) * time.Millisecond,
+		MaxBackoff:  time.Duration(cfg.Section("").Key("retry_max_backoff").MustUint(uint(watchdog.RETRY_MAX_BACKOFF/time.Millisecond))) * time.Millisecond,
+	}
+
+	// 流水线容量以及并发配置，时间单位为毫秒
+	pipeline := watchdog.DefaultPipelineOptions()
+	pipeline.SourceQueueCap = cfg.Section("").Key("source_queue_cap").MustInt(pipeline.SourceQueueCap)
+	pipeline.CacheQueueCap = cfg.Section("").Key("cache_queue_cap").MustInt(pipeline.CacheQueueCap)
+	pipeline.TaskQueueCap = cfg.Section("").Key("task_queue_cap").MustInt(pipeline.TaskQueueCap)
+	pipeline.BatchSize = cfg.Section("").Key("task_batch_size").MustInt(pipeline.BatchSize)
+	pipeline.BatchWindow = time.Duration(cfg.Section("").Key("task_batch_window").MustUint(uint(pipeline.BatchWindow/time.Millisecond))) * time.Millisecond
+	pipeline.Workers = cfg.Section("").Key("task_workers").MustInt(pipeline.Workers)
+
+	agent = watchdog.NewWatchdog().
 		SetHost(hostname).
 		SetLogPath(logPath).
 		SetDataPath(dataPath).
-		LoadPlugins(plugins.Autoload()).
-		Run()
+		SetRetryPolicy(retryPolicy).
+		SetPipelineOptions(pipeline).
+		SetVersion(Build.GitCommit).
+		LoadPlugins(plugins.Autoload())
+	if sink := heartbeatSink(); sink != nil {
+		interval, err := heartbeatInterval()
+		if err != nil {
+			log.Printf("Invalid heartbeat_interval, %s, fall back to %s", err, interval)
+		}
+		agent.SetHeartbeat(sink, interval)
+	}
+	agent.Run()
+
+	// 启动程序监控(pprof、status、metrics)
+	server = &http.Server{Addr: cfg.Section("").Key("admin_listen").MustString(ADMIN_LISTEN)}
+	if adminExposed(server.Addr) && cfg.Section("").Key("admin_token").Value() == "" {
+		agent.Logger.Warnf("Admin endpoint %s is reachable from other hosts without admin_token, /reload and /poisoned are unprotected", server.Addr)
+	}
+	go server.ListenAndServe()
 
-	// 启动程序监控
-	go http.ListenAndServe(":12345", nil)
+	// 支持SIGHUP、管理接口以及配置文件变更触发热加载
+	go watchSignal()
+	if cfg.Section("").Key("auto_reload").MustBool(true) {
+		go watchConfigFile()
+	}
+}
 
-	// TODO:推送心跳信息
+// 心跳间隔(毫秒)须为正数，否则使用默认值
+func heartbeatInterval() (time.Duration, error) {
+	key := ConfigMgr().Section("").Key("heartbeat_interval")
+	if key.Value() == "" {
+		return watchdog.HEARTBEAT_INTERVAL, nil
+	}
+	ms, err := key.Int64()
+	if err != nil || ms <= 0 {
+		return watchdog.HEARTBEAT_INTERVAL, fmt.Errorf("must be a positive number of milliseconds, got %q", key.Value())
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// 心跳默认经由[KAFKA]配置的broker推送，未配置broker时不推送
+func heartbeatSink() watchdog.HeartbeatSink {
+	cfg := ConfigMgr()
+	sink := cfg.Section("").Key("heartbeat_sink").MustString(HEARTBEAT_SINK_KAFKA)
+	switch sink {
+	case HEARTBEAT_SINK_KAFKA:
+		brokers := cfg.Section("KAFKA").Key("brokers").Value()
+		if brokers == "" {
+			return nil
+		}
+		topic := cfg.Section("KAFKA").Key("heartbeat_topic").MustString(HEARTBEAT_TOPIC)
+		return watchdog.NewKafkaHeartbeatSink(brokers, topic)
+	case HEARTBEAT_SINK_LOG:
+		return watchdog.NewLogHeartbeatSink(agent.Logger)
+	case HEARTBEAT_SINK_NONE:
+		return nil
+	default:
+		agent.Logger.Warnf("Unknown heartbeat_sink %q, heartbeat is disabled", sink)
+		return nil
+	}
+}
+
+func Stop() error {
+	if server != nil {
+		server.Close()
+	}
+	if agent == nil {
+		return nil
+	}
+	cfg := ConfigMgr()
+	timeout := time.Duration(cfg.Section("").Key("shutdown_timeout").MustUint(uint(SHUTDOWN_TIMEOUT/time.Millisecond))) * time.Millisecond
+	return agent.Stop(timeout)
 }
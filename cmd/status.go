@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	. "github.com/cobolbaby/log-agent/utils"
+	"github.com/cobolbaby/log-agent/watchdog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	ADMIN_LISTEN = "127.0.0.1:12345" // 管理接口默认监听地址，仅本机可访问
+)
+
+type BuildInfo struct {
+	GitCommit string
+	BuildTime string
+	GoVersion string
+}
+
+type AgentStatus struct {
+	Build    BuildInfo
+	Watchdog *watchdog.Status
+}
+
+var (
+	// 由main包在启动时注入
+	Build BuildInfo
+)
+
+func init() {
+	http.HandleFunc("/status", statusHandler)
+	http.Handle("/metrics", promhttp.Handler())
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if agent == nil {
+		http.Error(w, "WatchDog is not running", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&AgentStatus{
+		Build:    Build,
+		Watchdog: agent.Status(),
+	})
+}
+
+// 管理接口地址，监听所有网卡时通过本地回环访问
+func adminAddr() string {
+	addr := ConfigMgr().Section("").Key("admin_listen").MustString(ADMIN_LISTEN)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return addr
+}
+
+// 热加载、人工处理失败事件等变更操作需校验admin_token，未设置时不校验
+func adminAuthorized(r *http.Request) bool {
+	token := ConfigMgr().Section("").Key("admin_token").Value()
+	if token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// 管理接口监听所有网卡或非本机地址时需设置admin_token
+func adminExposed(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return true
+	}
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// 查询运行中的Agent状态
+func Status(serviceState string) error {
+	fmt.Printf("Service:     %s\n", serviceState)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + adminAddr() + "/status")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin endpoint respond %s", resp.Status)
+	}
+
+	status := new(AgentStatus)
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return err
+	}
+	printStatus(os.Stdout, status)
+	// 仅在存在poisoned事件时列出明细
+	if status.Watchdog.Poisoned > 0 {
+		letters, err := fetchPoisoned(client)
+		if err != nil {
+			return err
+		}
+		printPoisoned(os.Stdout, letters)
+	}
+	return nil
+}
+
+func printStatus(out io.Writer, status *AgentStatus) {
+	wd := status.Watchdog
+	fmt.Fprintf(out, "Host:        %s\n", wd.Host)
+	fmt.Fprintf(out, "Start Time:  %s\n", wd.StartTime.Format(time.RFC3339))
+	fmt.Fprintf(out, "Uptime:      %s\n", wd.Uptime)
+	fmt.Fprintf(out, "Git Commit:  %s\n", status.Build.GitCommit)
+	fmt.Fprintf(out, "Build Time:  %s\n", status.Build.BuildTime)
+	fmt.Fprintf(out, "Go Version:  %s\n", status.Build.GoVersion)
+	fmt.Fprintf(out, "Queues:      cache %d, task %d, in flight %d\n", wd.Queues.Cache, wd.Queues.Task, wd.Queues.InFlight)
+	fmt.Fprintf(out, "Dead Letter: pending %d, poisoned %d\n", wd.DeadLetters, wd.Poisoned)
+
+	for _, p := range wd.Plugins {
+		fmt.Fprintf(out, "\n[%s]\n", p.Biz)
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		if p.Rule != nil {
+			fmt.Fprintf(tw, "  watch\t%s\n", p.Rule.Watch)
+			fmt.Fprintf(tw, "  patterns\t%s\n", p.Rule.Patterns)
+			fmt.Fprintf(tw, "  ignores\t%s\n", p.Rule.Ignores)
+			if len(p.Rule.Includes) > 0 || len(p.Rule.Excludes) > 0 {
+				fmt.Fprintf(tw, "  include\t%s\n", strings.Join(p.Rule.Includes, " "))
+				fmt.Fprintf(tw, "  exclude\t%s\n", strings.Join(p.Rule.Excludes, " "))
+			}
+			fmt.Fprintf(tw, "  max_nesting_level\t%d\n", p.Rule.MaxNestingLevel)
+			fmt.Fprintf(tw, "  debounce\t%s\n", p.Rule.Debounce)
+			fmt.Fprintf(tw, "  change_detect\t%s\n", p.Rule.ChangePolicy)
+			fmt.Fprintf(tw, "  mode\t%s\n", p.Rule.Mode)
+			fmt.Fprintf(tw, "  strategy\t%s\n", strings.Join(p.Rule.Strategy, ","))
+			fmt.Fprintf(tw, "  poll_interval\t%s\n", p.Rule.PollInterval)
+			for _, s := range p.Rule.PollSchedules {
+				fmt.Fprintf(tw, "  poll_schedule\t%s\n", s)
+			}
+			if p.Rule.PollWindow != "" {
+				fmt.Fprintf(tw, "  poll_window\t%s\n", p.Rule.PollWindow)
+			}
+			if p.Rule.Watches > 0 || len(p.Rule.FallbackDirs) > 0 {
+				fmt.Fprintf(tw, "  watches\t%d\n", p.Rule.Watches)
+			}
+			for _, dir := range p.Rule.FallbackDirs {
+				fmt.Fprintf(tw, "  fallback poll\t%s\n", dir)
+			}
+			if scan := p.Rule.LastScan; scan != nil {
+				state := "finished"
+				if scan.Running {
+					state = "running"
+				}
+				fmt.Fprintf(tw, "  last scan\t%s %s, %s elapsed, %d dirs, %d skipped, %d files, %d affected\n",
+					state, scan.Path, scan.Elapsed, scan.Dirs, scan.Skipped, scan.Files, scan.Affected)
+			}
+			for _, i := range p.Rule.Incidents {
+				fmt.Fprintf(tw, "  incident\t%s ~ %s (%s) %s, caught up %d files\n",
+					i.Start.Format(time.RFC3339), i.End.Format(time.RFC3339), i.Duration, i.Reason, i.CaughtUp)
+			}
+		}
+		fmt.Fprintf(tw, "  adapters\t%s\n", strings.Join(p.Adapters, ","))
+		fmt.Fprintf(tw, "  source queue\t%d\n", wd.Queues.Source[p.Biz])
+		fmt.Fprintf(tw, "  processed\t%d\n", p.Stats.Processed)
+		fmt.Fprintf(tw, "  failed\t%d\n", p.Stats.Failed)
+		fmt.Fprintf(tw, "  overflowed\t%d\n", p.Stats.Overflowed)
+		if !p.Stats.LastSuccess.IsZero() {
+			fmt.Fprintf(tw, "  last success\t%s\n", p.Stats.LastSuccess.Format(time.RFC3339))
+		}
+		if p.Stats.LastError != "" {
+			fmt.Fprintf(tw, "  last error\t%s %s\n", p.Stats.LastErrorTime.Format(time.RFC3339), p.Stats.LastError)
+		}
+		tw.Flush()
+	}
+}
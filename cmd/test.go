@@ -2,9 +2,268 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/cobolbaby/log-agent/plugins"
+	. "github.com/cobolbaby/log-agent/utils"
+	"github.com/cobolbaby/log-agent/watchdog"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"github.com/go-ini/ini"
+	"github.com/kardianos/osext"
+	"github.com/streadway/amqp"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-// 参考nginx -t
-func Test() {
-	fmt.Println("initCheck")
+const (
+	PING_TIMEOUT = 5 * time.Second // 连通性检查超时时间
+)
+
+// 单个配置节的检查结果
+type checkReport struct {
+	section string
+	errs    []string
+	oks     []string
+	skips   []string
+}
+
+func (this *checkReport) check(item string, err error) {
+	if err != nil {
+		this.errs = append(this.errs, fmt.Sprintf("%s: %s", item, err))
+		return
+	}
+	this.oks = append(this.oks, item)
+}
+
+// 未检查的项目，不计为错误
+func (this *checkReport) skip(item string) {
+	this.skips = append(this.skips, item)
+}
+
+func (this *checkReport) print() {
+	state := "PASS"
+	if len(this.errs) > 0 {
+		state = "FAIL"
+	} else if len(this.oks) == 0 && len(this.skips) > 0 {
+		state = "SKIP"
+	}
+	fmt.Printf("[%s] %s\n", this.section, state)
+	for _, item := range this.oks {
+		fmt.Printf("  ok    %s\n", item)
+	}
+	for _, item := range this.skips {
+		fmt.Printf("  skip  %s\n", item)
+	}
+	for _, item := range this.errs {
+		fmt.Printf("  error %s\n", item)
+	}
+}
+
+// 参考nginx -t，检查配置但不启动监听，ping为true时检查Kafka/Cassandra/RabbitMQ的连通性
+// 返回出错的配置节数
+func Test(ping bool) int {
+	cfg := ConfigMgr()
+
+	fullexecpath, _ := osext.Executable()
+	execdir, _ := filepath.Split(fullexecpath)
+
+	var reports []*checkReport
+
+	global := &checkReport{section: "global"}
+	if !cfg.Section("").Key("switch").MustBool() {
+		global.check("switch", fmt.Errorf("LogAgent Monitor Switch Close"))
+	}
+	if hostname := cfg.Section("").Key("hostname").Value(); hostname == "" || hostname == "localhost" {
+		global.check("hostname", fmt.Errorf("please modify hostname"))
+	} else {
+		global.check("hostname "+hostname, nil)
+	}
+	dataPath := cfg.Section("").Key("data").Value()
+	if dataPath == "" {
+		dataPath = filepath.Join(execdir, "data")
+	}
+	global.check("data "+dataPath+" writable", checkWritable(dataPath))
+	logPath := cfg.Section("").Key("logs").Value()
+	if logPath == "" {
+		logPath = filepath.Join(execdir, "logs")
+	}
+	global.check("logs "+logPath+" writable", checkWritable(logPath))
+	if interval, err := heartbeatInterval(); err != nil {
+		global.check("heartbeat_interval", err)
+	} else {
+		global.check(fmt.Sprintf("heartbeat_interval %s", interval), nil)
+	}
+	reports = append(reports, global)
+
+	if ping {
+		if brokers := cfg.Section("KAFKA").Key("brokers").Value(); brokers != "" {
+			report := &checkReport{section: "KAFKA"}
+			report.check("ping "+brokers, pingKafka(brokers))
+			reports = append(reports, report)
+		}
+		if hosts := cfg.Section("CASSANDRA").Key("hosts").Value(); hosts != "" {
+			report := &checkReport{section: "CASSANDRA"}
+			for _, host := range strings.Split(hosts, ",") {
+				report.check("ping "+host, pingCassandra(host))
+			}
+			reports = append(reports, report)
+		}
+		if url := cfg.Section("RABBITMQ").Key("url").Value(); url != "" {
+			report := &checkReport{section: "RABBITMQ"}
+			for _, u := range strings.Split(url, ",") {
+				// 输出中隐去账号密码
+				label := "ping " + u
+				if uri, err := amqp.ParseURI(strings.TrimSpace(u)); err == nil {
+					label = fmt.Sprintf("ping %s:%d", uri.Host, uri.Port)
+				}
+				report.check(label, pingRabbitmq(u))
+			}
+			reports = append(reports, report)
+		}
+	}
+
+	// 插件自检时仅输出告警信息
+	watchDog := watchdog.NewWatchdog().SetLogger(log.NewConsoleLogger())
+	for _, section := range cfg.Sections() {
+		if !plugins.IsPluginSection(section) {
+			continue
+		}
+		reports = append(reports, checkPlugin(watchDog, section))
+	}
+
+	failures := 0
+	for _, report := range reports {
+		report.print()
+		if len(report.errs) > 0 {
+			failures++
+		}
+	}
+	return failures
+}
+
+func checkPlugin(watchDog *watchdog.Watchdog, section *ini.Section) *checkReport {
+	report := &checkReport{section: section.Name()}
+
+	plugin, err := plugins.New(section)
+	if err != nil {
+		report.check("plugin", err)
+		return report
+	}
+	if !plugin.IsActive() {
+		report.skip("switch off")
+		return report
+	}
+	report.check("AutoCheck", plugin.AutoCheck(watchDog))
+
+	rule := plugin.NewRule()
+	report.check(ruleLabel(rule), rule.Validate())
+	// 仅监听网络端口的插件无需检查目录
+	if rule.MonitPath != "" {
+		report.check("watch "+rule.MonitPath+" readable", checkReadable(rule.MonitPath))
+	}
+	return report
+}
+
+// 仅列出已配置的匹配规则
+func ruleLabel(rule *fsnotify.Rule) string {
+	label := "patterns " + rule.Patterns + " ignores " + rule.Ignores
+	for _, c := range []struct {
+		name  string
+		exprs []string
+	}{
+		{"include", rule.Includes},
+		{"exclude", rule.Excludes},
+		{"file_include", rule.FileIncludes},
+		{"file_exclude", rule.FileExcludes},
+		{"dir_include", rule.DirIncludes},
+		{"dir_exclude", rule.DirExcludes},
+	} {
+		if len(c.exprs) > 0 {
+			label += " " + c.name + " " + strings.Join(c.exprs, " ")
+		}
+	}
+	return label
+}
+
+func checkReadable(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	// 网络目录需要实际读取才能发现权限问题
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// 目录尚不存在时检查最近的已存在的上级目录，启动时再创建，检查本身不创建目录
+func checkWritable(dir string) error {
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	f, err := ioutil.TempFile(dir, ".logagent-test-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func pingKafka(brokers string) error {
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_0_1_0
+	config.Net.DialTimeout = PING_TIMEOUT
+	config.Metadata.Retry.Max = 0
+	client, err := sarama.NewClient(strings.Split(brokers, ","), config)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+func pingRabbitmq(url string) error {
+	conn, err := amqp.DialConfig(strings.TrimSpace(url), amqp.Config{Dial: amqp.DefaultDial(PING_TIMEOUT)})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func pingCassandra(host string) error {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "9042")
+	}
+	conn, err := net.DialTimeout("tcp", host, PING_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
 }
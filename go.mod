@@ -5,6 +5,7 @@ go 1.12
 require (
 	github.com/Jeffail/tunny v0.0.0-20181108205650-4921fff29480
 	github.com/Shopify/sarama v1.22.1
+	github.com/bmatcuk/doublestar v1.3.4
 	github.com/dgraph-io/badger v1.6.0
 	github.com/djherbis/times v1.2.0
 	github.com/fastly/go-utils v0.0.0-20180712184237-d95a45783239 // indirect
@@ -19,8 +20,11 @@ require (
 	github.com/lestrrat-go/strftime v0.0.0-20190725011945-5c849dd2c51d // indirect
 	github.com/otiai10/copy v1.0.1
 	github.com/otiai10/curr v0.0.0-20190513014714-f5a3d24e5776 // indirect
+	github.com/prometheus/client_golang v1.2.1
+	github.com/robfig/cron v1.2.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/smartystreets/goconvey v0.0.0-20190731233626-505e41936337 // indirect
+	github.com/streadway/amqp v1.1.0
 	github.com/tebeka/strftime v0.1.3 // indirect
 	golang.org/x/text v0.3.2
 	gopkg.in/ini.v1 v1.48.0 // indirect
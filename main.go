@@ -14,6 +14,10 @@ import (
 const Usage = `
   Usage:
     throttle <ops> [<duration>]
+    throttle -t <config> [-p]
+    throttle status [-c <config>]
+    throttle poisoned (requeue|discard) <path> [-c <config>]
+    throttle reassemble <topic> <output> [-c <config>]
     throttle -h | --help
     throttle --version
   Options:
@@ -39,7 +43,7 @@ func (p *program) run() {
 }
 
 func (p *program) Stop(s service.Service) error {
-	return nil
+	return cmd.Stop()
 }
 
 func getDefaultConfigPath() (string, error) {
@@ -54,6 +58,11 @@ func getDefaultConfigPath() (string, error) {
 
 func main() {
 	// runtime.GOMAXPROCS(runtime.NumCPU() / 2.0)
+	cmd.Build = cmd.BuildInfo{
+		GitCommit: GIT_COMMIT,
+		BuildTime: BUILD_TIME,
+		GoVersion: GO_VERSION,
+	}
 
 	//服务的配置信息
 	configPath, err := getDefaultConfigPath()
@@ -99,14 +108,47 @@ func main() {
 		if len(args) < 3 {
 			log.Fatal(Usage)
 		}
-		cmd.Test()
+		// -p 同时检查Kafka/Cassandra/RabbitMQ的连通性
+		ping := len(args) > 3 && (args[3] == "-p" || args[3] == "--ping")
+		if failures := cmd.Test(ping); failures > 0 {
+			log.Fatalf("configuration file %s test failed, %d section(s) with errors", args[2], failures)
+		}
+		log.Printf("configuration file %s test is successful", args[2])
 	case "start", "stop", "restart", "install", "uninstall":
 		// Ps: 需要拥有管理员的权限
 		if err = service.Control(s, os.Args[1]); err != nil {
 			log.Fatal(err)
 		}
 	case "status":
-		// TODO:查看当前程序运行状态
+		// 服务状态由系统服务管理器提供，运行详情则通过本地管理接口查询
+		state := "unknown"
+		if st, err := s.Status(); err == service.ErrNotInstalled {
+			state = "not installed"
+		} else if err == nil && st == service.StatusRunning {
+			state = "running"
+		} else if err == nil && st == service.StatusStopped {
+			state = "stopped"
+		}
+		if err = cmd.Status(state); err != nil {
+			log.Fatalf("Fail to query agent status: %s", err)
+		}
+	case "poisoned":
+		// 超过重试上限的事件需人工重新投递或放弃
+		if len(args) < 4 || (args[2] != "requeue" && args[2] != "discard") {
+			log.Fatal(Usage)
+		}
+		if err = cmd.Poisoned(args[2], args[3]); err != nil {
+			log.Fatalf("Fail to %s poisoned event %s: %s", args[2], args[3], err)
+		}
+		log.Printf("%s poisoned event %s successfully", args[2], args[3])
+	case "reassemble":
+		// 从Kafka中还原文件，分片的消息重组后校验
+		if len(args) < 4 {
+			log.Fatal(Usage)
+		}
+		if err = cmd.Reassemble(args[2], args[3]); err != nil {
+			log.Fatalf("Fail to reassemble files from %s: %s", args[2], err)
+		}
 	default:
 		log.Fatal(Usage)
 	}
@@ -0,0 +1,112 @@
+package plugins
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/cobolbaby/log-agent/watchdog/watcher"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// 接收网络设备、PLC等推送的syslog，e.g. [SYSLOG.PLC]
+// 记录按发送方主机以及应用合批，同文件事件一样经由CheckFile/Transform钩子后交由各适配器处理
+type SYSLOG struct {
+	DefaultPlugin
+}
+
+func (this *SYSLOG) AutoCheck(watchDog *watchdog.Watchdog) error {
+	watchDog.Logger.Infof(this.Name() + " AutoCheck")
+
+	if !this.Config.HasKey("listen") || this.Config.Key("listen").Value() == "" {
+		return fmt.Errorf("No config %q in section %q", "listen", this.Name())
+	}
+	for _, addr := range this.listen() {
+		if _, _, err := watcher.ParseListenAddr(addr); err != nil {
+			return fmt.Errorf("Invalid listen in section %q: %s", this.Name(), err)
+		}
+	}
+	if _, err := this.tlsConfig(); err != nil {
+		return fmt.Errorf("Invalid tls config in section %q: %s", this.Name(), err)
+	}
+	if this.cassandraEnabled() {
+		return fmt.Errorf("Cassandra does not support syslog records in section %q", this.Name())
+	}
+	return nil
+}
+
+// 无需监听目录，记录到达即处理
+func (this *SYSLOG) NewRule() *fsnotify.Rule {
+	return &fsnotify.Rule{
+		Biz:          this.Name(),
+		Mode:         fsnotify.MODE_TAIL,
+		Backpressure: fsnotify.BACKPRESSURE_BLOCK,
+		OnDelete:     fsnotify.DELETE_IGNORE,
+	}
+}
+
+func (this *SYSLOG) AutoInit(watchDog *watchdog.Watchdog) error {
+	watchDog.Logger.Infof(this.Name() + " AutoInit")
+
+	watchDog.SetRules(this.Name(), this.NewRule())
+	watchDog.SetWatchStrategy(this.Name(), []string{watcher.SYSLOG})
+
+	tlsConfig, err := this.tlsConfig()
+	if err != nil {
+		return err
+	}
+	watchDog.AddSource(this.Name(), watcher.NewSyslogWatcher(&watcher.SyslogConfig{
+		Listen:    this.listen(),
+		TLS:       tlsConfig,
+		BatchSize: this.Config.Key("batch_size").MustInt(watcher.SYSLOG_BATCH_SIZE),
+		BatchWait: time.Duration(this.Config.Key("batch_wait").MustUint(uint(watcher.SYSLOG_BATCH_WAIT/time.Millisecond))) * time.Millisecond,
+	}))
+
+	return this.mountAdapters(watchDog)
+}
+
+// e.g. listen = udp://0.0.0.0:514,tcp://0.0.0.0:514,tls://0.0.0.0:6514
+func (this *SYSLOG) listen() []string {
+	var addrs []string
+	for _, addr := range strings.Split(this.Config.Key("listen").Value(), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// 未配置证书时返回nil，配置了tls_ca时要求客户端提供证书
+func (this *SYSLOG) tlsConfig() (*tls.Config, error) {
+	certFile := this.Config.Key("tls_cert").Value()
+	keyFile := this.Config.Key("tls_key").Value()
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile := this.Config.Key("tls_ca").Value(); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func init() {
+	Register(&SYSLOG{})
+}
@@ -4,12 +4,16 @@ import (
 	. "github.com/cobolbaby/log-agent/utils"
 	"github.com/cobolbaby/log-agent/watchdog"
 	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/cobolbaby/log-agent/watchdog/lib/completeness"
 	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
 	"github.com/cobolbaby/log-agent/watchdog/lib/hook"
+	"github.com/cobolbaby/log-agent/watchdog/lib/multiline"
 	"github.com/cobolbaby/log-agent/watchdog/watcher"
+	"crypto/md5"
 	"errors"
 	"fmt"
 	"github.com/go-ini/ini"
+	"io"
 	"log"
 	"path/filepath"
 	"reflect"
@@ -18,7 +22,6 @@ import (
 )
 
 var (
-	cfg     = ConfigMgr()
 	structs = make(map[string]reflect.Type)
 )
 
@@ -26,6 +29,7 @@ type Plugin interface {
 	SetAttr(string, interface{}) Plugin
 	Name() string
 	IsActive() bool
+	NewRule() *fsnotify.Rule
 	AutoCheck(*watchdog.Watchdog) error
 	AutoInit(*watchdog.Watchdog) error
 	Mount(*watchdog.Watchdog) error
@@ -38,6 +42,8 @@ type DefaultPlugin struct {
 	BizName     string
 	Description string
 	Config      *ini.Section
+	digest      string
+	checker     *completeness.Chain // 文件完整性检测，未配置时为nil
 }
 
 func (this *DefaultPlugin) SetAttr(attr string, val interface{}) Plugin {
@@ -46,6 +52,7 @@ func (this *DefaultPlugin) SetAttr(attr string, val interface{}) Plugin {
 		this.BizName = val.(string)
 	case "Config":
 		this.Config = val.(*ini.Section)
+		this.digest = digest(this.Config)
 	}
 	return this
 }
@@ -73,9 +80,23 @@ func (this *DefaultPlugin) AutoCheck(watchDog *watchdog.Watchdog) error {
 		if this.Config.HasKey(k) && this.Config.Key(k).Value() != "" {
 			continue
 		}
+		// 仅接收上传的业务无需监听目录
+		if this.ingestToken() != "" {
+			continue
+		}
 		errmsg := fmt.Sprintf("No config %q in section %q", k, this.Name())
 		return errors.New(errmsg)
 	}
+	// 匹配规则有误时提前报错，避免运行时panic
+	if err := this.NewRule().Validate(); err != nil {
+		return fmt.Errorf("Invalid rule in section %q: %s", this.Name(), err)
+	}
+	if _, err := this.NewChecker(); err != nil {
+		return fmt.Errorf("Invalid complete_check in section %q: %s", this.Name(), err)
+	}
+	if this.cassandraEnabled() && this.Config.Key("mode").Value() == fsnotify.MODE_TAIL {
+		return fmt.Errorf("Cassandra does not support mode %q in section %q", fsnotify.MODE_TAIL, this.Name())
+	}
 	return nil
 }
 
@@ -89,9 +110,10 @@ func (this *DefaultPlugin) CheckFile(watchDog *watchdog.Watchdog, file *handler.
 	// 扩展代码...
 	// 检查即时生成文件的创建时间，确认机器时间设置是否正确
 	// 如果时间区间偏差太大，则延迟抛出问
-	// 如何通过检查的结果控制后续流程是否执行
-	if file.LastOp.Op != "LOAD" {
-		return nil
+
+	// 文件尚未写完时返回IncompleteError，由Watchdog延迟后重新处理
+	if this.checker != nil {
+		return this.checker.Check(file.Filepath)
 	}
 
 	return nil
@@ -112,54 +134,98 @@ func (this *DefaultPlugin) Transform(watchDog *watchdog.Watchdog, file *handler.
 func (this *DefaultPlugin) AutoInit(watchDog *watchdog.Watchdog) error {
 	watchDog.Logger.Infof(this.Name() + " AutoInit")
 
-	watchDog.SetRules(this.Name(), &fsnotify.Rule{
-		Biz:             this.Name(),
-		RootPath:        this.Config.Key("watch").Value(),
-		MonitPath:       filepath.Join(this.Config.Key("watch").Value(), this.Config.Key("subdir").Value()),
-		Patterns:        this.Config.Key("patterns").Value(),
-		Ignores:         this.Config.Key("ignores").Value(),
-		MaxNestingLevel: this.Config.Key("max_nesting_level").MustUint(0),
-		DebounceTime:    time.Duration(this.Config.Key("debounce").MustUint(3000)) * time.Millisecond, // 文件系统事件延迟处理时间. 每种业务的处理机制是不一样的, 可以设置一个默认的, 然后也可以针对单一业务做配置覆盖.
-	})
+	watchDog.SetRules(this.Name(), this.NewRule())
 
-	watchStrategy := []string{watcher.FS_NOTIFY}
-	if !this.Config.HasKey("history_import") || (this.Config.HasKey("history_import") && this.Config.Key("history_import").MustBool() == true) {
-		watchStrategy = append(watchStrategy, watcher.FS_POLL)
+	checker, err := this.NewChecker()
+	if err != nil {
+		return err
+	}
+	this.checker = checker
+
+	var watchStrategy []string
+	if this.Config.Key("watch").Value() != "" {
+		watchStrategy = append(watchStrategy, watcher.FS_NOTIFY)
+		if !this.Config.HasKey("history_import") || (this.Config.HasKey("history_import") && this.Config.Key("history_import").MustBool() == true) {
+			watchStrategy = append(watchStrategy, watcher.FS_POLL)
+		}
+	}
+	// 接收HTTP上传的文件
+	if token := this.ingestToken(); token != "" {
+		watchStrategy = append(watchStrategy, watcher.INGEST)
+		watchDog.AddSource(this.Name(), watcher.NewIngestWatcher(this.ingestConfig(watchDog, token)))
 	}
 	watchDog.SetWatchStrategy(this.Name(), watchStrategy)
 
+	return this.mountAdapters(watchDog)
+}
+
+// 依据配置挂载适配器
+func (this *DefaultPlugin) mountAdapters(watchDog *watchdog.Watchdog) error {
 	// 历史版本直接上传Cassandra
-	if this.Config.HasKey("cassandra_hosts") && this.Config.HasKey("cassandra_keyspace") && this.Config.HasKey("cassandra_table") {
-		CassandraAdapter, err := handler.NewCassandraAdapter(&handler.CassandraAdapterCfg{
+	if this.cassandraEnabled() {
+		cfg := &handler.CassandraAdapterCfg{
 			Hosts:     this.Config.Key("cassandra_hosts").Value(),
 			Keyspace:  this.Config.Key("cassandra_keyspace").Value(),
 			TableName: this.Config.Key("cassandra_table").Value(),
-		})
-		if err != nil {
-			return err
 		}
-		watchDog.AddHandler(this.Name(), CassandraAdapter)
+		if !watchDog.ReuseHandler(this.Name(), cfg) {
+			CassandraAdapter, err := handler.NewCassandraAdapter(cfg)
+			if err != nil {
+				return err
+			}
+			watchDog.AddHandler(this.Name(), CassandraAdapter)
+		}
 	}
 
 	// 新版本先上传至Kafka
 	if this.Config.HasKey("kafka_brokers") && this.Config.HasKey("kafka_topic") {
-		KafkaAdapter, err := handler.NewKafkaAdapter(&handler.KafkaAdapterCfg{
+		// 生产者按broker列表共享，故攒批配置仅在[KAFKA]中设置
+		kafka := ConfigMgr().Section("KAFKA")
+		cfg := &handler.KafkaAdapterCfg{
 			Brokers:        this.Config.Key("kafka_brokers").Value(),
 			Topic:          this.Config.Key("kafka_topic").Value(),
 			SchemaRegistry: this.Config.Key("kafka_schema_registry").Value(),
-		})
-		if err != nil {
-			return err
+			Format:         this.Config.Key("kafka_format").MustString(kafka.Key("format").MustString(handler.KAFKA_FORMAT_JSON)),
+			Async:          kafka.Key("async").MustBool(false),
+			Linger:         time.Duration(kafka.Key("linger").MustUint(uint(handler.KAFKA_LINGER/time.Millisecond))) * time.Millisecond,
+			BatchSize:      kafka.Key("batch_size").MustInt(handler.KAFKA_BATCH_SIZE),
+			ChunkSize:      kafka.Key("chunk_size").MustInt(handler.KAFKA_CHUNK_SIZE),
+			LineTopic:      this.Config.Key("kafka_line_topic").Value(),
+		}
+		if !watchDog.ReuseHandler(this.Name(), cfg) {
+			KafkaAdapter, err := handler.NewKafkaAdapter(cfg)
+			if err != nil {
+				return err
+			}
+			watchDog.AddHandler(this.Name(), KafkaAdapter)
+		}
+	}
+
+	// 推送至RabbitMQ，消息经broker确认后才视为成功
+	if this.Config.Key("rabbitmq_url").Value() != "" && (this.Config.HasKey("rabbitmq_exchange") || this.Config.HasKey("rabbitmq_routing_key")) {
+		cfg := &handler.RabbitmqAdapterCfg{
+			URL:        this.Config.Key("rabbitmq_url").Value(),
+			Exchange:   this.Config.Key("rabbitmq_exchange").Value(),
+			RoutingKey: this.Config.Key("rabbitmq_routing_key").Value(),
+		}
+		if !watchDog.ReuseHandler(this.Name(), cfg) {
+			RabbitmqAdapter, err := handler.NewRabbitmqAdapter(cfg)
+			if err != nil {
+				return err
+			}
+			watchDog.AddHandler(this.Name(), RabbitmqAdapter)
 		}
-		watchDog.AddHandler(this.Name(), KafkaAdapter)
 	}
 
 	// 本地备份操作
 	if this.Config.HasKey("backup") && this.Config.Key("backup").Value() != "" {
-		FileAdapter, _ := handler.NewFileAdapter(&handler.FileAdapterCfg{
+		cfg := &handler.FileAdapterCfg{
 			DestRoot: this.Config.Key("backup").Value(),
-		})
-		watchDog.AddHandler(this.Name(), FileAdapter)
+		}
+		if !watchDog.ReuseHandler(this.Name(), cfg) {
+			FileAdapter, _ := handler.NewFileAdapter(cfg)
+			watchDog.AddHandler(this.Name(), FileAdapter)
+		}
 	}
 
 	// TODO:连接消息总线，维持长连接
@@ -167,6 +233,117 @@ func (this *DefaultPlugin) AutoInit(watchDog *watchdog.Watchdog) error {
 	return nil
 }
 
+// Cassandra以文件为主键，不支持tail模式的增量行以及syslog记录
+func (this *DefaultPlugin) cassandraEnabled() bool {
+	return this.Config.HasKey("cassandra_hosts") && this.Config.HasKey("cassandra_keyspace") && this.Config.HasKey("cassandra_table")
+}
+
+func (this *DefaultPlugin) ingestToken() string {
+	return this.Config.Key("ingest_token").Value()
+}
+
+// 监听地址等由各业务共用，配置于[INGEST]
+func (this *DefaultPlugin) ingestConfig(watchDog *watchdog.Watchdog, token string) *watcher.IngestConfig {
+	section := ConfigMgr().Section("INGEST")
+	return &watcher.IngestConfig{
+		Listen:   section.Key("listen").MustString(watcher.INGEST_LISTEN),
+		Token:    token,
+		Spool:    section.Key("spool").MustString(filepath.Join(watchDog.DataPath(), "spool")),
+		MaxSize:  section.Key("max_size").MustInt64(watcher.INGEST_MAX_SIZE),
+		CertFile: section.Key("tls_cert").Value(),
+		KeyFile:  section.Key("tls_key").Value(),
+	}
+}
+
+// 依据配置生成监听规则，匹配规则在此编译，有误时由AutoCheck报错
+func (this *DefaultPlugin) NewRule() *fsnotify.Rule {
+	rule := &fsnotify.Rule{
+		Biz:               this.Name(),
+		RootPath:          this.Config.Key("watch").Value(),
+		MonitPath:         filepath.Join(this.Config.Key("watch").Value(), this.Config.Key("subdir").Value()),
+		Patterns:          this.Config.Key("patterns").Value(),
+		Ignores:           this.Config.Key("ignores").Value(),
+		MaxNestingLevel:   this.Config.Key("max_nesting_level").MustUint(0),
+		DebounceTime:      time.Duration(this.Config.Key("debounce").MustUint(3000)) * time.Millisecond, // 文件系统事件延迟处理时间. 每种业务的处理机制是不一样的, 可以设置一个默认的, 然后也可以针对单一业务做配置覆盖.
+		ChangePolicy:      this.Config.Key("change_detect").MustString(fsnotify.CHANGE_POLICY_MTIME),
+		Mode:              this.Config.Key("mode").MustString(fsnotify.MODE_FILE),
+		MultilineStart:    this.Config.Key("multiline_start").Value(),
+		MultilineContinue: this.Config.Key("multiline_continue").Value(),
+		MultilineFlush:    time.Duration(this.Config.Key("multiline_flush").MustUint(uint(multiline.FLUSH_TIMEOUT/time.Millisecond))) * time.Millisecond,
+		QueueCap:          this.Config.Key("source_queue_cap").MustInt(0),
+		Backpressure:      this.Config.Key("backpressure").MustString(ConfigMgr().Section("").Key("backpressure").MustString(fsnotify.BACKPRESSURE_BLOCK)),
+		OnDelete:          this.Config.Key("on_delete").MustString(fsnotify.DELETE_IGNORE),
+		Includes:          this.values("include"),
+		Excludes:          this.values("exclude"),
+		FileIncludes:      this.values("file_include"),
+		FileExcludes:      this.values("file_exclude"),
+		DirIncludes:       this.values("dir_include"),
+		DirExcludes:       this.values("dir_exclude"),
+		MinSize:           this.Config.Key("min_size").MustInt64(0),
+		MaxSize:           this.Config.Key("max_size").MustInt64(0),
+		MinAge:            time.Duration(this.Config.Key("min_age").MustUint(0)) * time.Second,
+		MaxAge:            time.Duration(this.Config.Key("max_age").MustUint(0)) * time.Second,
+		PollSchedules:     this.values("poll_schedule"),
+		PollWindow:        this.Config.Key("poll_window").Value(),
+		ScanWorkers:       this.Config.Key("scan_workers").MustInt(fsnotify.WALK_WORKERS),
+	}
+	// tail模式下文件原地追加，目录不会随之变化，缺省每次都逐一检查
+	rule.ScanIncremental = this.Config.Key("scan_incremental").MustBool(rule.Mode != fsnotify.MODE_TAIL)
+	// 配置了定时任务时缺省不再按固定间隔轮询
+	interval := uint(watcher.FS_POLL_INTERVAL / time.Second)
+	if len(rule.PollSchedules) > 0 {
+		interval = 0
+	}
+	rule.PollInterval = time.Duration(this.Config.Key("poll_interval").MustUint(interval)) * time.Second
+	rule.Compile()
+	return rule
+}
+
+// 读取可重复出现的配置项，未配置时返回nil
+func (this *DefaultPlugin) values(key string) []string {
+	if !this.Config.HasKey(key) {
+		return nil
+	}
+	var values []string
+	for _, v := range this.Config.Key(key).ValueWithShadows() {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// 依据配置生成文件完整性检测链，e.g. complete_check = stable,zip
+func (this *DefaultPlugin) NewChecker() (*completeness.Chain, error) {
+	var strategies []string
+	if v := this.Config.Key("complete_check").Value(); v != "" {
+		strategies = strings.Split(v, ",")
+	}
+	return completeness.New(strategies, completeness.Options{
+		Probes:   this.Config.Key("complete_probes").MustInt(completeness.STABLE_PROBES),
+		Interval: time.Duration(this.Config.Key("complete_interval").MustUint(uint(completeness.STABLE_INTERVAL/time.Millisecond))) * time.Millisecond,
+		Marker:   this.Config.Key("complete_marker").MustString(completeness.MARKER_SUFFIX),
+		Delay:    time.Duration(this.Config.Key("complete_retry_delay").MustUint(uint(completeness.RETRY_DELAY/time.Millisecond))) * time.Millisecond,
+		Timeout:  time.Duration(this.Config.Key("complete_timeout").MustUint(uint(completeness.TIMEOUT/time.Second))) * time.Second,
+	})
+}
+
+// 配置指纹，热加载时据此判断插件配置是否变更
+func (this *DefaultPlugin) Fingerprint() string {
+	return this.digest
+}
+
+// 读取缺省配置项时ini会补全该配置项，故需在加载配置时计算指纹
+func digest(section *ini.Section) string {
+	h := md5.New()
+	for _, key := range section.Keys() {
+		for _, v := range key.ValueWithShadows() {
+			io.WriteString(h, key.Name()+"="+v+"\n")
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 // 添加业务特殊处理(同步目录)
 func (this *DefaultPlugin) Mount(watchDog *watchdog.Watchdog) error {
 
@@ -189,27 +366,60 @@ func Register(plugin Plugin) {
 	structs[t.Name()] = t
 }
 
+// 依据配置节实例化插件，节名的首段即为插件名，e.g. [ICT.3070.DETAIL] => ICT
+func New(section *ini.Section) (Plugin, error) {
+	name := pluginName(section)
+	// 还是得研究一下反射那块
+	t, ok := structs[name]
+	if !ok {
+		return nil, fmt.Errorf("Plugin %q not yet exists :)", name)
+	}
+	plugin := reflect.New(t).Interface().(Plugin)
+	cfg := ConfigMgr()
+	// 动态设置配置信息，覆盖节中的同名配置项(允许重复配置项时NewKey仅追加)
+	// 历史版本直接上传Cassandra
+	section.Key("cassandra_hosts").SetValue(cfg.Section("CASSANDRA").Key("hosts").Value())
+	// 新版本先上传至Kafka
+	section.Key("kafka_brokers").SetValue(cfg.Section("KAFKA").Key("brokers").Value())
+	section.Key("kafka_schema_registry").SetValue(cfg.Section("KAFKA").Key("schema_registry").Value())
+	section.Key("rabbitmq_url").SetValue(cfg.Section("RABBITMQ").Key("url").Value())
+	plugin.SetAttr("BizName", section.Name()).SetAttr("Config", section)
+	return plugin, nil
+}
+
 func Autoload() []hook.AdvancePlugin {
+	plugins, err := Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return plugins
+}
+
+func pluginName(section *ini.Section) string {
+	return strings.ToUpper(strings.Split(section.Name(), ".")[0])
+}
+
+// 配置了监听目录或上传令牌的配置节即为插件配置，监听端口的插件(如SYSLOG)需已注册，以区分[INGEST]等全局配置
+func IsPluginSection(section *ini.Section) bool {
+	if section.HasKey("watch") || section.HasKey("ingest_token") {
+		return true
+	}
+	_, ok := structs[pluginName(section)]
+	return ok && section.HasKey("listen")
+}
+
+// 依据当前配置加载所有激活的插件，热加载时使用
+func Load() ([]hook.AdvancePlugin, error) {
 	var plugins []hook.AdvancePlugin
 
-	for _, v := range cfg.Sections() {
-		if !v.HasKey("watch") {
+	for _, v := range ConfigMgr().Sections() {
+		if !IsPluginSection(v) {
 			continue
 		}
-		name := strings.ToUpper(strings.Split(v.Name(), ".")[0])
-		// 还是得研究一下反射那块
-		t, ok := structs[name]
-		if !ok {
-			log.Fatalf("Plugin %q not yet exists :)", name)
-		}
-		plugin := reflect.New(t).Interface().(Plugin)
-		// 动态设置配置信息
-		// 历史版本直接上传Cassandra
-		v.NewKey("cassandra_hosts", cfg.Section("CASSANDRA").Key("hosts").Value())
-		// 新版本先上传至Kafka
-		v.NewKey("kafka_brokers", cfg.Section("KAFKA").Key("brokers").Value())
-		v.NewKey("kafka_schema_registry", cfg.Section("KAFKA").Key("schema_registry").Value())
-		plugin.SetAttr("BizName", v.Name()).SetAttr("Config", v)
+		plugin, err := New(v)
+		if err != nil {
+			return nil, err
+		}
 		// 判断插件是否处于激活状态
 		if !plugin.IsActive() {
 			continue
@@ -217,5 +427,5 @@ func Autoload() []hook.AdvancePlugin {
 		plugins = append(plugins, plugin)
 	}
 
-	return plugins
+	return plugins, nil
 }
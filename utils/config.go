@@ -2,29 +2,91 @@ package utils
 
 import (
 	"github.com/go-ini/ini"
+	"github.com/kardianos/osext"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 var (
-	iniCfg *ini.File
+	iniCfg  *ini.File
+	cfgLock sync.Mutex
+	// 可重复出现的列表配置项，其余配置项重复时以最后一次为准
+	listKeys = map[string]bool{
+		"include":       true,
+		"exclude":       true,
+		"file_include":  true,
+		"file_exclude":  true,
+		"dir_include":   true,
+		"dir_exclude":   true,
+		"poll_schedule": true,
+	}
 )
 
 func ConfigMgr() *ini.File {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
 	if iniCfg != nil {
 		return iniCfg
 	}
+	var err error
+	iniCfg, err = loadConfig(ConfigPath())
+	if err != nil {
+		log.Fatalf("Failed to Load configuration: %v", err)
+	}
+	return iniCfg
+}
+
+// 重新读取配置文件，读取失败时沿用原有配置
+func ReloadConfig() (*ini.File, error) {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	cfg, err := loadConfig(ConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	iniCfg = cfg
+	return iniCfg, nil
+}
+
+// 配置文件路径
+func ConfigPath() string {
 	filename := filepath.Join("conf", "logagent.ini")
-	if len(os.Args) == 3 && os.Args[1] == "-c" {
-		filename = os.Args[2]
+	// 未在当前目录找到配置时，使用程序所在目录下的配置
+	if _, err := os.Stat(filename); err != nil {
+		if fullexecpath, err := osext.Executable(); err == nil {
+			filename = filepath.Join(filepath.Dir(fullexecpath), "conf", "logagent.ini")
+		}
 	}
-	var err error
-	iniCfg, err = ini.LoadSources(ini.LoadOptions{
+	// e.g. logagent -c conf.ini / logagent -t conf.ini / logagent status -c conf.ini
+	for i, arg := range os.Args {
+		if (arg == "-c" || arg == "-t") && i+1 < len(os.Args) {
+			filename = os.Args[i+1]
+		}
+	}
+	return filename
+}
+
+func loadConfig(filename string) (*ini.File, error) {
+	cfg, err := ini.LoadSources(ini.LoadOptions{
 		SkipUnrecognizableLines: true,
+		// 同名配置项可重复出现，e.g. 多条include规则
+		AllowShadows: true,
 	}, filename)
 	if err != nil {
-		log.Fatalf("Failed to Load configuration: %v", err)
+		return nil, err
 	}
-	return iniCfg
+	// 开启AllowShadows后Value()返回首次出现的值，非列表配置项需保持以最后一次为准
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			values := key.ValueWithShadows()
+			if len(values) < 2 || listKeys[key.Name()] {
+				continue
+			}
+			section.DeleteKey(key.Name())
+			section.NewKey(key.Name(), values[len(values)-1])
+		}
+	}
+	return cfg, nil
 }
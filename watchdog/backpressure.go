@@ -0,0 +1,244 @@
+package watchdog
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"github.com/cobolbaby/log-agent/watchdog/watcher"
+	"github.com/dgraph-io/badger"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SPILL_PREFIX         = "_spill:"        // 溢出至磁盘的事件
+	SPILL_DRAIN_INTERVAL = time.Second      // 溢出事件回填间隔
+	OVERFLOW_SCAN_DELAY  = 30 * time.Second // 丢弃事件后延迟补扫目录，等待突发流量平复
+)
+
+// 流水线各环节的容量以及并发配置
+type PipelineOptions struct {
+	SourceQueueCap int           // 单一业务的事件通道容量
+	CacheQueueCap  int           // 缓存通道容量
+	TaskQueueCap   int           // 待处理任务通道容量
+	BatchSize      int           // 单批次最大事件数
+	BatchWindow    time.Duration // 批处理时间窗口
+	Workers        int           // 协程池大小
+}
+
+func DefaultPipelineOptions() PipelineOptions {
+	return PipelineOptions{
+		SourceQueueCap: SOURCE_QUEUE_CAP,
+		CacheQueueCap:  CACHE_QUEUE_CAP,
+		TaskQueueCap:   TASK_QUEUE_CAP,
+		BatchSize:      TASK_CONCURRENCY_CONTROL,
+		BatchWindow:    TASK_BATCH_WINDOW,
+		Workers:        runtime.NumCPU(),
+	}
+}
+
+// 非正数的配置项使用默认值，避免通道无缓冲或协程池为空
+func (this *Watchdog) SetPipelineOptions(opts PipelineOptions) *Watchdog {
+	def := DefaultPipelineOptions()
+	if opts.SourceQueueCap <= 0 {
+		opts.SourceQueueCap = def.SourceQueueCap
+	}
+	if opts.CacheQueueCap <= 0 {
+		opts.CacheQueueCap = def.CacheQueueCap
+	}
+	if opts.TaskQueueCap <= 0 {
+		opts.TaskQueueCap = def.TaskQueueCap
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = def.BatchSize
+	}
+	if opts.BatchWindow <= 0 {
+		opts.BatchWindow = def.BatchWindow
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = def.Workers
+	}
+	this.pipeline = opts
+	return this
+}
+
+// 通道已满时暂存事件，按业务分区并保持写入顺序
+type SpillQueue struct {
+	seq uint64
+	db  *badger.DB
+}
+
+func NewSpillQueue(db *badger.DB) *SpillQueue {
+	return &SpillQueue{
+		db: db,
+	}
+}
+
+func (this *SpillQueue) prefix(biz string) []byte {
+	return []byte(SPILL_PREFIX + biz + "|")
+}
+
+func (this *SpillQueue) Push(e *fsnotify.Event) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(e); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%020d-%010d", this.prefix(e.Biz), time.Now().UnixNano(), atomic.AddUint64(&this.seq, 1))
+	return this.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), buf.Bytes())
+	})
+}
+
+// 读取最早溢出的若干事件，事件回填后再依据返回的key删除
+func (this *SpillQueue) Peek(biz string, limit int) ([]*fsnotify.Event, [][]byte, error) {
+	var events []*fsnotify.Event
+	var keys [][]byte
+	err := this.db.View(func(txn *badger.Txn) error {
+		prefix := this.prefix(biz)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix) && len(events) < limit; it.Next() {
+			item := it.Item()
+			e := new(fsnotify.Event)
+			err := item.Value(func(val []byte) error {
+				return gob.NewDecoder(bytes.NewReader(val)).Decode(e)
+			})
+			if err != nil {
+				return err
+			}
+			events = append(events, e)
+			keys = append(keys, item.KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return events, keys, nil
+}
+
+func (this *SpillQueue) Delete(keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return this.db.Update(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 依据业务的背压策略生成通道溢出时的处理函数，阻塞策略无需处理
+func (this *Watchdog) overflowHandler(rule *fsnotify.Rule) func(e *fsnotify.Event) {
+	switch rule.Backpressure {
+	case fsnotify.BACKPRESSURE_SPILL:
+		return func(e *fsnotify.Event) {
+			this.overflow(rule, e)
+			if err := this.spill.Push(e); err != nil {
+				this.Logger.Errorf("Fail to spill %s event %s: %s", rule.Biz, e.Name, err)
+				this.scheduleOverflowScan(rule)
+			}
+		}
+	case fsnotify.BACKPRESSURE_DROP:
+		return func(e *fsnotify.Event) {
+			this.overflow(rule, e)
+			this.scheduleOverflowScan(rule)
+		}
+	default:
+		return nil
+	}
+}
+
+func (this *Watchdog) overflow(rule *fsnotify.Rule, e *fsnotify.Event) {
+	this.Logger.Warnf("The source queue of %s is full, %s %s event: %s", rule.Biz, rule.Backpressure, e.Op, e.Name)
+	metrics.EventsOverflowed.WithLabelValues(rule.Biz, rule.Backpressure).Inc()
+	this.stats.overflow(rule.Biz)
+}
+
+// 通道空闲时将溢出的事件回填至事件通道，未回填的事件在重启后继续处理
+// 回填的事件可能晚于后续捕获的事件，但文件内容以处理时为准，故不影响结果
+func (this *Watchdog) unspill(rule *fsnotify.Rule, srcChan chan *fsnotify.Event) {
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(SPILL_DRAIN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rule.Done:
+			return
+		case <-ticker.C:
+		}
+		// 持续回填直至磁盘中无溢出事件，通道已满时阻塞等待
+		resumed := 0
+		for {
+			free := cap(srcChan) - len(srcChan)
+			if free <= 0 {
+				free = 1
+			}
+			events, keys, err := this.spill.Peek(rule.Biz, free)
+			if err != nil {
+				this.Logger.Errorf("Fail to peek %s spilled events: %s", rule.Biz, err)
+				break
+			}
+			if len(events) == 0 {
+				break
+			}
+			// 回填期间事件计入处理中，以免停机时的排空提前结束而关闭数据库
+			atomic.AddInt64(&this.pending, int64(len(events)))
+			sent, stopped := this.resume(rule, srcChan, events)
+			err = this.spill.Delete(keys[:sent])
+			atomic.AddInt64(&this.pending, -int64(len(events)))
+			resumed += sent
+			if stopped {
+				this.Logger.Infof("Resume %d spilled events of %s, the rest are kept until restart", resumed, rule.Biz)
+				return
+			}
+			if err != nil {
+				// 删除失败的事件稍后会再次回填，文件内容以处理时为准，故不影响结果
+				this.Logger.Errorf("Fail to delete %s spilled events: %s", rule.Biz, err)
+				break
+			}
+		}
+		if resumed > 0 {
+			this.Logger.Infof("Resume %d spilled events of %s", resumed, rule.Biz)
+		}
+	}
+}
+
+// 将事件依次回填至事件通道，返回已回填的事件数。监听停止时未回填的事件仍保留于磁盘
+func (this *Watchdog) resume(rule *fsnotify.Rule, srcChan chan *fsnotify.Event, events []*fsnotify.Event) (int, bool) {
+	for i, e := range events {
+		select {
+		case srcChan <- e:
+		case <-rule.Done:
+			return i, true
+		}
+	}
+	return len(events), false
+}
+
+// 事件被丢弃后补扫一次目录，同一业务同时仅安排一次
+func (this *Watchdog) scheduleOverflowScan(rule *fsnotify.Rule) {
+	if _, scheduled := this.overflowScans.LoadOrStore(rule.Biz, true); scheduled {
+		return
+	}
+	this.Logger.Warnf("Schedule an overflow scan of %s in %s", rule.Biz, OVERFLOW_SCAN_DELAY)
+	go func() {
+		select {
+		case <-rule.Done:
+			this.overflowScans.Delete(rule.Biz)
+			return
+		case <-time.After(OVERFLOW_SCAN_DELAY):
+		}
+		// 补扫期间再次溢出则需重新安排
+		this.overflowScans.Delete(rule.Biz)
+		scanner := watcher.NewFspollingWatcher(this.db).SetLogger(this.Logger).(watcher.Scanner)
+		scanner.Scan(rule, this.cacheQueue)
+	}()
+}
@@ -0,0 +1,305 @@
+package watchdog
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/dgraph-io/badger"
+	"time"
+)
+
+const (
+	DEAD_LETTER_PREFIX  = "_dlq:"          // 待重试的失败事件
+	POISONED_PREFIX     = "_poisoned:"     // 超过重试上限的失败事件，需人工介入
+	RETRY_SCAN_INTERVAL = 5 * time.Second  // 重试调度的扫描间隔
+	RETRY_MAX_ATTEMPTS  = 10               // 默认最大重试次数
+	RETRY_BACKOFF       = 30 * time.Second // 默认首次重试的延迟时间
+	RETRY_MAX_BACKOFF   = 1 * time.Hour    // 默认最大重试延迟时间
+)
+
+var ErrLetterNotFound = errors.New("dead letter not found")
+
+// 失败重试策略，延迟时间按指数递增
+type RetryPolicy struct {
+	MaxAttempts uint
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (this RetryPolicy) Delay(attempts uint) time.Duration {
+	delay := this.Backoff
+	for i := uint(1); i < attempts && delay < this.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > this.MaxBackoff {
+		delay = this.MaxBackoff
+	}
+	return delay
+}
+
+// 处理失败的文件事件
+type DeadLetter struct {
+	File        handler.FileMeta
+	Attempts    uint
+	LastError   string
+	FirstFailed time.Time
+	LastFailed  time.Time
+	NextRetry   time.Time
+}
+
+// 基于badger的死信队列，与文件状态共用同一个库，通过key前缀区分
+type DeadLetterQueue struct {
+	db     *badger.DB
+	policy RetryPolicy
+}
+
+func NewDeadLetterQueue(db *badger.DB, policy RetryPolicy) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		db:     db,
+		policy: policy,
+	}
+}
+
+// 记录一次失败，超过重试上限的事件将被转移至poisoned区
+func (this *DeadLetterQueue) Push(file *handler.FileMeta, cause error) (*DeadLetter, error) {
+	var letter *DeadLetter
+	err := this.db.Update(func(txn *badger.Txn) error {
+		now := time.Now()
+		key := []byte(DEAD_LETTER_PREFIX + file.Filepath)
+
+		letter = &DeadLetter{FirstFailed: now}
+		if item, err := txn.Get(key); err == nil {
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, letter)
+			}); err != nil {
+				return err
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		letter.File = *file
+		// 重试时重新读取文件，非文件来源的记录则随事件(LastOp)保存
+		letter.File.Content = nil
+		letter.File.Records = nil
+		letter.Attempts++
+		letter.LastError = cause.Error()
+		letter.LastFailed = now
+		letter.NextRetry = now.Add(this.policy.Delay(letter.Attempts))
+
+		val, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		if letter.Attempts >= this.policy.MaxAttempts {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+			return txn.Set([]byte(POISONED_PREFIX+file.Filepath), val)
+		}
+		return txn.Set(key, val)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// 文件处理成功后移除对应的失败记录，包括人工重新入队前遗留的poisoned记录
+func (this *DeadLetterQueue) Ack(txn *badger.Txn, path string) error {
+	for _, prefix := range []string{DEAD_LETTER_PREFIX, POISONED_PREFIX} {
+		key := []byte(prefix + path)
+		if _, err := txn.Get(key); err != nil {
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			return err
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 业务被移除后其失败事件不再重试，转入poisoned区以便排查，同时清理对应的投递记录
+func (this *DeadLetterQueue) Park(biz string, reason string) (int, error) {
+	parked := 0
+	err := this.db.Update(func(txn *badger.Txn) error {
+		letters, err := this.scan(txn, DEAD_LETTER_PREFIX, func(l *DeadLetter) bool {
+			return l.File.LastOp != nil && l.File.LastOp.Biz == biz
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range letters {
+			l.LastError = reason
+			val, err := json.Marshal(l)
+			if err != nil {
+				return err
+			}
+			if err := txn.Delete([]byte(DEAD_LETTER_PREFIX + l.File.Filepath)); err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(POISONED_PREFIX+l.File.Filepath), val); err != nil {
+				return err
+			}
+			if err := deletePrefix(txn, LEDGER_PREFIX+l.File.Filepath+"|"); err != nil {
+				return err
+			}
+		}
+		parked = len(letters)
+		return nil
+	})
+	return parked, err
+}
+
+// 取出已到重试时间的事件，同时顺延其下次重试时间，避免处理完成前被重复投递
+func (this *DeadLetterQueue) Due(now time.Time) ([]*DeadLetter, error) {
+	var letters []*DeadLetter
+	err := this.db.Update(func(txn *badger.Txn) error {
+		due, err := this.scan(txn, DEAD_LETTER_PREFIX, func(l *DeadLetter) bool {
+			return !l.NextRetry.After(now)
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range due {
+			l.NextRetry = now.Add(this.policy.Delay(l.Attempts + 1))
+			val, err := json.Marshal(l)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(DEAD_LETTER_PREFIX+l.File.Filepath), val); err != nil {
+				return err
+			}
+		}
+		letters = due
+		return nil
+	})
+	return letters, err
+}
+
+// 将poisoned事件重新放回死信队列，重置重试次数后立即参与下一轮重试，check用于确认事件仍可处理
+func (this *DeadLetterQueue) Requeue(path string, check func(l *DeadLetter) error) (*DeadLetter, error) {
+	var letter *DeadLetter
+	err := this.db.Update(func(txn *badger.Txn) error {
+		var err error
+		if letter, err = this.get(txn, POISONED_PREFIX+path); err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(letter); err != nil {
+				return err
+			}
+		}
+		letter.Attempts = 0
+		letter.NextRetry = time.Now()
+		val, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte(POISONED_PREFIX + path)); err != nil {
+			return err
+		}
+		return txn.Set([]byte(DEAD_LETTER_PREFIX+path), val)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// 放弃poisoned事件，同时清理对应的投递记录
+func (this *DeadLetterQueue) Discard(path string) (*DeadLetter, error) {
+	var letter *DeadLetter
+	err := this.db.Update(func(txn *badger.Txn) error {
+		var err error
+		if letter, err = this.get(txn, POISONED_PREFIX+path); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte(POISONED_PREFIX + path)); err != nil {
+			return err
+		}
+		return deletePrefix(txn, LEDGER_PREFIX+path+"|")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+func (this *DeadLetterQueue) get(txn *badger.Txn, key string) (*DeadLetter, error) {
+	item, err := txn.Get([]byte(key))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrLetterNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	letter := new(DeadLetter)
+	if err := item.Value(func(val []byte) error {
+		return json.Unmarshal(val, letter)
+	}); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// 待重试的事件列表
+func (this *DeadLetterQueue) Pending() ([]*DeadLetter, error) {
+	return this.list(DEAD_LETTER_PREFIX)
+}
+
+// 超过重试上限的事件列表，供运维人员排查
+func (this *DeadLetterQueue) Poisoned() ([]*DeadLetter, error) {
+	return this.list(POISONED_PREFIX)
+}
+
+// 待重试以及poisoned事件的数量，仅遍历key，无需读取并解析内容
+func (this *DeadLetterQueue) Counts() (pending int, poisoned int, err error) {
+	err = this.db.View(func(txn *badger.Txn) error {
+		pending = countPrefix(txn, DEAD_LETTER_PREFIX)
+		poisoned = countPrefix(txn, POISONED_PREFIX)
+		return nil
+	})
+	return pending, poisoned, err
+}
+
+func countPrefix(txn *badger.Txn, prefix string) int {
+	it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+	defer it.Close()
+	n := 0
+	for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+		n++
+	}
+	return n
+}
+
+func (this *DeadLetterQueue) list(prefix string) ([]*DeadLetter, error) {
+	var letters []*DeadLetter
+	err := this.db.View(func(txn *badger.Txn) error {
+		var err error
+		letters, err = this.scan(txn, prefix, nil)
+		return err
+	})
+	return letters, err
+}
+
+func (this *DeadLetterQueue) scan(txn *badger.Txn, prefix string, filter func(l *DeadLetter) bool) ([]*DeadLetter, error) {
+	var letters []*DeadLetter
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+		l := new(DeadLetter)
+		if err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, l)
+		}); err != nil {
+			return nil, err
+		}
+		if filter != nil && !filter(l) {
+			continue
+		}
+		letters = append(letters, l)
+	}
+	return letters, nil
+}
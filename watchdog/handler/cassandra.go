@@ -4,12 +4,15 @@ import (
 	"archive/zip"
 	"crypto/md5"
 	"github.com/cobolbaby/log-agent/watchdog/lib/compress"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
 	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
 	"fmt"
 	"github.com/gocql/gocql"
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 )
@@ -20,6 +23,8 @@ const (
 
 var (
 	CassandraInstances = make(map[string]*gocql.Session)
+	cassandraRefs      = make(map[string]int)
+	cassandraLock      sync.Mutex
 )
 
 type CassandraAdapter struct {
@@ -56,12 +61,29 @@ func (this *CassandraAdapter) SetLogger(logger log.Logger) {
 	this.logger = logger
 }
 
+func (this *CassandraAdapter) GetName() string {
+	return this.Name
+}
+
+func (this *CassandraAdapter) GetConfig() interface{} {
+	return this.Config
+}
+
+func (this *CassandraAdapter) LedgerKey() string {
+	return this.Name + "@" + this.Config.Hosts + "/" + this.Config.Keyspace + "." + this.Config.TableName
+}
+
 func (this *CassandraAdapter) GetPriority() uint8 {
 	return this.Priority
 }
 
 func (this *CassandraAdapter) Handle(fi FileMeta) error {
 
+	// 表结构以文件为主键，无法保存增量的行，配置校验时已拒绝tail模式以及syslog
+	if fi.Incremental {
+		return fmt.Errorf("%s incremental content (tail mode or syslog) is not supported by cassandra", fi.Filepath)
+	}
+
 	// 针对超大文件执行过滤操作
 	if fi.Size > MAX_FILE_SIZE {
 		this.logger.Warnf("[CassandraAdapter] %s 文件大小超过16M", fi.Filepath)
@@ -206,7 +228,11 @@ func (this *CassandraAdapter) upload(fi *FileMeta) error {
 		| reference     | text      |              | 文件内容外部存储路径。                                                                                                                                                                                         |
 	*/
 
-	return this.Insert(fi)
+	if err := this.Insert(fi); err != nil {
+		return err
+	}
+	metrics.ObserveShipped(fi.LastOp.Biz, this.Name, fi.CompressSize)
+	return nil
 }
 
 // 如果新增的记录主键已经存在，则更新历史记录
@@ -278,10 +304,60 @@ func (this *CassandraAdapter) Rollback(fi FileMeta) error {
 	return nil
 }
 
+// 仅在镜像删除策略下删除对应的记录，主键依赖上传时记录的文件创建时间
+// 压缩包删除其下所有文件的记录
+func (this *CassandraAdapter) Remove(fi FileMeta, policy string) error {
+	if policy != fsnotify.DELETE_MIRROR || fi.Incremental {
+		return nil
+	}
+	if fi.CreateTime.IsZero() {
+		this.logger.Warnf("[CassandraAdapter] Skip the deletion of %s, the create time is unknown", fi.Filepath)
+		return nil
+	}
+	var q *gocql.Query
+	if fi.Ext == ".zip" {
+		q = this.Session.Query(`DELETE FROM `+this.Config.TableName+` WHERE file_date = ? AND file_time = ? AND folder = ? AND pack = ?`,
+			fi.CreateTime.Format("2006-01-02"), fi.CreateTime, fi.SubDir, fi.Filename)
+	} else {
+		q = this.Session.Query(`DELETE FROM `+this.Config.TableName+` WHERE file_date = ? AND file_time = ? AND folder = ? AND pack = ? AND name = ?`,
+			fi.CreateTime.Format("2006-01-02"), fi.CreateTime, fi.SubDir, "", fi.Filename)
+	}
+	if err := q.Exec(); err != nil {
+		this.logger.Errorf("[CassandraAdapter] Table %s delete couldn't be exec, %s", this.Config.TableName, err)
+		return err
+	}
+	this.logger.Debugf("[CassandraAdapter] Delete %s", fi.Filepath)
+	return nil
+}
+
+func (this *CassandraAdapter) sessionKey() string {
+	return strings.Join([]string{"cassandra", this.Config.Hosts, "keyspace", this.Config.Keyspace}, ":")
+}
+
+// 热加载替换适配器后释放会话，最后一个使用方释放时关闭
+func (this *CassandraAdapter) Close() error {
+	cassandraLock.Lock()
+	defer cassandraLock.Unlock()
+
+	key := this.sessionKey()
+	if cassandraRefs[key]--; cassandraRefs[key] > 0 {
+		return nil
+	}
+	delete(cassandraRefs, key)
+	if session, ok := CassandraInstances[key]; ok {
+		session.Close()
+		delete(CassandraInstances, key)
+	}
+	return nil
+}
+
 func (this *CassandraAdapter) CreateSession() error {
+	cassandraLock.Lock()
+	defer cassandraLock.Unlock()
 
-	key := strings.Join([]string{"cassandra", "keyspace", this.Config.Keyspace}, ":")
+	key := this.sessionKey()
 	if session, ok := CassandraInstances[key]; ok {
+		cassandraRefs[key]++
 		this.Session = session
 		return nil
 	}
@@ -318,6 +394,7 @@ func (this *CassandraAdapter) CreateSession() error {
 	}
 
 	CassandraInstances[key] = session
+	cassandraRefs[key]++
 	this.Session = session
 	return nil
 }
@@ -24,6 +24,10 @@ func (this *ConsoleAdapter) SetLogger(logger log.Logger) {
 	this.logger = logger
 }
 
+func (this *ConsoleAdapter) GetName() string {
+	return this.Name
+}
+
 func (this *ConsoleAdapter) GetPriority() uint8 {
 	return this.Priority
 }
@@ -37,3 +41,8 @@ func (this *ConsoleAdapter) Handle(fi FileMeta) error {
 func (this *ConsoleAdapter) Rollback(fi FileMeta) error {
 	return nil
 }
+
+func (this *ConsoleAdapter) Remove(fi FileMeta, policy string) error {
+	this.logger.Debugf("[ConsoleAdapter] %s %s, policy: %s", fi.Filepath, fi.LastOp.Op, policy)
+	return nil
+}
@@ -2,8 +2,10 @@ package handler
 
 import (
 	timeUtil "github.com/cobolbaby/log-agent/watchdog/lib/ctime"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
 	"github.com/cobolbaby/log-agent/watchdog/lib/log"
 	"github.com/otiai10/copy"
+	"os"
 	"path"
 	"syscall"
 	"time"
@@ -37,22 +39,40 @@ func (this *FileAdapter) SetLogger(logger log.Logger) {
 	this.logger = logger
 }
 
+func (this *FileAdapter) GetName() string {
+	return this.Name
+}
+
+func (this *FileAdapter) GetConfig() interface{} {
+	return this.Config
+}
+
+func (this *FileAdapter) LedgerKey() string {
+	return this.Name + "@" + this.Config.DestRoot
+}
+
 func (this *FileAdapter) GetPriority() uint8 {
 	return this.Priority
 }
 
-func (this *FileAdapter) Handle(fi FileMeta) error {
-	// 拷贝文件至目标目录
-	var destPath string
+func (this *FileAdapter) destPath(fi *FileMeta) string {
 	if this.Config.CustomPathFunc == nil {
-		destPath = path.Join(this.Config.DestRoot, fi.SubDir, fi.Filename)
-	} else {
-		destPath = this.Config.CustomPathFunc(&fi)
+		return path.Join(this.Config.DestRoot, fi.SubDir, fi.Filename)
 	}
+	return this.Config.CustomPathFunc(fi)
+}
+
+func (this *FileAdapter) Handle(fi FileMeta) error {
+	// 拷贝文件至目标目录
+	destPath := this.destPath(&fi)
 	// 若目标地址未设定，则不做操作
 	if destPath == "" {
 		return nil
 	}
+	// 非文件来源的记录追加至目标文件
+	if fi.Virtual {
+		return this.append(&fi, destPath)
+	}
 	if err := copy.Copy(fi.Filepath, destPath); err != nil {
 		this.logger.Errorf("[FileAdapter] %s Failed to copy, %s", fi.Filepath, err)
 		return err
@@ -66,10 +86,46 @@ func (this *FileAdapter) Handle(fi FileMeta) error {
 	return nil
 }
 
+func (this *FileAdapter) append(fi *FileMeta, destPath string) error {
+	if err := os.MkdirAll(path.Dir(destPath), 0755); err != nil {
+		this.logger.Errorf("[FileAdapter] Failed to create the directory of %s, %s", destPath, err)
+		return err
+	}
+	f, err := os.OpenFile(destPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		this.logger.Errorf("[FileAdapter] Failed to open %s, %s", destPath, err)
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(fi.Content); err != nil {
+		this.logger.Errorf("[FileAdapter] Failed to append %s to %s, %s", fi.Filepath, destPath, err)
+		return err
+	}
+	this.logger.Debugf("[FileAdapter] %s append to %s", fi.Filepath, destPath)
+	return nil
+}
+
 func (this *FileAdapter) Rollback(fi FileMeta) error {
 	return nil
 }
 
+// 仅在镜像删除策略下删除备份文件
+func (this *FileAdapter) Remove(fi FileMeta, policy string) error {
+	if policy != fsnotify.DELETE_MIRROR {
+		return nil
+	}
+	destPath := this.destPath(&fi)
+	if destPath == "" {
+		return nil
+	}
+	if err := os.Remove(destPath); err != nil && !os.IsNotExist(err) {
+		this.logger.Errorf("[FileAdapter] Failed to remove %s, %s", destPath, err)
+		return err
+	}
+	this.logger.Debugf("[FileAdapter] Remove %s", destPath)
+	return nil
+}
+
 // Chtimes changes the access and modification times of the named
 // file, similar to the Unix utime() or utimes() functions.
 //
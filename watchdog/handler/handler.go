@@ -27,13 +27,30 @@ type FileMeta struct {
 	Reference    string    // 保留字段
 	Host         string    // 文件溯源
 	FolderTime   time.Time // 文件所在目录的创建时间
+	Incremental  bool      // 增量读取(tail模式)，Content为新增的完整行
+	Offset       int64     // 增量内容在文件中的起始位置
+	Records      [][]byte  // 按多行规则切分后的记录，为nil时未切分
+	Virtual      bool      // 内容来自syslog等非文件来源，Filepath仅作标识
 }
 
 type WatchdogHandler interface {
 	Handle(file FileMeta) error
 	Rollback(file FileMeta) error
+	Remove(file FileMeta, policy string) error // 源文件删除后按策略通知目标端
 	SetLogger(logger log.Logger)
 	GetPriority() uint8
+	GetName() string // 适配器标识，用于记录文件投递状态，需保持稳定
+}
+
+// 可选实现，投递记录中的适配器标识，需包含目标端配置，目标变更后文件重新投递
+// 未实现时使用GetName
+type LedgerKeyer interface {
+	LedgerKey() string
+}
+
+// 可选实现，返回创建适配器时的配置，热加载时配置未变的适配器沿用原有实例
+type Configurable interface {
+	GetConfig() interface{}
 }
 
 const (
@@ -54,3 +71,40 @@ func GBKToUTF8(src string) (string, error) {
 	}
 	return string(res), nil
 }
+
+// 停机时释放各适配器共享的连接，Kafka生产者关闭前会等待缓存的消息发送完毕
+func Release() error {
+	var err error
+	kafkaLock.Lock()
+	defer kafkaLock.Unlock()
+	for key, producer := range KafkaInstances {
+		if e := producer.Close(); e != nil {
+			err = e
+		}
+		delete(KafkaInstances, key)
+	}
+	for key, producer := range KafkaAsyncInstances {
+		if e := producer.Close(); e != nil {
+			err = e
+		}
+		delete(KafkaAsyncInstances, key)
+	}
+	for key := range kafkaRefs {
+		delete(kafkaRefs, key)
+	}
+	cassandraLock.Lock()
+	defer cassandraLock.Unlock()
+	for key, session := range CassandraInstances {
+		session.Close()
+		delete(CassandraInstances, key)
+		delete(cassandraRefs, key)
+	}
+	rabbitmqLock.Lock()
+	defer rabbitmqLock.Unlock()
+	for key, session := range rabbitmqSessions {
+		session.close()
+		delete(rabbitmqSessions, key)
+		delete(rabbitmqRefs, key)
+	}
+	return err
+}
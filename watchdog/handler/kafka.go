@@ -1,26 +1,41 @@
 package handler
 
 import (
-	"archive/zip"
 	"crypto/md5"
-	"github.com/cobolbaby/log-agent/watchdog/lib/compress"
+	"github.com/cobolbaby/log-agent/watchdog/lib/avro"
+	"github.com/cobolbaby/log-agent/watchdog/lib/chunk"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
 	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/Shopify/sarama"
-	// "github.com/dangkaka/go-kafka-avro"
-	// "github.com/linkedin/goavro"
-	"io/ioutil"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"unicode/utf8"
 )
 
 var (
-	KafkaInstance sarama.SyncProducer
+	// 按broker列表复用生产者，热加载时配置未变的业务无需重建连接
+	KafkaInstances      = make(map[string]sarama.SyncProducer)
+	KafkaAsyncInstances = make(map[string]*KafkaAsyncProducer)
+	kafkaRefs           = make(map[string]int) // 生产者的使用方数量，以"sync:"或"async:"加broker列表为Key
+	kafkaLock           sync.Mutex
+)
+
+// 异步模式下的缺省攒批配置
+const (
+	KAFKA_LINGER     = 100 * time.Millisecond // 消息在缓冲区中的最长等待时间
+	KAFKA_BATCH_SIZE = 500                    // 缓冲的消息数达到该值时立即发送
+)
+
+const (
+	KAFKA_MAX_MESSAGE_BYTES = 10000000
+	KAFKA_CHUNK_SIZE        = 4 * 1024 * 1024 // 单个分片的内容上限，JSON格式下以十六进制编码，消息大小约为两倍
+	KAFKA_CHUNK_OVERHEAD    = 64 * 1024       // 为元数据以及Header预留的空间
 )
 
 const (
@@ -93,20 +108,99 @@ const (
 	`
 )
 
+// 消息格式
+const (
+	KAFKA_FORMAT_JSON = "json" // JSON中附带Schema，供Kafka Connect的JsonConverter解析
+	KAFKA_FORMAT_AVRO = "avro" // Confluent格式的Avro二进制，Schema注册至Schema Registry
+)
+
+// avro格式下单行记录缺省发送至<topic>-line，与文件消息的Schema互不兼容
+const (
+	KAFKA_LINE_TOPIC_SUFFIX = "-line"
+)
+
+// 与recordSchemaJSON/lineSchemaJSON的字段一一对应，文件内容直接以bytes保存，无需转为十六进制
+var (
+	recordAvroSchema = avro.NewSchema("", "dcagent_value",
+		avro.Field{Name: "file_date", Type: avro.TYPE_STRING},
+		avro.Field{Name: "file_time", Type: avro.TYPE_LONG},
+		avro.Field{Name: "folder", Type: avro.TYPE_STRING},
+		avro.Field{Name: "pack", Type: avro.TYPE_STRING},
+		avro.Field{Name: "name", Type: avro.TYPE_STRING},
+		avro.Field{Name: "size", Type: avro.TYPE_LONG},
+		avro.Field{Name: "modify_time", Type: avro.TYPE_LONG},
+		avro.Field{Name: "content", Type: avro.TYPE_BYTES},
+		avro.Field{Name: "compress", Type: avro.TYPE_BOOLEAN},
+		avro.Field{Name: "compress_size", Type: avro.TYPE_LONG},
+		avro.Field{Name: "checksum", Type: avro.TYPE_STRING},
+		avro.Field{Name: "host", Type: avro.TYPE_STRING},
+		avro.Field{Name: "folder_time", Type: avro.TYPE_LONG},
+	)
+	lineAvroSchema = avro.NewSchema("", "dcagent_line",
+		avro.Field{Name: "folder", Type: avro.TYPE_STRING},
+		avro.Field{Name: "name", Type: avro.TYPE_STRING},
+		avro.Field{Name: "offset", Type: avro.TYPE_LONG},
+		avro.Field{Name: "line", Type: avro.TYPE_STRING},
+		avro.Field{Name: "modify_time", Type: avro.TYPE_LONG},
+		avro.Field{Name: "host", Type: avro.TYPE_STRING},
+	)
+)
+
+// tail模式下单行记录的Schema
+const lineSchemaJSON = `
+	{
+		"type": "struct",
+		"name": "dcagent_line",
+		"fields": [
+			{
+				"field": "folder",
+				"type": "string"
+			},
+			{
+				"field": "name",
+				"type": "string"
+			},
+			{
+				"field": "offset",
+				"type": "int64"
+			},
+			{
+				"field": "line",
+				"type": "string"
+			},
+			{
+				"field": "modify_time",
+				"type": "int64"
+			},
+			{
+				"field": "host",
+				"type": "string"
+			}
+		]
+	}
+	`
+
 type KafkaAdapter struct {
 	Name     string
 	Config   *KafkaAdapterCfg
 	logger   log.Logger
 	Priority uint8
 	producer sarama.SyncProducer
-	// schemaRegistryClient *kafka.CachedSchemaRegistryClient
-	// codec                *goavro.Codec
+	async    *KafkaAsyncProducer
+	registry avro.Registry
 }
 
 type KafkaAdapterCfg struct {
 	Brokers        string
 	Topic          string
 	SchemaRegistry string
+	Format         string        // json(缺省)或avro
+	Registry       avro.Registry // 为nil时依据SchemaRegistry创建，可替换为进程内的Registry
+	Async          bool          // 异步攒批发送，按文件等待所有消息的确认
+	Linger         time.Duration
+	BatchSize      int
+	ChunkSize      int    // 内容超过该值的文件拆分为多条消息
+	LineTopic      string // avro格式下单行记录的Topic，为空时使用<topic>-line
 }
 
 func NewKafkaAdapter(Cfg *KafkaAdapterCfg) (WatchdogHandler, error) {
@@ -115,19 +209,65 @@ func NewKafkaAdapter(Cfg *KafkaAdapterCfg) (WatchdogHandler, error) {
 		Config: Cfg,
 	}
 
-	if err := self.newSyncProducer(); err != nil {
+	switch Cfg.Format {
+	case "", KAFKA_FORMAT_JSON:
+	case KAFKA_FORMAT_AVRO:
+		self.registry = Cfg.Registry
+		if self.registry == nil {
+			if Cfg.SchemaRegistry == "" {
+				return nil, fmt.Errorf("kafka format %s requires the schema registry", Cfg.Format)
+			}
+			registry, err := avro.NewHTTPRegistry(Cfg.SchemaRegistry)
+			if err != nil {
+				return nil, err
+			}
+			self.registry = registry
+		}
+	default:
+		return nil, fmt.Errorf("unknown kafka format %q", Cfg.Format)
+	}
+
+	if Cfg.ChunkSize <= 0 {
+		Cfg.ChunkSize = KAFKA_CHUNK_SIZE
+	}
+	if size := Cfg.ChunkSize; self.registry == nil && 2*size+KAFKA_CHUNK_OVERHEAD > KAFKA_MAX_MESSAGE_BYTES ||
+		size+KAFKA_CHUNK_OVERHEAD > KAFKA_MAX_MESSAGE_BYTES {
+		return nil, fmt.Errorf("kafka chunk size %d exceeds the max message bytes %d", size, KAFKA_MAX_MESSAGE_BYTES)
+	}
+
+	if err := self.newProducer(); err != nil {
 		return nil, err
 	}
 
 	return self, nil
 }
 
-func (this *KafkaAdapter) newSyncProducer() error {
-
-	if KafkaInstance != nil {
-		this.producer = KafkaInstance
+func (this *KafkaAdapter) newProducer() error {
+	if this.Config.Async {
+		producer, err := NewKafkaAsyncProducer(this.Config)
+		if err != nil {
+			return err
+		}
+		this.async = producer
 		return nil
 	}
+	producer, err := NewKafkaProducer(this.Config.Brokers)
+	if err != nil {
+		return err
+	}
+	this.producer = producer
+	return nil
+}
+
+// 获取共享的生产者，同一broker列表仅建立一次连接
+func NewKafkaProducer(brokers string) (sarama.SyncProducer, error) {
+	kafkaLock.Lock()
+	defer kafkaLock.Unlock()
+
+	if producer, ok := KafkaInstances[brokers]; ok {
+		kafkaRefs["sync:"+brokers]++
+		return producer, nil
+	}
 
 	config := sarama.NewConfig()
 	config.Version = sarama.V2_0_1_0
@@ -135,34 +275,233 @@ func (this *KafkaAdapter) newSyncProducer() error {
 	config.Producer.RequiredAcks = sarama.WaitForAll
 	config.Producer.Return.Successes = true
 	config.Producer.Compression = sarama.CompressionNone
-	config.Producer.MaxMessageBytes = 10000000
+	config.Producer.MaxMessageBytes = KAFKA_MAX_MESSAGE_BYTES
 	config.Producer.Retry.Max = 10
 	config.Producer.Retry.Backoff = 1000 * time.Millisecond
 	// sarama.MaxRequestSize =
 
-	client, err := sarama.NewSyncProducer(strings.Split(this.Config.Brokers, ","), config)
+	client, err := sarama.NewSyncProducer(strings.Split(brokers, ","), config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// defer client.Close()
-	KafkaInstance = client
-	this.producer = client
+	KafkaInstances[brokers] = client
+	kafkaRefs["sync:"+brokers]++
+	return client, nil
+}
 
-	// codec, err := goavro.NewCodec(recordSchemaJSON)
-	// if err != nil {
-	// 	return err
-	// }
-	// schemaRegistryClient := kafka.NewCachedSchemaRegistryClientWithRetries(strings.Split(this.Config.SchemaRegistry, ","), 3)
-	// this.codec = codec
-	// this.schemaRegistryClient = schemaRegistryClient
+// 释放共享的生产者，最后一个使用方释放时关闭
+func ReleaseKafkaProducer(brokers string) error {
+	kafkaLock.Lock()
+	defer kafkaLock.Unlock()
+
+	if kafkaRefs["sync:"+brokers]--; kafkaRefs["sync:"+brokers] > 0 {
+		return nil
+	}
+	delete(kafkaRefs, "sync:"+brokers)
+	producer, ok := KafkaInstances[brokers]
+	if !ok {
+		return nil
+	}
+	delete(KafkaInstances, brokers)
+	return producer.Close()
+}
+
+// 异步生产者，消息经Metadata关联至所属文件的kafkaFuture，确认或失败时回调
+type KafkaAsyncProducer struct {
+	producer sarama.AsyncProducer
+	mu       sync.RWMutex
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// 获取共享的异步生产者，攒批配置以首次创建时为准
+func NewKafkaAsyncProducer(Cfg *KafkaAdapterCfg) (*KafkaAsyncProducer, error) {
+	kafkaLock.Lock()
+	defer kafkaLock.Unlock()
+
+	if producer, ok := KafkaAsyncInstances[Cfg.Brokers]; ok {
+		kafkaRefs["async:"+Cfg.Brokers]++
+		return producer, nil
+	}
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_0_1_0
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.Compression = sarama.CompressionNone
+	config.Producer.MaxMessageBytes = KAFKA_MAX_MESSAGE_BYTES
+	config.Producer.Retry.Max = 10
+	config.Producer.Retry.Backoff = 1000 * time.Millisecond
+	config.Producer.Flush.Frequency = KAFKA_LINGER
+	if Cfg.Linger > 0 {
+		config.Producer.Flush.Frequency = Cfg.Linger
+	}
+	config.Producer.Flush.Messages = KAFKA_BATCH_SIZE
+	if Cfg.BatchSize > 0 {
+		config.Producer.Flush.Messages = Cfg.BatchSize
+	}
+	// 重试时保证同一分区内的消息有序，同一文件的记录依赖于此
+	config.Net.MaxOpenRequests = 1
+
+	producer, err := sarama.NewAsyncProducer(strings.Split(Cfg.Brokers, ","), config)
+	if err != nil {
+		return nil, err
+	}
+	self := &KafkaAsyncProducer{
+		producer: producer,
+	}
+	self.wg.Add(2)
+	go func() {
+		defer self.wg.Done()
+		for msg := range producer.Successes() {
+			if future, ok := msg.Metadata.(*kafkaFuture); ok {
+				future.complete(nil)
+			}
+		}
+	}()
+	go func() {
+		defer self.wg.Done()
+		for e := range producer.Errors() {
+			if future, ok := e.Msg.Metadata.(*kafkaFuture); ok {
+				future.complete(e.Err)
+			}
+		}
+	}()
+	KafkaAsyncInstances[Cfg.Brokers] = self
+	kafkaRefs["async:"+Cfg.Brokers]++
+	return self, nil
+}
+
+func releaseKafkaAsyncProducer(brokers string) error {
+	kafkaLock.Lock()
+	defer kafkaLock.Unlock()
+
+	if kafkaRefs["async:"+brokers]--; kafkaRefs["async:"+brokers] > 0 {
+		return nil
+	}
+	delete(kafkaRefs, "async:"+brokers)
+	producer, ok := KafkaAsyncInstances[brokers]
+	if !ok {
+		return nil
+	}
+	delete(KafkaAsyncInstances, brokers)
+	return producer.Close()
+}
 
+// 投递至缓冲区即返回，缓冲区已满时阻塞
+func (this *KafkaAsyncProducer) Send(future *kafkaFuture, msgs ...*sarama.ProducerMessage) error {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if this.closed {
+		return sarama.ErrShuttingDown
+	}
+	future.add(len(msgs))
+	for _, msg := range msgs {
+		msg.Metadata = future
+		this.producer.Input() <- msg
+	}
 	return nil
 }
 
+// 等待缓冲的消息发送完毕，所有文件的回调均已完成后返回
+func (this *KafkaAsyncProducer) Close() error {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return nil
+	}
+	this.closed = true
+	this.mu.Unlock()
+	this.producer.AsyncClose()
+	this.wg.Wait()
+	return nil
+}
+
+// 单个文件的投递结果，涵盖该文件(或压缩包内所有文件)的全部消息，Wait之后不再追加消息
+type kafkaFuture struct {
+	mu      sync.Mutex
+	pending int
+	waiting bool
+	err     error
+	done    chan struct{}
+	shipped int64 // 用于投递成功后统计流量
+}
+
+func newKafkaFuture() *kafkaFuture {
+	return &kafkaFuture{
+		done: make(chan struct{}),
+	}
+}
+
+func (this *kafkaFuture) add(n int) {
+	this.mu.Lock()
+	this.pending += n
+	this.mu.Unlock()
+}
+
+// 仅保留首个错误
+func (this *kafkaFuture) complete(err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err != nil && this.err == nil {
+		this.err = err
+	}
+	this.pending--
+	if this.pending == 0 && this.waiting {
+		close(this.done)
+	}
+}
+
+func (this *kafkaFuture) observe(shipped int64) {
+	this.shipped += shipped
+}
+
+// 等待已发出的消息全部得到确认，任一消息失败则返回错误
+func (this *kafkaFuture) Wait() error {
+	this.mu.Lock()
+	this.waiting = true
+	if this.pending == 0 {
+		defer this.mu.Unlock()
+		return this.err
+	}
+	this.mu.Unlock()
+	<-this.done
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.err
+}
+
+// 热加载替换适配器后释放生产者
+func (this *KafkaAdapter) Close() error {
+	if this.async != nil {
+		return releaseKafkaAsyncProducer(this.Config.Brokers)
+	}
+	return ReleaseKafkaProducer(this.Config.Brokers)
+}
+
 func (this *KafkaAdapter) SetLogger(logger log.Logger) {
 	this.logger = logger
 }
 
+func (this *KafkaAdapter) GetName() string {
+	return this.Name
+}
+
+func (this *KafkaAdapter) GetConfig() interface{} {
+	return this.Config
+}
+
+func (this *KafkaAdapter) LedgerKey() string {
+	key := this.Name + "@" + this.Config.Brokers + "/" + this.Config.Topic
+	if this.Config.LineTopic != "" {
+		key += "," + this.Config.LineTopic
+	}
+	return key
+}
+
 func (this *KafkaAdapter) GetPriority() uint8 {
 	return this.Priority
 }
@@ -175,125 +514,77 @@ func (this *KafkaAdapter) Handle(fi FileMeta) error {
 	// 	return nil
 	// }
 
-	// 如果为压缩文件需要特殊处理
-	switch fi.Ext {
-	case ".zip":
-		return this.uploadZipedFile(&fi)
-	default:
-		return this.uploadUnArchivedFile(&fi)
-	}
-}
-
-func (this *KafkaAdapter) uploadUnArchivedFile(fi *FileMeta) error {
-	var err error
-	for i, attempts := 1, 3; i <= attempts; i++ {
-		if fi.Content, err = ioutil.ReadFile(fi.Filepath); err == nil {
-			break
-		}
-		if i < attempts {
-			this.logger.Warnf("[KafkaAdapter] ioutil.ReadFile error: %s, retry #%d", err, i)
-			time.Sleep(time.Duration(i) * time.Second)
-		}
+	future := newKafkaFuture()
+	err := this.handle(&fi, future)
+	// 即便中途出错，已发出的消息也需等待确认，以免与重试时的消息交错
+	if e := future.Wait(); err == nil {
+		err = e
 	}
 	if err != nil {
-		/*
-			e.g.
-			1) File Handle Error: open D:\\I1000_testlog\\HP\\Matterhorn\\K2786401B\\board\\20181213181445__All.txt: The process cannot access the file because it is being used by another process.
-		*/
-		this.logger.Errorf("[KafkaAdapter] %s ioutil.ReadFile error, %s", fi.Filepath, err)
 		return err
 	}
-	return this.upload(fi)
+	metrics.ObserveShipped(fi.LastOp.Biz, this.Name, future.shipped)
+	return nil
 }
 
-func (this *KafkaAdapter) uploadZipedFile(fi *FileMeta) error {
-	if fi.Size == 0 {
-		this.logger.Errorf("[KafkaAdapter] %s is not a valid zip", fi.Filepath)
-		// TODO:预警
-		return nil
-		// 对于非正确格式的Zip包，采用常规方式进行上传
-		// return this.uploadUnArchivedFile(fi)
+func (this *KafkaAdapter) handle(fi *FileMeta, future *kafkaFuture) error {
+	// tail模式下逐行上传新增的内容，已按多行规则切分的则逐条上传记录
+	if fi.Incremental || fi.Records != nil {
+		return this.uploadRecords(fi, future)
 	}
+	// 如果为压缩文件需要特殊处理
+	return uploadFile(fi, this.logger, "[KafkaAdapter]", func(file *FileMeta) error {
+		return this.upload(file, future)
+	})
+}
 
-	// TODO:完善失败重试机制
-	// Open a zip archive for reading.
-	r, err := zip.OpenReader(fi.Filepath)
-	if err != nil {
-		this.logger.Errorf("[KafkaAdapter] %s zip.OpenReader error, %s", fi.Filepath, err)
+// 同步模式下逐条等待broker确认，异步模式下交由future汇总结果
+func (this *KafkaAdapter) send(future *kafkaFuture, msgs ...*sarama.ProducerMessage) error {
+	if this.async != nil {
+		return this.async.Send(future, msgs...)
+	}
+	if len(msgs) == 1 {
+		_, _, err := this.producer.SendMessage(msgs[0])
 		return err
 	}
-	defer r.Close()
-
-	// Iterate through the files in the archive,
-	// printing some of their contents.
-	for _, f := range r.File {
-		if f.FileInfo().IsDir() {
-			continue
-		}
-
-		// Windows下压缩包中的简体中文采用GBK编码
-		if !utf8.ValidString(f.Name) {
-			f.Name, err = GBKToUTF8(f.Name)
-			if err != nil {
-				this.logger.Warnf("[KafkaAdapter] %s is not a valid utf-8/gbk string", f.Name)
-				return err
-			}
-		}
+	return this.producer.SendMessages(msgs)
+}
 
-		file := &FileMeta{
-			Filepath:   fi.Filepath,
-			SubDir:     fi.SubDir,
-			Pack:       fi.Filename,
-			Filename:   f.Name,
-			Ext:        strings.ToLower(filepath.Ext(f.Name)),
-			Size:       f.FileInfo().Size(),
-			CreateTime: fi.CreateTime,
-			ModifyTime: fi.ModifyTime,
-			LastOp:     fi.LastOp,
-			Host:       fi.Host,
-			FolderTime: fi.FolderTime,
-		}
+// 每行(或每条记录)作为一条消息，以文件路径为Key保证同一文件的记录有序
+func (this *KafkaAdapter) uploadRecords(fi *FileMeta, future *kafkaFuture) error {
+	encode, err := this.lineEncoder()
+	if err != nil {
+		return err
+	}
+	msgKey := fileMsgKey(fi)
+	topic := this.lineTopic()
 
-		rc, err := f.Open()
+	var msgs []*sarama.ProducerMessage
+	for _, line := range lineRecords(fi) {
+		value, err := encode(line)
 		if err != nil {
-			this.logger.Errorf("[KafkaAdapter] %s f.Open error, %s", f.Name, err)
-			return err
-		}
-		defer rc.Close()
-
-		if file.Content, err = ioutil.ReadAll(rc); err != nil {
-			this.logger.Errorf("[KafkaAdapter] %s ioutil.ReadAll error, %s", f.Name, err)
-			return err
-		}
-
-		if err = this.upload(file); err != nil {
+			this.logger.Errorf("[KafkaAdapter] Failed to encode the record of %s, %s", fi.Filepath, err)
 			return err
 		}
+		msgs = append(msgs, &sarama.ProducerMessage{
+			Topic: topic,
+			Key:   sarama.StringEncoder(msgKey),
+			Value: value,
+		})
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	if err := this.send(future, msgs...); err != nil {
+		return err
 	}
+	future.observe(int64(len(fi.Content)))
+	this.logger.Debugf("[KafkaAdapter] Upload %d records of %s from offset %d", len(msgs), fi.Filepath, fi.Offset)
 	return nil
 }
 
-func (this *KafkaAdapter) upload(fi *FileMeta) error {
-	fi.Checksum = fmt.Sprintf("%x", md5.Sum(fi.Content))
-
-	// 压缩需要保证内存使用率问题
-	if compress.CheckIfCompressSize(fi.Size) && compress.CheckIfCompressExt(fi.Ext) {
-		fi.Compress = true
-
-		var err error
-		fi.Content, err = compress.GzipContent(fi.Content)
-		if err != nil {
-			this.logger.Errorf("[KafkaAdapter] %s couldn't be compressed, %s", fi.Filepath, err)
-			return err
-		}
-
-		fi.CompressSize = int64(len(fi.Content))
-	} else {
-		fi.Compress = false
-		// fi.Content = fi.Content
-		fi.CompressSize = fi.Size
-	}
-
+// 内容已读取并按需压缩
+func (this *KafkaAdapter) upload(fi *FileMeta, future *kafkaFuture) error {
 	/*
 		| Name          | Type      |          Key | Desc                                                                                                                                                                                                           |
 		| :------------ | :-------- | -----------: | :------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------- |
@@ -312,112 +603,196 @@ func (this *KafkaAdapter) upload(fi *FileMeta) error {
 		| reference     | text      |              | 文件内容外部存储路径。                                                                                                                                                                                         |
 	*/
 
-	return this.Insert(fi)
+	if err := this.Insert(fi, future); err != nil {
+		return err
+	}
+	future.observe(fi.CompressSize)
+	return nil
 }
 
 // 如果新增的记录主键已经存在，则更新历史记录
-func (this *KafkaAdapter) Insert(fi *FileMeta) error {
+func (this *KafkaAdapter) Insert(fi *FileMeta, future *kafkaFuture) error {
 	// file_date -- 当前时区时间-日期，该字段仅为方便业务查询
 	// file_time -- 当前时区时间-日期+时间
 
-	// fix: Error decoding JSON value for content: Value '' is not a valid blob representation: String representation of blob is missing 0x prefix
-	// 空文件在Cassandra中保存为"0x"
-	ctx := "0x" + hex.EncodeToString(fi.Content)
+	// fix: 矫正消息唯一性标示，考虑是压缩包的场景
+	msgKey := fileMsgKey(fi)
+
+	// 超大文件拆分为多条消息，各分片的content为(压缩后)内容的一段，其余字段与整个文件一致
+	parts := chunk.Split(fi.Content, this.Config.ChunkSize)
+	var c *chunk.Chunk
+	if len(parts) > 1 {
+		c = &chunk.Chunk{
+			FileID:   fmt.Sprintf("%x", md5.Sum([]byte(msgKey+"|"+fi.Checksum+"|"+strconv.FormatInt(fi.ModifyTime.UnixNano(), 10)))),
+			Total:    len(parts),
+			Checksum: fi.Checksum,
+		}
+	}
 
-	// Ref: http://cassandra.apache.org/doc/latest/cql/json.html#json-encoding-of-cassandra-data-types
-	// 传时间戳，不传Datetime了
-	payload := &LogfileEncoder{
-		CreateDate: fi.CreateTime.Format("2006-01-02"),
-		// CreateTime:   fi.CreateTime.UnixNano().Format("2006-01-02T15:04:05.000-0700"),
-		CreateTime:   fi.CreateTime.UnixNano() / 1000000,
-		SubDir:       fi.SubDir,
-		Pack:         fi.Pack,
-		Filename:     fi.Filename,
-		Size:         fi.Size,
-		ModifyTime:   fi.ModifyTime.UnixNano() / 1000000,
-		Compress:     fi.Compress,
-		CompressSize: fi.CompressSize,
-		Checksum:     fi.Checksum,
-		Host:         fi.Host,
-		FolderTime:   fi.FolderTime.UnixNano() / 1000000,
-		Content:      ctx,
+	msgs := make([]*sarama.ProducerMessage, 0, len(parts))
+	for i, part := range parts {
+		meta := *fi
+		meta.Content = part
+		msgVal, err := this.fileValue(&meta)
+		if err != nil {
+			this.logger.Errorf("[KafkaAdapter] Failed to encode %s, %s", fi.Filepath, err)
+			return err
+		}
+		msg := &sarama.ProducerMessage{
+			Topic: this.Config.Topic,
+			Key:   sarama.StringEncoder(msgKey),
+			Value: msgVal,
+		}
+		if c != nil {
+			c.Index = i
+			headers := c.Headers()
+			for _, k := range chunk.HEADERS {
+				msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(headers[k])})
+			}
+		}
+		msgs = append(msgs, msg)
 	}
 
-	// 添加Schema标注信息
-	schema := make(map[string]interface{})
-	err := json.Unmarshal([]byte(recordSchemaJSON), &schema)
-	if err != nil {
-		this.logger.Errorf("[KafkaAdapter] recordSchemaJSON json.Unmarshal error, %s", err)
+	// 同一Key的分片位于同一分区，按序发送
+	if err := this.send(future, msgs...); err != nil {
 		return err
 	}
+	if c != nil {
+		this.logger.Debugf("[KafkaAdapter] Upload %s in %d chunks, file id %s", fi.Filepath, c.Total, c.FileID)
+		return nil
+	}
+	this.logger.Debugf("[KafkaAdapter] Upload %s", fi.Filepath)
+	return nil
+}
 
-	msgVal := &MsgValueEncoder{
-		Schema:  schema,
-		Payload: payload,
+// 依据消息格式编码文件
+func (this *KafkaAdapter) fileValue(fi *FileMeta) (sarama.Encoder, error) {
+	if this.registry == nil {
+		// 添加Schema标注信息
+		schema := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(recordSchemaJSON), &schema); err != nil {
+			return nil, err
+		}
+		return &MsgValueEncoder{
+			Schema:  schema,
+			Payload: NewLogfileEncoder(fi),
+		}, nil
+	}
+	id, err := this.schemaID(this.Config.Topic, recordAvroSchema)
+	if err != nil {
+		return nil, err
+	}
+	content, err := recordAvroSchema.Encode(map[string]interface{}{
+		"file_date":     fi.CreateTime.Format("2006-01-02"),
+		"file_time":     fi.CreateTime.UnixNano() / 1000000,
+		"folder":        fi.SubDir,
+		"pack":          fi.Pack,
+		"name":          fi.Filename,
+		"size":          fi.Size,
+		"modify_time":   fi.ModifyTime.UnixNano() / 1000000,
+		"content":       fi.Content,
+		"compress":      fi.Compress,
+		"compress_size": fi.CompressSize,
+		"checksum":      fi.Checksum,
+		"host":          fi.Host,
+		"folder_time":   fi.FolderTime.UnixNano() / 1000000,
+	})
+	if err != nil {
+		return nil, err
 	}
+	return &AvroEncoder{SchemaID: id, Content: content}, nil
+}
 
-	// fix: 矫正消息唯一性标示，考虑是压缩包的场景
-	msgKey := fi.SubDir + "/"
-	if fi.Pack == "" {
-		msgKey += fi.Filename
-	} else {
-		msgKey += fi.Pack + "/" + fi.Filename
+// 依据消息格式生成单行记录的编码函数，Schema仅需解析或注册一次
+func (this *KafkaAdapter) lineEncoder() (func(*LogLineEncoder) (sarama.Encoder, error), error) {
+	if this.registry == nil {
+		schema := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(lineSchemaJSON), &schema); err != nil {
+			this.logger.Errorf("[KafkaAdapter] lineSchemaJSON json.Unmarshal error, %s", err)
+			return nil, err
+		}
+		return func(line *LogLineEncoder) (sarama.Encoder, error) {
+			return &MsgValueEncoder{Schema: schema, Payload: line}, nil
+		}, nil
+	}
+	id, err := this.schemaID(this.lineTopic(), lineAvroSchema)
+	if err != nil {
+		return nil, err
+	}
+	return func(line *LogLineEncoder) (sarama.Encoder, error) {
+		content, err := lineAvroSchema.Encode(map[string]interface{}{
+			"folder":      line.SubDir,
+			"name":        line.Filename,
+			"offset":      line.Offset,
+			"line":        line.Line,
+			"modify_time": line.ModifyTime,
+			"host":        line.Host,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &AvroEncoder{SchemaID: id, Content: content}, nil
+	}, nil
+}
+
+// 按TopicNameStrategy以<topic>-value为subject注册或查找Schema，ID由Registry缓存
+func (this *KafkaAdapter) schemaID(topic string, schema *avro.Schema) (int, error) {
+	id, err := this.registry.Register(topic+"-value", schema)
+	if err != nil {
+		this.logger.Errorf("[KafkaAdapter] Failed to register the schema of %s, %s", topic, err)
+		return 0, err
 	}
+	return id, nil
+}
 
-	msg := &sarama.ProducerMessage{
-		Topic: this.Config.Topic,
-		Key:   sarama.StringEncoder(msgKey),
-		Value: msgVal,
-	}
-
-	// native := map[string]interface{}{
-	// 	"file_date":     fi.CreateTime.Format("2006-01-02"),
-	// 	"file_time":     fi.CreateTime.UnixNano() / 1000000,
-	// 	"folder":        fi.SubDir,
-	// 	"pack":          fi.Pack,
-	// 	"name":          fi.Filename,
-	// 	"size":          fi.Size,
-	// 	"modify_time":   fi.ModifyTime.UnixNano() / 1000000,
-	// 	"compress":      fi.Compress,
-	// 	"compress_size": fi.CompressSize,
-	// 	"checksum":      fi.Checksum,
-	// 	"host":          fi.Host,
-	// 	"folder_time":   fi.FolderTime.UnixNano() / 1000000,
-	// 	"content":       ctx,
-	// }
-	// // Convert native Go form to binary Avro data
-	// binaryMsg, err := this.codec.BinaryFromNative(nil, native)
-	// if err != nil {
-	// 	return err
-	// }
-	// schemaId, err := this.schemaRegistryClient.CreateSubject(this.Config.Topic+"-value", this.codec)
-	// if err != nil {
-	// 	return err
-	// }
-	// msgVal := &AvroEncoder{
-	// 	SchemaID: schemaId,
-	// 	Content:  binaryMsg,
-	// }
-	// msg := &sarama.ProducerMessage{
-	// 	Topic:     this.Config.Topic,
-	// 	Key:       sarama.StringEncoder(fi.Filepath),
-	// 	Value:     msgVal,
-	// 	Timestamp: time.Now(),
-	// }
-	if _, _, err := this.producer.SendMessage(msg); err != nil {
-		return err
+// 单行记录的Topic，json格式的消息附带Schema，与文件消息共用同一个Topic
+func (this *KafkaAdapter) lineTopic() string {
+	if this.registry == nil {
+		return this.Config.Topic
 	}
-	this.logger.Debugf("[KafkaAdapter] Upload %s", fi.Filepath)
-	return nil
+	if this.Config.LineTopic != "" {
+		return this.Config.LineTopic
+	}
+	return this.Config.Topic + KAFKA_LINE_TOPIC_SUFFIX
 }
 
 func (this *KafkaAdapter) Rollback(fi FileMeta) error {
 	return nil
 }
 
+// 以空消息(tombstone)通知下游文件已删除，开启压实(compact)的Topic会据此清理该Key的历史消息
+// 压缩包内的文件各自为一个Key，源文件删除后无从得知包内的文件名，故不做处理
+func (this *KafkaAdapter) Remove(fi FileMeta, policy string) error {
+	if policy != fsnotify.DELETE_TOMBSTONE && policy != fsnotify.DELETE_MIRROR {
+		return nil
+	}
+	if fi.Ext == ".zip" && !fi.Incremental {
+		this.logger.Warnf("[KafkaAdapter] Skip the tombstone of %s, the entries of the zip are unknown", fi.Filepath)
+		return nil
+	}
+	// tail模式下文件的内容以单行记录发送
+	topic := this.Config.Topic
+	if fi.Incremental {
+		topic = this.lineTopic()
+	}
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(fi.SubDir + "/" + fi.Filename),
+	}
+	future := newKafkaFuture()
+	if err := this.send(future, msg); err != nil {
+		return err
+	}
+	if err := future.Wait(); err != nil {
+		return err
+	}
+	this.logger.Debugf("[KafkaAdapter] Send the tombstone of %s", fi.Filepath)
+	return nil
+}
+
 type MsgValueEncoder struct {
 	Schema  map[string]interface{} `json:"schema"`
-	Payload *LogfileEncoder        `json:"payload"`
+	Payload interface{}            `json:"payload"`
 }
 
 // LogfileEncoder Need to implement sarama.Encoder interface
@@ -437,6 +812,42 @@ type LogfileEncoder struct {
 	FolderTime   int64  `json:"folder_time"`
 }
 
+// 文件的元数据以及内容，Kafka以及RabbitMQ中的消息格式一致
+func NewLogfileEncoder(fi *FileMeta) *LogfileEncoder {
+	// fix: Error decoding JSON value for content: Value '' is not a valid blob representation: String representation of blob is missing 0x prefix
+	// 空文件在Cassandra中保存为"0x"
+	ctx := "0x" + hex.EncodeToString(fi.Content)
+
+	// Ref: http://cassandra.apache.org/doc/latest/cql/json.html#json-encoding-of-cassandra-data-types
+	// 传时间戳，不传Datetime了
+	return &LogfileEncoder{
+		CreateDate: fi.CreateTime.Format("2006-01-02"),
+		// CreateTime:   fi.CreateTime.UnixNano().Format("2006-01-02T15:04:05.000-0700"),
+		CreateTime:   fi.CreateTime.UnixNano() / 1000000,
+		SubDir:       fi.SubDir,
+		Pack:         fi.Pack,
+		Filename:     fi.Filename,
+		Size:         fi.Size,
+		ModifyTime:   fi.ModifyTime.UnixNano() / 1000000,
+		Compress:     fi.Compress,
+		CompressSize: fi.CompressSize,
+		Checksum:     fi.Checksum,
+		Host:         fi.Host,
+		FolderTime:   fi.FolderTime.UnixNano() / 1000000,
+		Content:      ctx,
+	}
+}
+
+// tail模式下的单行记录，按多行规则切分时为整条记录
+type LogLineEncoder struct {
+	SubDir     string `json:"folder"`
+	Filename   string `json:"name"`
+	Offset     int64  `json:"offset"`
+	Line       string `json:"line"`
+	ModifyTime int64  `json:"modify_time"`
+	Host       string `json:"host"`
+}
+
 func (v *MsgValueEncoder) Encode() ([]byte, error) {
 	return json.Marshal(v)
 }
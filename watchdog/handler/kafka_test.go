@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/cobolbaby/log-agent/watchdog/lib/avro"
+	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newAvroAdapter(t *testing.T) (*KafkaAdapter, *avro.HTTPRegistry, func()) {
+	server := httptest.NewServer(avro.NewMemoryRegistry())
+	registry, err := avro.NewHTTPRegistry(server.URL)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	adapter := &KafkaAdapter{
+		Name:     "Kafka",
+		Config:   &KafkaAdapterCfg{Topic: "topic-bsilog", Format: KAFKA_FORMAT_AVRO},
+		logger:   log.NewConsoleLogger(),
+		registry: registry,
+	}
+	return adapter, registry, server.Close
+}
+
+// Confluent格式: Magic Byte(0) + 4字节大端序的Schema ID + Avro二进制
+func decodeConfluent(t *testing.T, data []byte, registry *avro.HTTPRegistry, subject string, schema *avro.Schema) map[string]interface{} {
+	if len(data) < 5 || data[0] != 0 {
+		t.Fatalf("invalid magic byte in %x", data)
+	}
+	id, err := registry.Register(subject, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := int(binary.BigEndian.Uint32(data[1:5])); got != id {
+		t.Fatalf("got schema id %d, want %d of %s", got, id, subject)
+	}
+	record, err := schema.Decode(data[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestKafkaAvroFileValue(t *testing.T) {
+	adapter, registry, closer := newAvroAdapter(t)
+	defer closer()
+
+	now := time.Now()
+	fi := &FileMeta{
+		SubDir:     "K2786401B/board",
+		Filename:   "20181213181445__All.txt",
+		Size:       5,
+		CreateTime: now,
+		ModifyTime: now,
+		Content:    []byte("hello"),
+		Checksum:   "5d41402abc4b2a76b9719d911017c592",
+		Host:       "smoke-host",
+	}
+	value, err := adapter.fileValue(fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := value.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.Length() != len(data) {
+		t.Errorf("got length %d, want %d", value.Length(), len(data))
+	}
+
+	record := decodeConfluent(t, data, registry, "topic-bsilog-value", recordAvroSchema)
+	if !bytes.Equal(record["content"].([]byte), fi.Content) {
+		t.Errorf("content: got %q, want %q", record["content"], fi.Content)
+	}
+	if record["folder"] != fi.SubDir || record["name"] != fi.Filename || record["checksum"] != fi.Checksum {
+		t.Errorf("unexpected record %v", record)
+	}
+	if record["modify_time"] != now.UnixNano()/1000000 {
+		t.Errorf("modify_time: got %v", record["modify_time"])
+	}
+}
+
+func TestKafkaAvroLineValue(t *testing.T) {
+	adapter, registry, closer := newAvroAdapter(t)
+	defer closer()
+
+	encode, err := adapter.lineEncoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := &LogLineEncoder{
+		SubDir:     "syslog",
+		Filename:   "app.log",
+		Offset:     1024,
+		Line:       "error: disk full",
+		ModifyTime: 1545000000000,
+		Host:       "smoke-host",
+	}
+	value, err := encode(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := value.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 单行记录发送至独立的Topic，按TopicNameStrategy注册Schema
+	if topic := adapter.lineTopic(); topic != "topic-bsilog-line" {
+		t.Errorf("got line topic %s, want topic-bsilog-line", topic)
+	}
+	record := decodeConfluent(t, data, registry, "topic-bsilog-line-value", lineAvroSchema)
+	if record["line"] != line.Line || record["offset"] != line.Offset || record["name"] != line.Filename {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	// 文件以及单行记录的Schema分别注册，ID不同
+	fileID, err := registry.Register("topic-bsilog-value", recordAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lineID := int(binary.BigEndian.Uint32(data[1:5])); lineID == fileID {
+		t.Errorf("got the same schema id %d for file and line records", lineID)
+	}
+}
+
+func TestKafkaJSONFileValue(t *testing.T) {
+	adapter := &KafkaAdapter{
+		Name:   "Kafka",
+		Config: &KafkaAdapterCfg{Topic: "topic-bsilog"},
+		logger: log.NewConsoleLogger(),
+	}
+	value, err := adapter.fileValue(&FileMeta{Filename: "a.txt", Content: []byte{0xab, 0xcd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := value.(*MsgValueEncoder)
+	if !ok {
+		t.Fatalf("got %T, want *MsgValueEncoder", value)
+	}
+	if content := msg.Payload.(*LogfileEncoder).Content; content != "0xabcd" {
+		t.Errorf("content: got %s, want 0xabcd", content)
+	}
+}
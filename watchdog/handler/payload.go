@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/lib/compress"
+	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Kafka、RabbitMQ等以消息投递文件的适配器共用的读取、解包以及压缩逻辑
+// prefix为日志前缀，e.g. [KafkaAdapter]
+
+// 读取文件内容，计算校验值并按需压缩后交由send投递，zip包则逐个投递其中的文件
+func uploadFile(fi *FileMeta, logger log.Logger, prefix string, send func(*FileMeta) error) error {
+	switch fi.Ext {
+	case ".zip":
+		return uploadZipedFile(fi, logger, prefix, send)
+	default:
+		return uploadUnArchivedFile(fi, logger, prefix, send)
+	}
+}
+
+func uploadUnArchivedFile(fi *FileMeta, logger log.Logger, prefix string, send func(*FileMeta) error) error {
+	var err error
+	for i, attempts := 1, 3; i <= attempts; i++ {
+		if fi.Content, err = ioutil.ReadFile(fi.Filepath); err == nil {
+			break
+		}
+		if i < attempts {
+			logger.Warnf("%s ioutil.ReadFile error: %s, retry #%d", prefix, err, i)
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+	}
+	if err != nil {
+		/*
+			e.g.
+			1) File Handle Error: open D:\\I1000_testlog\\HP\\Matterhorn\\K2786401B\\board\\20181213181445__All.txt: The process cannot access the file because it is being used by another process.
+		*/
+		logger.Errorf("%s %s ioutil.ReadFile error, %s", prefix, fi.Filepath, err)
+		return err
+	}
+	if err := prepareContent(fi, logger, prefix); err != nil {
+		return err
+	}
+	return send(fi)
+}
+
+func uploadZipedFile(fi *FileMeta, logger log.Logger, prefix string, send func(*FileMeta) error) error {
+	if fi.Size == 0 {
+		logger.Errorf("%s %s is not a valid zip", prefix, fi.Filepath)
+		return nil
+	}
+
+	r, err := zip.OpenReader(fi.Filepath)
+	if err != nil {
+		logger.Errorf("%s %s zip.OpenReader error, %s", prefix, fi.Filepath, err)
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		// Windows下压缩包中的简体中文采用GBK编码
+		if !utf8.ValidString(f.Name) {
+			f.Name, err = GBKToUTF8(f.Name)
+			if err != nil {
+				logger.Warnf("%s %s is not a valid utf-8/gbk string", prefix, f.Name)
+				return err
+			}
+		}
+
+		file := &FileMeta{
+			Filepath:   fi.Filepath,
+			SubDir:     fi.SubDir,
+			Pack:       fi.Filename,
+			Filename:   f.Name,
+			Ext:        strings.ToLower(filepath.Ext(f.Name)),
+			Size:       f.FileInfo().Size(),
+			CreateTime: fi.CreateTime,
+			ModifyTime: fi.ModifyTime,
+			LastOp:     fi.LastOp,
+			Host:       fi.Host,
+			FolderTime: fi.FolderTime,
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			logger.Errorf("%s %s f.Open error, %s", prefix, f.Name, err)
+			return err
+		}
+		file.Content, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			logger.Errorf("%s %s ioutil.ReadAll error, %s", prefix, f.Name, err)
+			return err
+		}
+
+		if err := prepareContent(file, logger, prefix); err != nil {
+			return err
+		}
+		if err := send(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 计算原始内容的校验值，压缩需要保证内存使用率问题
+func prepareContent(fi *FileMeta, logger log.Logger, prefix string) error {
+	fi.Checksum = fmt.Sprintf("%x", md5.Sum(fi.Content))
+
+	if compress.CheckIfCompressSize(fi.Size) && compress.CheckIfCompressExt(fi.Ext) {
+		fi.Compress = true
+
+		var err error
+		fi.Content, err = compress.GzipContent(fi.Content)
+		if err != nil {
+			logger.Errorf("%s %s couldn't be compressed, %s", prefix, fi.Filepath, err)
+			return err
+		}
+
+		fi.CompressSize = int64(len(fi.Content))
+	} else {
+		fi.Compress = false
+		fi.CompressSize = fi.Size
+	}
+	return nil
+}
+
+// 消息Key，考虑是压缩包的场景
+func fileMsgKey(fi *FileMeta) string {
+	msgKey := fi.SubDir + "/"
+	if fi.Pack == "" {
+		return msgKey + fi.Filename
+	}
+	return msgKey + fi.Pack + "/" + fi.Filename
+}
+
+// 增量内容逐行(或按已切分的记录)生成单行消息，Offset为记录在文件中的起始位置
+func lineRecords(fi *FileMeta) []*LogLineEncoder {
+	records := fi.Records
+	if records == nil {
+		records = bytes.SplitAfter(fi.Content, []byte("\n"))
+	}
+
+	var lines []*LogLineEncoder
+	offset := fi.Offset
+	for _, line := range records {
+		if len(line) == 0 {
+			continue
+		}
+		lines = append(lines, &LogLineEncoder{
+			SubDir:     fi.SubDir,
+			Filename:   fi.Filename,
+			Offset:     offset,
+			Line:       strings.TrimRight(string(line), "\r\n"),
+			ModifyTime: fi.ModifyTime.UnixNano() / 1000000,
+			Host:       fi.Host,
+		})
+		offset += int64(len(line))
+	}
+	return lines
+}
@@ -0,0 +1,166 @@
+package watchdog
+
+import (
+	"encoding/json"
+	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"github.com/Shopify/sarama"
+	"runtime"
+	"time"
+)
+
+const (
+	HEARTBEAT_INTERVAL = time.Minute // 心跳上报间隔
+)
+
+type HeartbeatPlugin struct {
+	Biz         string    `json:"biz"`
+	Watch       string    `json:"watch"`
+	Processed   uint64    `json:"processed"` // 自上次心跳以来处理成功的文件数
+	Failed      uint64    `json:"failed"`    // 自上次心跳以来处理失败的文件数
+	LastSuccess time.Time `json:"last_success"`
+}
+
+// 心跳信息，用于集中排查Agent是否存活以及是否存在积压
+type Heartbeat struct {
+	Host        string             `json:"host"`
+	Version     string             `json:"version"`
+	OS          string             `json:"os"`
+	Arch        string             `json:"arch"`
+	StartTime   time.Time          `json:"start_time"`
+	Time        time.Time          `json:"time"`
+	Plugins     []*HeartbeatPlugin `json:"plugins"`
+	Backlog     int64              `json:"backlog"` // 尚未处理完成的事件数
+	DeadLetters int                `json:"dead_letters"`
+	Poisoned    int                `json:"poisoned"`
+	LastUpload  time.Time          `json:"last_upload"`
+}
+
+// 心跳的发送目标，可按需扩展
+type HeartbeatSink interface {
+	Send(beat *Heartbeat) error
+}
+
+// 通过Kafka发送心跳，消息以主机名为Key
+type KafkaHeartbeatSink struct {
+	Brokers  string
+	Topic    string
+	producer sarama.SyncProducer
+}
+
+func NewKafkaHeartbeatSink(brokers string, topic string) HeartbeatSink {
+	return &KafkaHeartbeatSink{
+		Brokers: brokers,
+		Topic:   topic,
+	}
+}
+
+func (this *KafkaHeartbeatSink) Send(beat *Heartbeat) error {
+	// 启动时Kafka不可用也不影响后续心跳
+	if this.producer == nil {
+		producer, err := handler.NewKafkaProducer(this.Brokers)
+		if err != nil {
+			return err
+		}
+		this.producer = producer
+	}
+	value, err := json.Marshal(beat)
+	if err != nil {
+		return err
+	}
+	_, _, err = this.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: this.Topic,
+		Key:   sarama.StringEncoder(beat.Host),
+		Value: sarama.ByteEncoder(value),
+	})
+	return err
+}
+
+// 将心跳写入日志，便于本地调试
+type LogHeartbeatSink struct {
+	logger log.Logger
+}
+
+func NewLogHeartbeatSink(logger log.Logger) HeartbeatSink {
+	return &LogHeartbeatSink{
+		logger: logger,
+	}
+}
+
+func (this *LogHeartbeatSink) Send(beat *Heartbeat) error {
+	value, err := json.Marshal(beat)
+	if err != nil {
+		return err
+	}
+	this.logger.Infof("Heartbeat: %s", value)
+	return nil
+}
+
+func (this *Watchdog) SetVersion(version string) *Watchdog {
+	this.version = version
+	return this
+}
+
+func (this *Watchdog) SetHeartbeat(sink HeartbeatSink, interval time.Duration) *Watchdog {
+	// 非正数的间隔无法创建定时器
+	if interval <= 0 {
+		interval = HEARTBEAT_INTERVAL
+	}
+	this.heartbeatSink = sink
+	this.heartbeatInterval = interval
+	return this
+}
+
+// 定时发送心跳，各业务的处理数为两次心跳之间的增量
+func (this *Watchdog) heartbeat() {
+	defer this.wg.Done()
+
+	last := make(map[string]BizStats)
+	ticker := time.NewTicker(this.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stopping:
+			return
+		case <-ticker.C:
+			beat := this.newHeartbeat(last)
+			if err := this.heartbeatSink.Send(beat); err != nil {
+				this.Logger.Warnf("Fail to send heartbeat: %s", err)
+			}
+		}
+	}
+}
+
+func (this *Watchdog) newHeartbeat(last map[string]BizStats) *Heartbeat {
+	status := this.Status()
+	beat := &Heartbeat{
+		Host:        status.Host,
+		Version:     this.version,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		StartTime:   status.StartTime,
+		Time:        time.Now(),
+		Backlog:     status.Queues.InFlight,
+		DeadLetters: status.DeadLetters,
+		Poisoned:    status.Poisoned,
+	}
+	for _, p := range status.Plugins {
+		// 统计数为累计值，热加载重新挂载的业务沿用原有统计
+		prev := last[p.Biz]
+		hp := &HeartbeatPlugin{
+			Biz:         p.Biz,
+			Processed:   p.Stats.Processed - prev.Processed,
+			Failed:      p.Stats.Failed - prev.Failed,
+			LastSuccess: p.Stats.LastSuccess,
+		}
+		if p.Rule != nil {
+			hp.Watch = p.Rule.Watch
+		}
+		if p.Stats.LastSuccess.After(beat.LastUpload) {
+			beat.LastUpload = p.Stats.LastSuccess
+		}
+		last[p.Biz] = p.Stats
+		beat.Plugins = append(beat.Plugins, hp)
+	}
+	return beat
+}
@@ -0,0 +1,65 @@
+package watchdog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	LEDGER_PREFIX = "_ledger:" // 文件在各适配器上的投递记录
+)
+
+// 记录每个文件版本在各适配器上的投递状态，重试时跳过已成功的适配器
+type DeliveryLedger struct {
+	db *badger.DB
+}
+
+func NewDeliveryLedger(db *badger.DB) *DeliveryLedger {
+	return &DeliveryLedger{
+		db: db,
+	}
+}
+
+// 适配器的目标端变更后(如Kafka的topic)，原有记录不再适用
+func (this *DeliveryLedger) key(file *handler.FileMeta, adapter handler.WatchdogHandler) []byte {
+	id := adapter.GetName()
+	if keyer, ok := adapter.(handler.LedgerKeyer); ok {
+		id = keyer.LedgerKey()
+	}
+	return []byte(LEDGER_PREFIX + file.Filepath + "|" + id)
+}
+
+// 文件版本以修改时间标识，增量内容还需区分读取位置
+func (this *DeliveryLedger) version(file *handler.FileMeta) []byte {
+	t, _ := file.ModifyTime.GobEncode()
+	if file.Incremental {
+		t = append(t, []byte(fmt.Sprintf("@%d", file.Offset))...)
+	}
+	return t
+}
+
+// 判断当前文件版本是否已被该适配器确认
+func (this *DeliveryLedger) Delivered(file *handler.FileMeta, adapter handler.WatchdogHandler) bool {
+	err := this.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(this.key(file, adapter))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if bytes.Equal(val, this.version(file)) {
+				return nil
+			}
+			return errors.New("the delivered version is outdated")
+		})
+	})
+	return err == nil
+}
+
+func (this *DeliveryLedger) Record(file *handler.FileMeta, adapter handler.WatchdogHandler) error {
+	return this.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(this.key(file, adapter), this.version(file))
+	})
+}
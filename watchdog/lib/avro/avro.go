@@ -0,0 +1,185 @@
+package avro
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// 仅支持由基本类型字段构成的record，足以描述文件以及单行记录的消息
+const (
+	TYPE_STRING  = "string"
+	TYPE_BYTES   = "bytes"
+	TYPE_LONG    = "long"
+	TYPE_INT     = "int"
+	TYPE_BOOLEAN = "boolean"
+	TYPE_DOUBLE  = "double"
+)
+
+type Field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Avro Schema中的name仅允许字母、数字以及下划线，不能包含"-"
+type Schema struct {
+	Type      string  `json:"type"`
+	Name      string  `json:"name"`
+	Namespace string  `json:"namespace,omitempty"`
+	Fields    []Field `json:"fields"`
+}
+
+func NewSchema(namespace string, name string, fields ...Field) *Schema {
+	return &Schema{
+		Type:      "record",
+		Name:      name,
+		Namespace: namespace,
+		Fields:    fields,
+	}
+}
+
+// 注册至Schema Registry的JSON文本
+func (this *Schema) String() string {
+	b, _ := json.Marshal(this)
+	return string(b)
+}
+
+// 解析Schema Registry返回的Schema，仅支持由基本类型字段构成的record
+func ParseSchema(text string) (*Schema, error) {
+	schema := new(Schema)
+	if err := json.Unmarshal([]byte(text), schema); err != nil {
+		return nil, fmt.Errorf("avro: unsupported schema, %s", err)
+	}
+	if schema.Type != "record" {
+		return nil, fmt.Errorf("avro: unsupported schema type %q", schema.Type)
+	}
+	return schema, nil
+}
+
+// 按字段顺序编码为Avro二进制格式，缺少的字段或类型不符时返回错误
+// Ref: https://avro.apache.org/docs/current/spec.html#binary_encoding
+func (this *Schema) Encode(record map[string]interface{}) ([]byte, error) {
+	buf := make([]byte, 0, 256)
+	for _, f := range this.Fields {
+		v, ok := record[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("avro: missing field %q", f.Name)
+		}
+		var err error
+		if buf, err = appendValue(buf, f.Type, v); err != nil {
+			return nil, fmt.Errorf("avro: field %q, %s", f.Name, err)
+		}
+	}
+	return buf, nil
+}
+
+// 按字段顺序解码，string解码为string，bytes为[]byte，long以及int均为int64
+func (this *Schema) Decode(data []byte) (map[string]interface{}, error) {
+	record := make(map[string]interface{}, len(this.Fields))
+	for _, f := range this.Fields {
+		v, n, err := readValue(data, f.Type)
+		if err != nil {
+			return nil, fmt.Errorf("avro: field %q, %s", f.Name, err)
+		}
+		record[f.Name] = v
+		data = data[n:]
+	}
+	return record, nil
+}
+
+func readValue(data []byte, typ string) (interface{}, int, error) {
+	switch typ {
+	case TYPE_STRING, TYPE_BYTES:
+		l, n := binary.Varint(data)
+		if n <= 0 || l < 0 || int64(len(data)-n) < l {
+			return nil, 0, errors.New("invalid length")
+		}
+		b := data[n : n+int(l)]
+		if typ == TYPE_STRING {
+			return string(b), n + int(l), nil
+		}
+		return append([]byte{}, b...), n + int(l), nil
+	case TYPE_LONG, TYPE_INT:
+		v, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, 0, errors.New("invalid varint")
+		}
+		return v, n, nil
+	case TYPE_BOOLEAN:
+		if len(data) < 1 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return data[0] != 0, 1, nil
+	case TYPE_DOUBLE:
+		if len(data) < 8 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), 8, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported type %q", typ)
+}
+
+func appendValue(buf []byte, typ string, v interface{}) ([]byte, error) {
+	switch typ {
+	case TYPE_STRING:
+		s, ok := v.(string)
+		if !ok {
+			break
+		}
+		return AppendBytes(buf, []byte(s)), nil
+	case TYPE_BYTES:
+		switch b := v.(type) {
+		case []byte:
+			return AppendBytes(buf, b), nil
+		case string:
+			return AppendBytes(buf, []byte(b)), nil
+		}
+	case TYPE_LONG, TYPE_INT:
+		switch n := v.(type) {
+		case int64:
+			return AppendLong(buf, n), nil
+		case int:
+			return AppendLong(buf, int64(n)), nil
+		case int32:
+			return AppendLong(buf, int64(n)), nil
+		}
+	case TYPE_BOOLEAN:
+		b, ok := v.(bool)
+		if !ok {
+			break
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case TYPE_DOUBLE:
+		f, ok := v.(float64)
+		if !ok {
+			break
+		}
+		return AppendDouble(buf, f), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %q", typ)
+	}
+	return nil, fmt.Errorf("%T is not a valid %s", v, typ)
+}
+
+// long以及int均采用zigzag编码的变长整数
+func AppendLong(buf []byte, n int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], n)]...)
+}
+
+// bytes以及string均以长度开头
+func AppendBytes(buf []byte, b []byte) []byte {
+	return append(AppendLong(buf, int64(len(b))), b...)
+}
+
+func AppendDouble(buf []byte, f float64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(f))
+	return append(buf, tmp[:]...)
+}
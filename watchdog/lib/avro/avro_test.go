@@ -0,0 +1,105 @@
+package avro
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testSchema = NewSchema("", "dcagent_test",
+	Field{Name: "name", Type: TYPE_STRING},
+	Field{Name: "content", Type: TYPE_BYTES},
+	Field{Name: "size", Type: TYPE_LONG},
+	Field{Name: "count", Type: TYPE_INT},
+	Field{Name: "compress", Type: TYPE_BOOLEAN},
+	Field{Name: "ratio", Type: TYPE_DOUBLE},
+)
+
+func TestEncodeDecode(t *testing.T) {
+	record := map[string]interface{}{
+		"name":     "sub/测试.log",
+		"content":  []byte{0, 1, 2, 0xff},
+		"size":     int64(-1234567890123),
+		"count":    42,
+		"compress": true,
+		"ratio":    0.25,
+	}
+	data, err := testSchema.Encode(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := testSchema.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded["name"] != record["name"] {
+		t.Errorf("name: got %v, want %v", decoded["name"], record["name"])
+	}
+	if !bytes.Equal(decoded["content"].([]byte), record["content"].([]byte)) {
+		t.Errorf("content: got %v, want %v", decoded["content"], record["content"])
+	}
+	if decoded["size"] != int64(-1234567890123) {
+		t.Errorf("size: got %v", decoded["size"])
+	}
+	if decoded["count"] != int64(42) {
+		t.Errorf("count: got %v", decoded["count"])
+	}
+	if decoded["compress"] != true {
+		t.Errorf("compress: got %v", decoded["compress"])
+	}
+	if decoded["ratio"] != 0.25 {
+		t.Errorf("ratio: got %v", decoded["ratio"])
+	}
+}
+
+// Ref: https://avro.apache.org/docs/current/spec.html#binary_encoding
+func TestEncodeBinary(t *testing.T) {
+	schema := NewSchema("", "test", Field{Name: "n", Type: TYPE_LONG}, Field{Name: "s", Type: TYPE_STRING})
+	data, err := schema.Encode(map[string]interface{}{"n": int64(-64), "s": "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// -64 => 0x7f，"foo" => 长度3(0x06)加内容
+	if want := []byte{0x7f, 0x06, 'f', 'o', 'o'}; !bytes.Equal(data, want) {
+		t.Errorf("got %x, want %x", data, want)
+	}
+}
+
+func TestEncodeError(t *testing.T) {
+	if _, err := testSchema.Encode(map[string]interface{}{"name": "a"}); err == nil {
+		t.Error("expect an error for the missing fields")
+	}
+	schema := NewSchema("", "test", Field{Name: "n", Type: TYPE_LONG})
+	if _, err := schema.Encode(map[string]interface{}{"n": "1"}); err == nil {
+		t.Error("expect an error for the mismatched type")
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	data, err := testSchema.Encode(map[string]interface{}{
+		"name":     "name",
+		"content":  []byte("content"),
+		"size":     int64(1),
+		"count":    1,
+		"compress": false,
+		"ratio":    1.0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testSchema.Decode(data[:len(data)-1]); err == nil {
+		t.Error("expect an error for the truncated data")
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	schema, err := ParseSchema(testSchema.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.String() != testSchema.String() {
+		t.Errorf("got %s, want %s", schema, testSchema)
+	}
+	if _, err := ParseSchema(`{"type":"enum","name":"x","symbols":["A"]}`); err == nil {
+		t.Error("expect an error for the unsupported schema")
+	}
+}
@@ -0,0 +1,266 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REGISTRY_TIMEOUT      = 10 * time.Second
+	REGISTRY_CONTENT_TYPE = "application/vnd.schemaregistry.v1+json"
+)
+
+var ErrSubjectNotFound = errors.New("subject or schema not found")
+
+// 按subject注册或查找Schema，返回Schema ID
+type Registry interface {
+	Register(subject string, schema *Schema) (int, error)
+}
+
+// Confluent Schema Registry的HTTP客户端，Schema ID按subject以及Schema缓存，多个地址依次尝试
+type HTTPRegistry struct {
+	urls    []string
+	client  *http.Client
+	mu      sync.Mutex
+	ids     map[string]int
+	schemas map[int]*Schema // 消费端按ID获取的Schema
+}
+
+func NewHTTPRegistry(urls string) (*HTTPRegistry, error) {
+	var list []string
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u == "" {
+			continue
+		}
+		if _, err := url.Parse(u); err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no schema registry url")
+	}
+	return &HTTPRegistry{
+		urls:    list,
+		client:  &http.Client{Timeout: REGISTRY_TIMEOUT},
+		ids:     make(map[string]int),
+		schemas: make(map[int]*Schema),
+	}, nil
+}
+
+// 先查找已注册的Schema，不存在时再注册，以便仅有只读权限时也能使用
+func (this *HTTPRegistry) Register(subject string, schema *Schema) (int, error) {
+	key := subject + "|" + schema.String()
+	this.mu.Lock()
+	id, ok := this.ids[key]
+	this.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	id, err := this.post("/subjects/"+url.PathEscape(subject), schema)
+	if err == ErrSubjectNotFound {
+		id, err = this.post("/subjects/"+url.PathEscape(subject)+"/versions", schema)
+	}
+	if err != nil {
+		return 0, err
+	}
+	this.mu.Lock()
+	this.ids[key] = id
+	this.mu.Unlock()
+	return id, nil
+}
+
+// 依据消息中的Schema ID获取Schema，供消费端解码
+func (this *HTTPRegistry) Lookup(id int) (*Schema, error) {
+	this.mu.Lock()
+	schema, ok := this.schemas[id]
+	this.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	var result *registryResult
+	var err error
+	for _, u := range this.urls {
+		if result, err = this.request(http.MethodGet, u+"/schemas/ids/"+strconv.Itoa(id), nil); err == nil || err == ErrSubjectNotFound {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if schema, err = ParseSchema(result.Schema); err != nil {
+		return nil, err
+	}
+	this.mu.Lock()
+	this.schemas[id] = schema
+	this.mu.Unlock()
+	return schema, nil
+}
+
+func (this *HTTPRegistry) post(path string, schema *Schema) (int, error) {
+	body, _ := json.Marshal(map[string]string{"schema": schema.String()})
+	var err error
+	for _, u := range this.urls {
+		var result *registryResult
+		if result, err = this.request(http.MethodPost, u+path, body); err == ErrSubjectNotFound {
+			return 0, err
+		}
+		if err != nil {
+			continue
+		}
+		if result.ID <= 0 {
+			return 0, fmt.Errorf("schema registry %s: no schema id", u+path)
+		}
+		return result.ID, nil
+	}
+	return 0, err
+}
+
+type registryResult struct {
+	ID        int    `json:"id"`
+	Schema    string `json:"schema"`
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func (this *HTTPRegistry) request(method string, u string, body []byte) (*registryResult, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", REGISTRY_CONTENT_TYPE)
+	}
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	result := new(registryResult)
+	json.Unmarshal(data, result)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrSubjectNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("schema registry %s: %s %d %s", u, resp.Status, result.ErrorCode, result.Message)
+	}
+	return result, nil
+}
+
+// 进程内的Schema Registry，实现注册、查找以及按ID获取Schema的接口，用于调试或联调
+type MemoryRegistry struct {
+	mu       sync.Mutex
+	schemas  []string                  // Schema ID - 1 -> Schema
+	subjects map[string]map[string]int // subject -> Schema -> Schema ID
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		subjects: make(map[string]map[string]int),
+	}
+}
+
+// 相同的Schema仅分配一个ID，与Confluent的实现一致
+func (this *MemoryRegistry) Register(subject string, schema *Schema) (int, error) {
+	return this.register(subject, schema.String()), nil
+}
+
+func (this *MemoryRegistry) register(subject string, schema string) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if id, ok := this.subjects[subject][schema]; ok {
+		return id
+	}
+	id := 0
+	for i, s := range this.schemas {
+		if s == schema {
+			id = i + 1
+			break
+		}
+	}
+	if id == 0 {
+		this.schemas = append(this.schemas, schema)
+		id = len(this.schemas)
+	}
+	if this.subjects[subject] == nil {
+		this.subjects[subject] = make(map[string]int)
+	}
+	this.subjects[subject][schema] = id
+	return id
+}
+
+func (this *MemoryRegistry) lookup(subject string, schema string) (int, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	id, ok := this.subjects[subject][schema]
+	return id, ok
+}
+
+// 依据ID获取Schema，供消费端解码
+func (this *MemoryRegistry) Schema(id int) (string, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if id <= 0 || id > len(this.schemas) {
+		return "", false
+	}
+	return this.schemas[id-1], true
+}
+
+// POST /subjects/<subject>            查找
+// POST /subjects/<subject>/versions   注册
+// GET  /schemas/ids/<id>              获取
+func (this *MemoryRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", REGISTRY_CONTENT_TYPE)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "schemas" && parts[1] == "ids":
+		id, _ := strconv.Atoi(parts[2])
+		schema, ok := this.Schema(id)
+		if !ok {
+			registryError(w, http.StatusNotFound, 40403, "Schema not found")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"schema": schema})
+	case r.Method == http.MethodPost && parts[0] == "subjects" && (len(parts) == 2 || len(parts) == 3 && parts[2] == "versions"):
+		var req struct {
+			Schema string `json:"schema"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Schema == "" {
+			registryError(w, http.StatusUnprocessableEntity, 42201, "Invalid schema")
+			return
+		}
+		subject, _ := url.PathUnescape(parts[1])
+		if len(parts) == 3 {
+			json.NewEncoder(w).Encode(map[string]int{"id": this.register(subject, req.Schema)})
+			return
+		}
+		id, ok := this.lookup(subject, req.Schema)
+		if !ok {
+			registryError(w, http.StatusNotFound, 40403, "Schema not found")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"subject": subject, "id": id, "schema": req.Schema})
+	default:
+		registryError(w, http.StatusNotFound, 404, "Not found")
+	}
+}
+
+func registryError(w http.ResponseWriter, status int, code int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error_code": code, "message": message})
+}
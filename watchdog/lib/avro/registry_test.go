@@ -0,0 +1,96 @@
+package avro
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestRegistry(t *testing.T) (*MemoryRegistry, *HTTPRegistry, func()) {
+	mem := NewMemoryRegistry()
+	server := httptest.NewServer(mem)
+	registry, err := NewHTTPRegistry(server.URL)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return mem, registry, server.Close
+}
+
+func TestHTTPRegistryRegister(t *testing.T) {
+	mem, registry, closer := newTestRegistry(t)
+	defer closer()
+
+	id, err := registry.Register("topic-file-value", testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Errorf("got schema id %d, want 1", id)
+	}
+	if schema, ok := mem.Schema(id); !ok || schema != testSchema.String() {
+		t.Errorf("got schema %q, want %q", schema, testSchema)
+	}
+
+	// 已注册的Schema通过查找获得相同的ID
+	again, err := registry.Register("topic-file-value", testSchema)
+	if err != nil || again != id {
+		t.Errorf("got schema id %d (%v), want %d", again, err, id)
+	}
+	fresh, _ := NewHTTPRegistry(registry.urls[0])
+	if again, err := fresh.Register("topic-file-value", testSchema); err != nil || again != id {
+		t.Errorf("got schema id %d (%v) by lookup, want %d", again, err, id)
+	}
+
+	// 相同的Schema在其他subject下也仅分配一个ID
+	other, err := registry.Register("topic-line-value", testSchema)
+	if err != nil || other != id {
+		t.Errorf("got schema id %d (%v) under another subject, want %d", other, err, id)
+	}
+
+	line := NewSchema("", "dcagent_line", Field{Name: "line", Type: TYPE_STRING})
+	lineID, err := registry.Register("topic-line-value", line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lineID == id {
+		t.Errorf("got the same schema id %d for different schemas", lineID)
+	}
+}
+
+func TestHTTPRegistryLookup(t *testing.T) {
+	_, registry, closer := newTestRegistry(t)
+	defer closer()
+
+	id, err := registry.Register("topic-file-value", testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := registry.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.String() != testSchema.String() {
+		t.Errorf("got %s, want %s", schema, testSchema)
+	}
+	if _, err := registry.Lookup(id + 1); err != ErrSubjectNotFound {
+		t.Errorf("got %v for the unknown schema id, want %v", err, ErrSubjectNotFound)
+	}
+}
+
+func TestHTTPRegistryFailover(t *testing.T) {
+	mem := NewMemoryRegistry()
+	server := httptest.NewServer(mem)
+	defer server.Close()
+
+	// 首个地址不可用时使用下一个地址
+	registry, err := NewHTTPRegistry("http://127.0.0.1:1, " + server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Register("topic-file-value", testSchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHTTPRegistry(" , "); err == nil {
+		t.Error("expect an error for the empty urls")
+	}
+}
@@ -0,0 +1,147 @@
+package chunk
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strconv"
+)
+
+// 超过单条消息上限的文件拆分为多个分片，以相同的Key依次发送，分片信息记录于消息Header
+const (
+	HEADER_FILE_ID     = "file_id"     // 同一文件的各分片一致，重传时不变
+	HEADER_CHUNK_INDEX = "chunk_index" // 分片序号，从0开始
+	HEADER_CHUNK_TOTAL = "chunk_total" // 分片总数
+	HEADER_CHECKSUM    = "checksum"    // 原始文件内容(解压后)的MD5
+)
+
+var HEADERS = []string{HEADER_FILE_ID, HEADER_CHUNK_INDEX, HEADER_CHUNK_TOTAL, HEADER_CHECKSUM}
+
+type Chunk struct {
+	FileID   string
+	Index    int
+	Total    int
+	Checksum string
+}
+
+// 按大小切分内容，分片引用原内容；空内容或不超过size时仅有一个分片
+func Split(content []byte, size int) [][]byte {
+	if size <= 0 || len(content) <= size {
+		return [][]byte{content}
+	}
+	parts := make([][]byte, 0, (len(content)+size-1)/size)
+	for len(content) > size {
+		parts = append(parts, content[:size])
+		content = content[size:]
+	}
+	return append(parts, content)
+}
+
+func (this *Chunk) Headers() map[string]string {
+	return map[string]string{
+		HEADER_FILE_ID:     this.FileID,
+		HEADER_CHUNK_INDEX: strconv.Itoa(this.Index),
+		HEADER_CHUNK_TOTAL: strconv.Itoa(this.Total),
+		HEADER_CHECKSUM:    this.Checksum,
+	}
+}
+
+// 解析消息Header，不含分片信息时返回nil
+func ParseHeaders(headers map[string]string) (*Chunk, error) {
+	id, ok := headers[HEADER_FILE_ID]
+	if !ok {
+		return nil, nil
+	}
+	index, err := strconv.Atoi(headers[HEADER_CHUNK_INDEX])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s of %s: %s", HEADER_CHUNK_INDEX, id, err)
+	}
+	total, err := strconv.Atoi(headers[HEADER_CHUNK_TOTAL])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s of %s: %s", HEADER_CHUNK_TOTAL, id, err)
+	}
+	if total <= 0 || index < 0 || index >= total {
+		return nil, fmt.Errorf("chunk %d/%d of %s out of range", index, total, id)
+	}
+	return &Chunk{
+		FileID:   id,
+		Index:    index,
+		Total:    total,
+		Checksum: headers[HEADER_CHECKSUM],
+	}, nil
+}
+
+// 校验重组后的原始内容
+func Verify(content []byte, checksum string) error {
+	if sum := fmt.Sprintf("%x", md5.Sum(content)); sum != checksum {
+		return fmt.Errorf("checksum mismatch, expect %s but got %s", checksum, sum)
+	}
+	return nil
+}
+
+type partial struct {
+	total    int
+	checksum string
+	parts    [][]byte
+	received int
+}
+
+// 按文件归集分片，非并发安全。同一文件的分片在同一分区内有序，但生产者重试时可能重复
+type Assembler struct {
+	files     map[string]*partial
+	completed map[string]bool // 已重组的文件，其后到达的重复分片直接忽略
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{
+		files:     make(map[string]*partial),
+		completed: make(map[string]bool),
+	}
+}
+
+// 集齐所有分片后返回按序拼接的内容，重复的分片忽略
+func (this *Assembler) Add(c *Chunk, content []byte) ([]byte, bool, error) {
+	if this.completed[c.FileID] {
+		return nil, false, nil
+	}
+	p, ok := this.files[c.FileID]
+	if !ok {
+		p = &partial{
+			total:    c.Total,
+			checksum: c.Checksum,
+			parts:    make([][]byte, c.Total),
+		}
+		this.files[c.FileID] = p
+	}
+	if p.total != c.Total || p.checksum != c.Checksum {
+		return nil, false, fmt.Errorf("chunk %d/%d of %s does not match the previous chunks, total %d, checksum %s", c.Index, c.Total, c.FileID, p.total, p.checksum)
+	}
+	if p.parts[c.Index] == nil {
+		// 空分片也需标记为已接收
+		p.parts[c.Index] = append([]byte{}, content...)
+		p.received++
+	}
+	if p.received < p.total {
+		return nil, false, nil
+	}
+	delete(this.files, c.FileID)
+	this.completed[c.FileID] = true
+
+	size := 0
+	for _, part := range p.parts {
+		size += len(part)
+	}
+	whole := make([]byte, 0, size)
+	for _, part := range p.parts {
+		whole = append(whole, part...)
+	}
+	return whole, true, nil
+}
+
+// 尚未集齐分片的文件
+func (this *Assembler) Pending() []string {
+	ids := make([]string, 0, len(this.files))
+	for id := range this.files {
+		ids = append(ids, id)
+	}
+	return ids
+}
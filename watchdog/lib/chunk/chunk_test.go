@@ -0,0 +1,146 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		size    int
+		want    []string
+	}{
+		{"empty", "", 4, []string{""}},
+		{"smaller than size", "abc", 4, []string{"abc"}},
+		{"equal to size", "abcd", 4, []string{"abcd"}},
+		{"exact multiple", "abcdefgh", 4, []string{"abcd", "efgh"}},
+		{"with remainder", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"no limit", "abcdefghij", 0, []string{"abcdefghij"}},
+	}
+	for _, tt := range tests {
+		parts := Split([]byte(tt.content), tt.size)
+		if len(parts) != len(tt.want) {
+			t.Errorf("%s: got %d parts, want %d", tt.name, len(parts), len(tt.want))
+			continue
+		}
+		for i := range parts {
+			if string(parts[i]) != tt.want[i] {
+				t.Errorf("%s: part %d got %q, want %q", tt.name, i, parts[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    *Chunk
+		wantErr bool
+	}{
+		{"not chunked", map[string]string{}, nil, false},
+		{"valid", map[string]string{HEADER_FILE_ID: "f", HEADER_CHUNK_INDEX: "1", HEADER_CHUNK_TOTAL: "3", HEADER_CHECKSUM: "c"},
+			&Chunk{FileID: "f", Index: 1, Total: 3, Checksum: "c"}, false},
+		{"invalid index", map[string]string{HEADER_FILE_ID: "f", HEADER_CHUNK_INDEX: "x", HEADER_CHUNK_TOTAL: "3"}, nil, true},
+		{"invalid total", map[string]string{HEADER_FILE_ID: "f", HEADER_CHUNK_INDEX: "0", HEADER_CHUNK_TOTAL: ""}, nil, true},
+		{"index out of range", map[string]string{HEADER_FILE_ID: "f", HEADER_CHUNK_INDEX: "3", HEADER_CHUNK_TOTAL: "3"}, nil, true},
+		{"negative index", map[string]string{HEADER_FILE_ID: "f", HEADER_CHUNK_INDEX: "-1", HEADER_CHUNK_TOTAL: "3"}, nil, true},
+		{"zero total", map[string]string{HEADER_FILE_ID: "f", HEADER_CHUNK_INDEX: "0", HEADER_CHUNK_TOTAL: "0"}, nil, true},
+	}
+	for _, tt := range tests {
+		c, err := ParseHeaders(tt.headers)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.want == nil {
+			if c != nil {
+				t.Errorf("%s: got %+v, want nil", tt.name, c)
+			}
+			continue
+		}
+		if c == nil || *c != *tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, c, tt.want)
+		}
+	}
+
+	// Headers与ParseHeaders互为逆操作
+	c := &Chunk{FileID: "f", Index: 2, Total: 5, Checksum: "c"}
+	if got, err := ParseHeaders(c.Headers()); err != nil || *got != *c {
+		t.Errorf("round trip: got %+v, %v, want %+v", got, err, c)
+	}
+}
+
+func checksum(content string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(content)))
+}
+
+func TestAssembler(t *testing.T) {
+	type part struct {
+		index   int
+		total   int
+		content string
+	}
+	tests := []struct {
+		name    string
+		parts   []part
+		want    string // 集齐时的内容
+		done    int    // 集齐于第几个分片，-1表示未集齐
+		wantErr int    // 第几个分片报错，-1表示无错误
+	}{
+		{"in order", []part{{0, 3, "abc"}, {1, 3, "def"}, {2, 3, "g"}}, "abcdefg", 2, -1},
+		{"out of order", []part{{2, 3, "g"}, {0, 3, "abc"}, {1, 3, "def"}}, "abcdefg", 2, -1},
+		{"duplicate chunk", []part{{0, 3, "abc"}, {0, 3, "abc"}, {1, 3, "def"}, {2, 3, "g"}}, "abcdefg", 3, -1},
+		{"duplicate after completion", []part{{0, 2, "abc"}, {1, 2, "def"}, {1, 2, "def"}}, "abcdef", 1, -1},
+		{"empty final chunk", []part{{0, 2, "abc"}, {1, 2, ""}}, "abc", 1, -1},
+		{"missing chunk", []part{{0, 3, "abc"}, {2, 3, "g"}}, "", -1, -1},
+		{"mismatched total", []part{{0, 3, "abc"}, {1, 2, "def"}}, "", -1, 1},
+	}
+	for _, tt := range tests {
+		a := NewAssembler()
+		for i, p := range tt.parts {
+			sum := checksum(tt.want)
+			whole, done, err := a.Add(&Chunk{FileID: "f", Index: p.index, Total: p.total, Checksum: sum}, []byte(p.content))
+			if (err != nil) != (i == tt.wantErr) {
+				t.Errorf("%s: chunk #%d got error %v", tt.name, i, err)
+			}
+			if done != (i == tt.done) {
+				t.Errorf("%s: chunk #%d got done %t", tt.name, i, done)
+			}
+			if done && !bytes.Equal(whole, []byte(tt.want)) {
+				t.Errorf("%s: got %q, want %q", tt.name, whole, tt.want)
+			}
+			if done {
+				if err := Verify(whole, sum); err != nil {
+					t.Errorf("%s: %s", tt.name, err)
+				}
+			}
+		}
+		if pending := a.Pending(); (len(pending) > 0) != (tt.done < 0) {
+			t.Errorf("%s: got pending %v", tt.name, pending)
+		}
+	}
+}
+
+func TestAssemblerMismatchedChecksum(t *testing.T) {
+	a := NewAssembler()
+	if _, _, err := a.Add(&Chunk{FileID: "f", Index: 0, Total: 2, Checksum: "a"}, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.Add(&Chunk{FileID: "f", Index: 1, Total: 2, Checksum: "b"}, []byte("y")); err == nil {
+		t.Error("got nil error for a mismatched checksum")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if err := Verify([]byte("hello"), checksum("hello")); err != nil {
+		t.Error(err)
+	}
+	if err := Verify([]byte("hello"), checksum("world")); err == nil {
+		t.Error("got nil error for a mismatched checksum")
+	}
+}
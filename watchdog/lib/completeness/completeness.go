@@ -0,0 +1,262 @@
+package completeness
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 文件完整性的检测策略
+const (
+	STRATEGY_STABLE    = "stable"    // 连续多次探测大小以及修改时间均未变化
+	STRATEGY_EXCLUSIVE = "exclusive" // 能够以独占方式打开，Linux下仅能检测到使用flock加锁的写入方
+	STRATEGY_PROCFD    = "procfd"    // 无进程以写方式打开该文件，仅支持Linux
+	STRATEGY_ZIP       = "zip"       // 压缩包的中央目录可正常读取
+	STRATEGY_MARKER    = "marker"    // 存在同名的标记文件，e.g. a.zip.done
+)
+
+const (
+	STABLE_PROBES   = 2                // 大小以及修改时间的探测次数
+	STABLE_INTERVAL = time.Second      // 探测间隔
+	MARKER_SUFFIX   = ".done"          // 标记文件的后缀
+	RETRY_DELAY     = 10 * time.Second // 文件不完整时重新处理的延迟
+	TIMEOUT         = 30 * time.Minute // 超过该时间未修改的文件不再检测，交由后续流程处理(如损坏的压缩包)
+)
+
+// 标记文件本身无需上传
+var ErrMarkerFile = errors.New("marker file")
+
+// 文件尚未写完，需延迟后重新处理
+type IncompleteError struct {
+	Path     string
+	Strategy string
+	Reason   string
+	Delay    time.Duration
+}
+
+func (this *IncompleteError) Error() string {
+	return fmt.Sprintf("%s is incomplete (%s): %s", this.Path, this.Strategy, this.Reason)
+}
+
+func IsIncomplete(err error) (*IncompleteError, bool) {
+	e, ok := err.(*IncompleteError)
+	return e, ok
+}
+
+type Checker interface {
+	Check(path string) error
+}
+
+type Options struct {
+	Probes   int
+	Interval time.Duration
+	Marker   string
+	Delay    time.Duration
+	Timeout  time.Duration
+}
+
+// 依次执行各检测策略，任一策略不通过即认为文件不完整
+type Chain struct {
+	checkers []Checker
+	names    []string
+	delay    time.Duration
+	timeout  time.Duration
+	marker   string
+}
+
+// 依据策略名生成检测链，未配置策略时返回nil
+func New(strategies []string, opts Options) (*Chain, error) {
+	if opts.Probes <= 0 {
+		opts.Probes = STABLE_PROBES
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = STABLE_INTERVAL
+	}
+	if opts.Marker == "" {
+		opts.Marker = MARKER_SUFFIX
+	}
+	if opts.Delay <= 0 {
+		opts.Delay = RETRY_DELAY
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = TIMEOUT
+	}
+	chain := &Chain{delay: opts.Delay, timeout: opts.Timeout}
+	for _, name := range strategies {
+		name = strings.TrimSpace(name)
+		var checker Checker
+		switch name {
+		case "":
+			continue
+		case STRATEGY_STABLE:
+			checker = &StableChecker{Probes: opts.Probes, Interval: opts.Interval, Expire: opts.Timeout}
+		case STRATEGY_EXCLUSIVE:
+			checker = CheckerFunc(exclusiveOpen)
+		case STRATEGY_PROCFD:
+			checker = CheckerFunc(openForWrite)
+		case STRATEGY_ZIP:
+			checker = CheckerFunc(zipIntegrity)
+		case STRATEGY_MARKER:
+			checker = &MarkerChecker{Suffix: opts.Marker}
+			chain.marker = opts.Marker
+		default:
+			return nil, fmt.Errorf("unknown completeness strategy %q", name)
+		}
+		chain.checkers = append(chain.checkers, checker)
+		chain.names = append(chain.names, name)
+	}
+	if len(chain.checkers) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+func (this *Chain) Check(path string) error {
+	if this.marker != "" && strings.HasSuffix(path, this.marker) {
+		return ErrMarkerFile
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// 长时间未变化的文件即便检测不通过也不会再完整了，避免无限期地重新处理
+	if time.Since(fi.ModTime()) > this.timeout {
+		return nil
+	}
+	for i, checker := range this.checkers {
+		if err := checker.Check(path); err != nil {
+			// 文件已不存在等异常无需再等待
+			if os.IsNotExist(err) {
+				return err
+			}
+			delay := this.delay
+			if d, ok := checker.(delayer); ok {
+				delay = d.RetryDelay()
+			}
+			return &IncompleteError{Path: path, Strategy: this.names[i], Reason: err.Error(), Delay: delay}
+		}
+	}
+	return nil
+}
+
+// 检测策略自定义的重新处理延迟
+type delayer interface {
+	RetryDelay() time.Duration
+}
+
+type CheckerFunc func(path string) error
+
+func (f CheckerFunc) Check(path string) error {
+	return f(path)
+}
+
+type probe struct {
+	size    int64
+	modTime time.Time
+	count   int       // 大小以及修改时间连续未变化的探测次数
+	last    time.Time // 最近一次计入的探测时间
+}
+
+// 多次探测期间大小或修改时间发生变化，说明仍在写入
+// 探测结果按路径记录，未达到探测次数时返回错误由调用方延迟重新处理，避免占用协程等待
+type StableChecker struct {
+	Probes   int
+	Interval time.Duration
+	Expire   time.Duration // 超过该时间未再探测的记录视为失效，e.g. 文件已被删除
+	mu       sync.Mutex
+	probes   map[string]*probe
+	swept    time.Time
+}
+
+func (this *StableChecker) Check(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		this.mu.Lock()
+		delete(this.probes, path)
+		this.mu.Unlock()
+		return err
+	}
+	if this.Probes <= 1 {
+		return nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := time.Now()
+	this.sweep(now)
+	p, ok := this.probes[path]
+	if !ok || fi.Size() != p.size || !fi.ModTime().Equal(p.modTime) {
+		var reason string
+		if ok {
+			reason = fmt.Sprintf("size changed from %d to %d", p.size, fi.Size())
+		} else {
+			reason = fmt.Sprintf("probe 1/%d", this.Probes)
+		}
+		this.probes[path] = &probe{size: fi.Size(), modTime: fi.ModTime(), count: 1, last: now}
+		return errors.New(reason)
+	}
+	// 间隔不足的探测不计数
+	if now.Sub(p.last) >= this.Interval {
+		p.count++
+		p.last = now
+	}
+	if p.count < this.Probes {
+		return fmt.Errorf("probe %d/%d", p.count, this.Probes)
+	}
+	delete(this.probes, path)
+	return nil
+}
+
+// 按探测间隔重新处理
+func (this *StableChecker) RetryDelay() time.Duration {
+	return this.Interval
+}
+
+// 清理失效的探测记录，每个探测间隔至多清理一次
+func (this *StableChecker) sweep(now time.Time) {
+	if this.probes == nil {
+		this.probes = make(map[string]*probe)
+	}
+	if now.Sub(this.swept) < this.Interval {
+		return
+	}
+	this.swept = now
+	for path, p := range this.probes {
+		if now.Sub(p.last) > this.Expire {
+			delete(this.probes, path)
+		}
+	}
+}
+
+// 上游在文件写完后生成标记文件
+type MarkerChecker struct {
+	Suffix string
+}
+
+func (this *MarkerChecker) Check(path string) error {
+	marker := path + this.Suffix
+	if _, err := os.Stat(marker); err != nil {
+		return fmt.Errorf("marker %s not found", filepath.Base(marker))
+	}
+	return nil
+}
+
+// 中央目录位于压缩包末尾，拷贝未完成时无法读取
+func zipIntegrity(path string) error {
+	if strings.ToLower(filepath.Ext(path)) != ".zip" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	return r.Close()
+}
@@ -0,0 +1,86 @@
+package completeness
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Linux下没有强制的独占打开，仅能检测到使用flock加锁的写入方
+func exclusiveOpen(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return fmt.Errorf("locked by another process, %s", err)
+	}
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// 遍历/proc/<pid>/fd，查找以写方式打开该文件的进程
+// 无权限读取的进程直接跳过，故需以root运行才能覆盖所有进程
+func openForWrite(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return err
+	}
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	self := strconv.Itoa(os.Getpid())
+	for _, proc := range procs {
+		pid := proc.Name()
+		if _, err := strconv.Atoi(pid); err != nil || pid == self {
+			continue
+		}
+		fdDir := filepath.Join("/proc", pid, "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || target != abs {
+				continue
+			}
+			if writable(filepath.Join("/proc", pid, "fdinfo", fd.Name())) {
+				return fmt.Errorf("opened for writing by pid %s", pid)
+			}
+		}
+	}
+	return nil
+}
+
+// fdinfo中的flags为八进制的打开标志
+func writable(fdinfo string) bool {
+	f, err := os.Open(fdinfo)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "flags:") {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "flags:")), 8, 64)
+		if err != nil {
+			return false
+		}
+		mode := flags & syscall.O_ACCMODE
+		return mode == syscall.O_WRONLY || mode == syscall.O_RDWR
+	}
+	return false
+}
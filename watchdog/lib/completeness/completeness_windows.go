@@ -0,0 +1,29 @@
+package completeness
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// 不共享读写打开文件，其他进程仍持有句柄时返回共享冲突
+func exclusiveOpen(path string) error {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(pathp,
+		syscall.GENERIC_READ, 0, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if err == syscall.ERROR_FILE_NOT_FOUND || err == syscall.ERROR_PATH_NOT_FOUND {
+			return err
+		}
+		return fmt.Errorf("opened by another process, %s", err)
+	}
+	return syscall.CloseHandle(h)
+}
+
+// Windows下没有/proc，由exclusive策略代替
+func openForWrite(path string) error {
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"errors"
+	"io/ioutil"
 	"regexp"
 )
 
@@ -44,3 +45,12 @@ func GzipContent(originBuff []byte) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+func GunzipContent(compressed []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return ioutil.ReadAll(gr)
+}
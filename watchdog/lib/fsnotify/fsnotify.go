@@ -1,36 +1,169 @@
 package fsnotify
 
 import (
+	"errors"
 	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/lib/schedule"
 	"github.com/fsnotify/fsnotify"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// 遍历回调返回该错误时将中断整个遍历
+var ErrWalkAborted = errors.New("walk aborted")
+
+// 遍历回调返回该错误时不再遍历该目录的子项
+var ErrSkipDir = errors.New("skip this directory")
+
+// 文件变更的判定策略
+const (
+	CHANGE_POLICY_MTIME    = "mtime"    // 比较文件大小以及修改时间
+	CHANGE_POLICY_CHECKSUM = "checksum" // 比较文件内容的校验值
+	CHANGE_POLICY_BOTH     = "both"     // 大小或修改时间变化后，再比较校验值确认
+)
+
+// 文件处理模式
+const (
+	MODE_FILE = "file" // 整个文件作为一条记录上传
+	MODE_TAIL = "tail" // 仅读取新增的行，适用于持续追加的日志文件
+)
+
+// 事件通道已满时的处理策略
+const (
+	BACKPRESSURE_BLOCK = "block" // 阻塞等待，持续阻塞会导致内核事件队列溢出
+	BACKPRESSURE_SPILL = "spill" // 暂存至磁盘，通道空闲后再转发
+	BACKPRESSURE_DROP  = "drop"  // 丢弃事件，稍后补扫目录
+)
+
+// 文件删除或移出监控目录后的处理策略
+const (
+	DELETE_IGNORE    = "ignore"    // 仅清理本地状态
+	DELETE_TOMBSTONE = "tombstone" // 向目标端发送删除标记，保留已上传的数据
+	DELETE_MIRROR    = "mirror"    // 同步删除目标端的数据
+)
+
 type Event struct {
 	Name     string
 	Op       string
 	Biz      string
 	RootPath string
 	ModTime  time.Time
+	Size     int64
 	IsDir    bool
+	Records  [][]byte // 非文件来源(如syslog)的记录，随事件投递以便失败后重试
+	Host     string   // 上传文件的来源主机，为空时取Agent的主机名
+	SubDir   string   // 上传文件的子目录，仅Host不为空时有效
 }
 
 type Rule struct {
-	Biz             string
-	RootPath        string
-	MonitPath       string
-	Patterns        string
-	Ignores         string
+	Biz       string
+	RootPath  string
+	MonitPath string
+	Patterns  string // 旧版的单一匹配规则，同时作用于文件以及目录
+	Ignores   string
+	// 多条匹配规则，支持re:以及glob:前缀，排除规则优先
+	Includes     []string
+	Excludes     []string
+	FileIncludes []string
+	FileExcludes []string
+	DirIncludes  []string
+	DirExcludes  []string
+	// 文件大小以及修改时间过滤，为0时不限制
+	MinSize         int64
+	MaxSize         int64
+	MinAge          time.Duration
+	MaxAge          time.Duration
 	MaxNestingLevel uint
 	DebounceTime    time.Duration
+	ChangePolicy    string
+	Mode            string
+	// 多行记录切分规则
+	MultilineStart    string
+	MultilineContinue string
+	MultilineFlush    time.Duration
+	QueueCap          int    // 事件通道容量，为0时使用全局配置
+	Backpressure      string // 事件通道已满时的处理策略
+	OnDelete          string // 文件删除后的处理策略
+	// 轮询扫描的间隔、定时任务以及允许扫描的时间段
+	PollInterval  time.Duration
+	PollSchedules []string
+	PollWindow    string
+	// 轮询扫描的并发数以及是否跳过未变化的目录
+	ScanWorkers     int
+	ScanIncremental bool
+	OnOverflow      func(e *Event)
 	Done            chan struct{}
+	matcher         *Matcher
+}
+
+// 校验并编译匹配规则，避免运行时编译引发panic
+func (rule *Rule) Validate() error {
+	if err := rule.Compile(); err != nil {
+		return err
+	}
+	for _, expr := range []string{rule.MultilineStart, rule.MultilineContinue} {
+		if expr == "" {
+			continue
+		}
+		if _, err := regexp.Compile(expr); err != nil {
+			return err
+		}
+	}
+	switch rule.ChangePolicy {
+	case "", CHANGE_POLICY_MTIME, CHANGE_POLICY_CHECKSUM, CHANGE_POLICY_BOTH:
+	default:
+		return fmt.Errorf("unknown change policy %q", rule.ChangePolicy)
+	}
+	switch rule.Mode {
+	case "", MODE_FILE, MODE_TAIL:
+	default:
+		return fmt.Errorf("unknown mode %q", rule.Mode)
+	}
+	switch rule.Backpressure {
+	case "", BACKPRESSURE_BLOCK, BACKPRESSURE_SPILL, BACKPRESSURE_DROP:
+	default:
+		return fmt.Errorf("unknown backpressure policy %q", rule.Backpressure)
+	}
+	switch rule.OnDelete {
+	case "", DELETE_IGNORE, DELETE_TOMBSTONE, DELETE_MIRROR:
+	default:
+		return fmt.Errorf("unknown delete policy %q", rule.OnDelete)
+	}
+	for _, expr := range rule.PollSchedules {
+		if _, err := schedule.ParseJob(expr); err != nil {
+			return err
+		}
+	}
+	if _, err := schedule.ParseWindow(rule.PollWindow); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 向事件通道发送事件，通道已满且设置了溢出处理时不再阻塞
+func (rule *Rule) Publish(ch chan *Event, e *Event) {
+	if rule.OnOverflow == nil {
+		ch <- e
+		return
+	}
+	select {
+	case ch <- e:
+	default:
+		rule.OnOverflow(e)
+	}
 }
 
 type RecursiveWatcher struct {
 	*fsnotify.Watcher
+	// 监听数耗尽时回调，由调用方改为轮询该子目录，未设置时返回错误
+	OnExhausted func(dir string)
+	mu          sync.Mutex
+	watches     map[string]bool
 }
 
 func NewRecursiveWatcher() (*RecursiveWatcher, error) {
@@ -38,7 +171,61 @@ func NewRecursiveWatcher() (*RecursiveWatcher, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &RecursiveWatcher{watcher}, nil
+	return &RecursiveWatcher{
+		Watcher: watcher,
+		watches: make(map[string]bool),
+	}, nil
+}
+
+// Linux下超出fs.inotify.max_user_watches时返回ENOSPC，超出max_user_instances时返回EMFILE
+func IsWatchExhausted(err error) bool {
+	return err == syscall.ENOSPC || err == syscall.EMFILE
+}
+
+// 添加目录监听，监听数耗尽时交由OnExhausted处理并返回ErrSkipDir，其子目录也就无需再尝试了
+func (w *RecursiveWatcher) AddWatch(dir string) error {
+	dir = filepath.Clean(dir)
+	if err := w.Watcher.Add(dir); err != nil {
+		if IsWatchExhausted(err) && w.OnExhausted != nil {
+			w.OnExhausted(dir)
+			return ErrSkipDir
+		}
+		return err
+	}
+	w.mu.Lock()
+	w.watches[dir] = true
+	w.mu.Unlock()
+	return nil
+}
+
+// 当前的监听数
+func (w *RecursiveWatcher) Count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.watches)
+}
+
+// 目录删除或移走后移除其自身以及子目录的监听，返回移除的数量
+func (w *RecursiveWatcher) Prune(dir string) int {
+	dir = filepath.Clean(dir)
+	prefix := dir + string(filepath.Separator)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// 仅监听目录，文件的删除事件无需遍历
+	if !w.watches[dir] {
+		return 0
+	}
+	n := 0
+	for path := range w.watches {
+		if path != dir && !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		// 内核在目录删除时已自动移除监听，此处仅清理残留，忽略错误
+		w.Watcher.Remove(path)
+		delete(w.watches, path)
+		n++
+	}
+	return n
 }
 
 func (w *RecursiveWatcher) NotifyFsEvent(rule *Rule, cb func(e *Event, err error)) {
@@ -50,21 +237,20 @@ func (w *RecursiveWatcher) NotifyFsEvent(rule *Rule, cb func(e *Event, err error
 				// 目录--Create事件必须监控，同时考虑到后期会为新建目录添加相应的触发器，所以还需回调
 				// 文件--如果新建文件的父目录被监控了，Create事件就会被抛出，所以无需再次添加至监控列表
 				// 如果将文件也添加至监控列表，则内存中需要维护一个大的map，出现内存持续飙升的问题
-				if !CheckIfMatch(event.Name, rule) || CheckIfIgnore(event.Name, rule) {
-					// fmt.Printf("%s ignore fs event: %s %s", rule.Biz, event.Op, event.Name)
-					continue
-				}
 				fi, err := os.Stat(event.Name)
 				if err != nil {
 					cb(nil, err)
 					continue
 				}
+				if !rule.Match(event.Name, fi.IsDir()) || !rule.AcceptEvent(fi.IsDir(), fi.Size(), fi.ModTime()) {
+					// fmt.Printf("%s ignore fs event: %s %s", rule.Biz, event.Op, event.Name)
+					continue
+				}
 				if fi.IsDir() {
-					w.RecursiveAdd(&Rule{
-						MonitPath: event.Name,
-						Patterns:  rule.Patterns,
-						Ignores:   rule.Ignores,
-					})
+					r := new(Rule)
+					*r = *rule
+					r.MonitPath = event.Name
+					w.RecursiveAdd(r)
 				}
 				cb(&Event{
 					Op:   "CREATE",
@@ -77,7 +263,8 @@ func (w *RecursiveWatcher) NotifyFsEvent(rule *Rule, cb func(e *Event, err error
 				// e.g. Windows下生成一个新文件会触发两个事件: 文件创建事件和目录写入事件
 				// TODO:上述说法在直接拷贝目录的业务场景下不成立，后续还得继续支持该业务场景
 				// 文件--Write事件因文件内容修改引起，所以无需再次添加监控列表
-				if !CheckIfMatch(event.Name, rule) || CheckIfIgnore(event.Name, rule) {
+				fi, err := os.Stat(event.Name)
+				if err != nil || !rule.Match(event.Name, fi.IsDir()) || !rule.AcceptEvent(fi.IsDir(), fi.Size(), fi.ModTime()) {
 					// fmt.Printf("%s ignore fs event: %s %s", rule.Biz, event.Op, event.Name)
 					continue
 				}
@@ -88,13 +275,14 @@ func (w *RecursiveWatcher) NotifyFsEvent(rule *Rule, cb func(e *Event, err error
 				continue
 			}
 			if event.Op&fsnotify.Remove == fsnotify.Remove {
-				// 目录--Remove事件因目录删除引起，如果将其移出监控列表，可优化内存使用，但当前业务不涉及移除目录的操作
+				// 目录--Remove事件因目录删除引起，将其以及子目录移出监控列表，释放监听数
 				// 文件--Remove事件因文件删除引起，而监控列表中仅保存了目录，所以没有什么好移除的
-				if !CheckIfMatch(event.Name, rule) || CheckIfIgnore(event.Name, rule) {
+				w.Prune(event.Name)
+				// 已无法判断是否为目录，按文件或目录之一匹配即可
+				if !rule.Match(event.Name, false) && !rule.Match(event.Name, true) {
 					// fmt.Printf("%s ignore fs event: %s %s", rule.Biz, event.Op, event.Name)
 					continue
 				}
-				// w.Remove(event.Name)
 				cb(&Event{
 					Op:   "REMOVE",
 					Name: event.Name,
@@ -102,13 +290,13 @@ func (w *RecursiveWatcher) NotifyFsEvent(rule *Rule, cb func(e *Event, err error
 				continue
 			}
 			if event.Op&fsnotify.Rename == fsnotify.Rename {
-				// 目录--Rename事件与目录删除等同，如果将其移出监控列表，可优化内存使用，但当前业务不涉及移除目录的操作
+				// 目录--Rename事件与目录删除等同，移入的新目录会触发Create事件并重新添加监听
 				// 文件--Rename事件与文件删除等同，而监控列表中仅保存了目录，所以没有什么好移除的
-				if !CheckIfMatch(event.Name, rule) || CheckIfIgnore(event.Name, rule) {
+				w.Prune(event.Name)
+				if !rule.Match(event.Name, false) && !rule.Match(event.Name, true) {
 					// fmt.Printf("%s ignore fs event: %s %s", rule.Biz, event.Op, event.Name)
 					continue
 				}
-				// w.Remove(event.Name)
 				cb(&Event{
 					Op:   "RENAME",
 					Name: event.Name,
@@ -131,7 +319,12 @@ func (w *RecursiveWatcher) RecursiveAdd(rule *Rule) error {
 		return err
 	}
 	fmt.Println("Add Watch:", rule.MonitPath)
-	w.Add(rule.MonitPath)
+	if err := w.AddWatch(rule.MonitPath); err != nil {
+		if err == ErrSkipDir {
+			return nil
+		}
+		return err
+	}
 	if !fi.IsDir() {
 		return nil
 	}
@@ -141,7 +334,7 @@ func (w *RecursiveWatcher) RecursiveAdd(rule *Rule) error {
 			return nil
 		}
 		fmt.Println("Add Watch:", e.Name)
-		return w.Add(e.Name)
+		return w.AddWatch(e.Name)
 	})
 }
 
@@ -161,42 +354,35 @@ func WalkDir(rule *Rule, level uint, fn func(e *Event) error) error {
 	for _, entry := range entries {
 		subdir := filepath.Join(rule.MonitPath, entry.Name())
 		// 非匹配项就不再遍历
-		if !CheckIfMatch(subdir, rule) || CheckIfIgnore(subdir, rule) {
+		if !rule.Match(subdir, entry.IsDir()) || !rule.Accept(entry.IsDir(), entry.Size(), entry.ModTime()) {
 			continue
 		}
-		fn(&Event{
+		err := fn(&Event{
 			Name:    subdir,
 			ModTime: entry.ModTime(),
+			Size:    entry.Size(),
 			IsDir:   entry.IsDir(),
 			Op:      "LOAD",
 		})
+		if err == ErrWalkAborted {
+			return err
+		}
+		if err == ErrSkipDir {
+			continue
+		}
 		// 支持设定目录监控的深度
 		if entry.IsDir() && (rule.MaxNestingLevel == 0 || (rule.MaxNestingLevel != 0 && level < rule.MaxNestingLevel)) {
 			r := new(Rule)
 			*r = *rule
 			r.MonitPath = subdir
-			WalkDir(r, level+1, fn)
+			if err := WalkDir(r, level+1, fn); err == ErrWalkAborted {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func CheckIfMatch(path string, rule *Rule) bool {
-	if rule.Patterns == ".*" || rule.Patterns == "" {
-		return true
-	}
-	// 匹配规则中分隔符写法仅支持Linux风格
-	return rule.Patterns != "" && regexp.MustCompile(rule.Patterns).MatchString(filepath.ToSlash(path))
-}
-
-func CheckIfIgnore(path string, rule *Rule) bool {
-	if rule.Ignores == ".*" {
-		return true
-	}
-	// 匹配规则中分隔符写法仅支持Linux风格
-	return rule.Ignores != "" && regexp.MustCompile(rule.Ignores).MatchString(filepath.ToSlash(path))
-}
-
 /*
 // filteredSearchOfDirectoryTree Walks down a directory tree looking for
 // files that match the pattern: re. If a file is found print it out and
@@ -0,0 +1,195 @@
+package fsnotify
+
+import (
+	"fmt"
+	"github.com/bmatcuk/doublestar"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 匹配规则的语法前缀，未指定时按正则处理
+const (
+	SYNTAX_REGEX = "re:"   // 正则，匹配完整路径
+	SYNTAX_GLOB  = "glob:" // doublestar通配符，匹配相对于监控根目录的路径，e.g. glob:**/*.log
+)
+
+type pattern struct {
+	expr string
+	re   *regexp.Regexp
+	glob string
+}
+
+func compilePattern(expr string) (*pattern, error) {
+	p := &pattern{expr: expr}
+	switch {
+	case strings.HasPrefix(expr, SYNTAX_GLOB):
+		p.glob = strings.TrimPrefix(expr, SYNTAX_GLOB)
+		// 与自身匹配以遍历整个表达式，空串会在首个分段处提前返回而漏报语法错误
+		if _, err := doublestar.Match(p.glob, p.glob); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %s", p.glob, err)
+		}
+	default:
+		re, err := regexp.Compile(strings.TrimPrefix(expr, SYNTAX_REGEX))
+		if err != nil {
+			return nil, err
+		}
+		p.re = re
+	}
+	return p, nil
+}
+
+func (p *pattern) match(path string, rel string) bool {
+	if p.re != nil {
+		return p.re.MatchString(path)
+	}
+	ok, _ := doublestar.Match(p.glob, rel)
+	return ok
+}
+
+type patterns []*pattern
+
+func compilePatterns(exprs []string) (patterns, error) {
+	var ps patterns
+	for _, expr := range exprs {
+		if expr == "" {
+			continue
+		}
+		p, err := compilePattern(expr)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+func (ps patterns) any(path string, rel string) bool {
+	for _, p := range ps {
+		if p.match(path, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// 预编译的匹配规则，由Rule.Compile生成，规则副本间共享
+type Matcher struct {
+	root         string
+	includes     patterns
+	excludes     patterns
+	fileIncludes patterns
+	fileExcludes patterns
+	dirIncludes  patterns
+	dirExcludes  patterns
+}
+
+// 包含规则为空时视为全部包含，排除规则优先
+func (m *Matcher) Match(path string, isDir bool) bool {
+	// 匹配规则中分隔符写法仅支持Linux风格
+	slashed := filepath.ToSlash(path)
+	rel := slashed
+	if r, err := filepath.Rel(m.root, path); err == nil {
+		rel = filepath.ToSlash(r)
+	}
+	if m.excludes.any(slashed, rel) {
+		return false
+	}
+	if len(m.includes) > 0 && !m.includes.any(slashed, rel) {
+		return false
+	}
+	excludes, includes := m.fileExcludes, m.fileIncludes
+	if isDir {
+		excludes, includes = m.dirExcludes, m.dirIncludes
+	}
+	if excludes.any(slashed, rel) {
+		return false
+	}
+	return len(includes) == 0 || includes.any(slashed, rel)
+}
+
+// 编译匹配规则，旧版的Patterns/Ignores同时作用于文件以及目录
+func (rule *Rule) Compile() error {
+	m := &Matcher{root: filepath.Clean(rule.RootPath)}
+	includes := rule.Includes
+	if rule.Patterns != "" && rule.Patterns != ".*" {
+		includes = append([]string{rule.Patterns}, includes...)
+	}
+	excludes := rule.Excludes
+	if rule.Ignores != "" {
+		excludes = append([]string{rule.Ignores}, excludes...)
+	}
+	var err error
+	for _, c := range []struct {
+		dst   *patterns
+		exprs []string
+	}{
+		{&m.includes, includes},
+		{&m.excludes, excludes},
+		{&m.fileIncludes, rule.FileIncludes},
+		{&m.fileExcludes, rule.FileExcludes},
+		{&m.dirIncludes, rule.DirIncludes},
+		{&m.dirExcludes, rule.DirExcludes},
+	} {
+		if *c.dst, err = compilePatterns(c.exprs); err != nil {
+			return err
+		}
+	}
+	rule.matcher = m
+	return nil
+}
+
+// 路径是否匹配，规则需事先编译，未编译时临时编译(不缓存，避免并发写入)
+func (rule *Rule) Match(path string, isDir bool) bool {
+	m := rule.matcher
+	if m == nil {
+		r := *rule
+		if err := r.Compile(); err != nil {
+			return false
+		}
+		m = r.matcher
+	}
+	return m.Match(path, isDir)
+}
+
+// 文件大小以及修改时间是否满足过滤条件，目录不做过滤
+func (rule *Rule) Accept(isDir bool, size int64, modTime time.Time) bool {
+	return rule.accept(isDir, size, modTime, true)
+}
+
+// 实时事件不按min_age过滤，否则刚写入的文件永远无法通过，由Watchdog依据Settle延迟处理
+func (rule *Rule) AcceptEvent(isDir bool, size int64, modTime time.Time) bool {
+	return rule.accept(isDir, size, modTime, false)
+}
+
+// 距离满足min_age尚需等待的时间
+func (rule *Rule) Settle(modTime time.Time) time.Duration {
+	if rule.MinAge <= 0 {
+		return 0
+	}
+	if wait := rule.MinAge - time.Since(modTime); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (rule *Rule) accept(isDir bool, size int64, modTime time.Time, minAge bool) bool {
+	if isDir {
+		return true
+	}
+	if rule.MinSize > 0 && size < rule.MinSize {
+		return false
+	}
+	if rule.MaxSize > 0 && size > rule.MaxSize {
+		return false
+	}
+	age := time.Since(modTime)
+	if minAge && rule.MinAge > 0 && age < rule.MinAge {
+		return false
+	}
+	if rule.MaxAge > 0 && age > rule.MaxAge {
+		return false
+	}
+	return true
+}
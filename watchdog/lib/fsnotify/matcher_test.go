@@ -0,0 +1,100 @@
+package fsnotify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"no rules", Rule{RootPath: "/data"}, "/data/a.log", false, true},
+		{"legacy patterns", Rule{RootPath: "/data", Patterns: `\.log$`}, "/data/a.log", false, true},
+		{"legacy patterns mismatch", Rule{RootPath: "/data", Patterns: `\.log$`}, "/data/a.txt", false, false},
+		{"legacy ignores", Rule{RootPath: "/data", Ignores: `\.tmp$`}, "/data/a.tmp", false, false},
+		{"regex matches the full path", Rule{RootPath: "/data", Includes: []string{`re:^/data/sub/`}}, "/data/sub/a.log", false, true},
+		{"regex without prefix", Rule{RootPath: "/data", Includes: []string{`^/data/sub/`}}, "/data/other/a.log", false, false},
+		{"glob matches the relative path", Rule{RootPath: "/data", Includes: []string{"glob:**/*.log"}}, "/data/sub/a.log", false, true},
+		{"glob is anchored to the root", Rule{RootPath: "/data", Includes: []string{"glob:sub/*.log"}}, "/data/sub/a.log", false, true},
+		{"glob does not match the absolute path", Rule{RootPath: "/data", Includes: []string{"glob:/data/**"}}, "/data/sub/a.log", false, false},
+		{"glob with unclean root", Rule{RootPath: "/data/./", Includes: []string{"glob:sub/*.log"}}, "/data/sub/a.log", false, true},
+		{"glob outside the root", Rule{RootPath: "/data", Includes: []string{"glob:*.log"}}, "/other/a.log", false, false},
+		{"regex outside the root", Rule{RootPath: "/data", Includes: []string{`re:^/other/`}}, "/other/a.log", false, true},
+		{"relative root falls back to the full path", Rule{RootPath: "data", Includes: []string{"glob:/data/*.log"}}, "/data/a.log", false, true},
+		{"single star does not cross directories", Rule{RootPath: "/data", Includes: []string{"glob:*.log"}}, "/data/sub/a.log", false, false},
+		{"any include matches", Rule{RootPath: "/data", Includes: []string{"glob:*.txt", `re:\.log$`}}, "/data/a.log", false, true},
+		{"exclude wins over include", Rule{RootPath: "/data", Includes: []string{"glob:**/*.log"}, Excludes: []string{"glob:tmp/**"}}, "/data/tmp/a.log", false, false},
+		{"file include ignores directories", Rule{RootPath: "/data", FileIncludes: []string{"glob:**/*.log"}}, "/data/sub", true, true},
+		{"file include filters files", Rule{RootPath: "/data", FileIncludes: []string{"glob:**/*.log"}}, "/data/sub/a.txt", false, false},
+		{"file exclude", Rule{RootPath: "/data", FileExcludes: []string{`re:\.swp$`}}, "/data/.a.swp", false, false},
+		{"dir exclude", Rule{RootPath: "/data", DirExcludes: []string{"glob:**/.git"}}, "/data/repo/.git", true, false},
+		{"dir exclude ignores files", Rule{RootPath: "/data", DirExcludes: []string{"glob:**/.git"}}, "/data/repo/.git", false, true},
+		{"dir include", Rule{RootPath: "/data", DirIncludes: []string{"glob:2019*"}}, "/data/2018", true, false},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		if err := rule.Compile(); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got := rule.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("%s: Match(%s, %t) got %t, want %t", tt.name, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	for _, rule := range []Rule{
+		{Includes: []string{"re:("}},
+		{Excludes: []string{"glob:[a"}},
+		{Patterns: "("},
+		{DirExcludes: []string{"glob:{a"}},
+	} {
+		if err := rule.Compile(); err == nil {
+			t.Errorf("got nil error for %+v", rule)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+	now := time.Now()
+	rule := Rule{MinSize: 10, MaxSize: 100, MinAge: time.Minute, MaxAge: time.Hour}
+	tests := []struct {
+		name    string
+		isDir   bool
+		size    int64
+		modTime time.Time
+		want    bool
+		event   bool // 实时事件不按min_age过滤
+	}{
+		{"directory", true, 0, now, true, true},
+		{"accepted", false, 50, now.Add(-10 * time.Minute), true, true},
+		{"too small", false, 5, now.Add(-10 * time.Minute), false, false},
+		{"too large", false, 500, now.Add(-10 * time.Minute), false, false},
+		{"too young", false, 50, now, false, true},
+		{"too old", false, 50, now.Add(-2 * time.Hour), false, false},
+	}
+	for _, tt := range tests {
+		if got := rule.Accept(tt.isDir, tt.size, tt.modTime); got != tt.want {
+			t.Errorf("%s: Accept got %t, want %t", tt.name, got, tt.want)
+		}
+		if got := rule.AcceptEvent(tt.isDir, tt.size, tt.modTime); got != tt.event {
+			t.Errorf("%s: AcceptEvent got %t, want %t", tt.name, got, tt.event)
+		}
+	}
+
+	if wait := rule.Settle(now.Add(-10 * time.Second)); wait <= 0 || wait > 50*time.Second {
+		t.Errorf("got settle %s, want about 50s", wait)
+	}
+	if wait := rule.Settle(now.Add(-2 * time.Minute)); wait != 0 {
+		t.Errorf("got settle %s, want 0", wait)
+	}
+	if wait := (&Rule{}).Settle(now); wait != 0 {
+		t.Errorf("got settle %s without min_age, want 0", wait)
+	}
+}
@@ -0,0 +1,266 @@
+package fsnotify
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	WALK_WORKERS = 4   // 并发遍历目录的协程数
+	WALK_BATCH   = 256 // 每次读取的目录项数，避免一次性加载大目录
+)
+
+// 回调返回该错误表示文件有待下游处理，所在目录暂不缓存，下次遍历时仍需逐一检查
+var ErrPending = errors.New("pending")
+
+// 目录上次完整遍历时的状态，修改时间以及目录项数均未变化时跳过其下的文件
+type DirState struct {
+	ModTime time.Time
+	Entries int
+	Subdirs []string
+	Rule    string // 匹配规则的指纹，规则变更后需重新遍历
+}
+
+type DirCache interface {
+	LoadDir(biz string, path string) (*DirState, bool)
+	SaveDir(biz string, path string, state *DirState) error
+}
+
+// 并发、增量的目录遍历，回调会被多个协程同时调用
+type Walker struct {
+	// 遍历进度，供外部随时读取
+	Dirs    int64 // 完整遍历的目录数
+	Skipped int64 // 未变化而跳过的目录数
+	Files   int64 // 检查的文件数
+	Workers int
+	Cache   DirCache // 为nil时全量遍历
+}
+
+type dirTask struct {
+	path  string
+	level uint
+}
+
+// 待遍历的目录栈，所有协程空闲且栈为空时遍历结束
+type dirQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	tasks   []dirTask
+	active  int
+	aborted bool
+}
+
+func newDirQueue() *dirQueue {
+	q := &dirQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *dirQueue) push(t dirTask) {
+	q.mu.Lock()
+	q.tasks = append(q.tasks, t)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+func (q *dirQueue) pop() (dirTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.tasks) == 0 && q.active > 0 && !q.aborted {
+		q.cond.Wait()
+	}
+	if q.aborted || len(q.tasks) == 0 {
+		return dirTask{}, false
+	}
+	t := q.tasks[len(q.tasks)-1]
+	q.tasks = q.tasks[:len(q.tasks)-1]
+	q.active++
+	return t, true
+}
+
+func (q *dirQueue) done() {
+	q.mu.Lock()
+	q.active--
+	finished := q.active == 0 && len(q.tasks) == 0
+	q.mu.Unlock()
+	if finished {
+		q.cond.Broadcast()
+	}
+}
+
+func (q *dirQueue) abort() {
+	q.mu.Lock()
+	q.aborted = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// 遍历rule.MonitPath，与WalkDir一致仅返回根目录的错误以及ErrWalkAborted
+func (this *Walker) Walk(rule *Rule, fn func(e *Event) error) error {
+	if _, err := os.Stat(rule.MonitPath); err != nil {
+		return err
+	}
+	workers := this.Workers
+	if workers <= 0 {
+		workers = WALK_WORKERS
+	}
+	fingerprint := ruleFingerprint(rule)
+	queue := newDirQueue()
+	queue.push(dirTask{path: rule.MonitPath, level: 1})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var rootErr error
+	aborted := false
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				t, ok := queue.pop()
+				if !ok {
+					return
+				}
+				err := this.visit(rule, t, fingerprint, queue, fn)
+				queue.done()
+				if err == ErrWalkAborted {
+					mu.Lock()
+					aborted = true
+					mu.Unlock()
+					queue.abort()
+					return
+				}
+				if err != nil && t.path == rule.MonitPath {
+					mu.Lock()
+					rootErr = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if aborted {
+		return ErrWalkAborted
+	}
+	return rootErr
+}
+
+func (this *Walker) visit(rule *Rule, t dirTask, fingerprint string, queue *dirQueue, fn func(e *Event) error) error {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	// 支持设定目录监控的深度
+	descend := rule.MaxNestingLevel == 0 || t.level < rule.MaxNestingLevel
+
+	// 目录的修改时间仅随目录项的增删而变化，故只能跳过本层的文件，子目录仍需逐一检查
+	if this.Cache != nil {
+		if state, ok := this.Cache.LoadDir(rule.Biz, t.path); ok && state.Rule == fingerprint && state.ModTime.Equal(fi.ModTime()) {
+			if n, err := countEntries(t.path); err == nil && n == state.Entries {
+				atomic.AddInt64(&this.Skipped, 1)
+				if descend {
+					for _, name := range state.Subdirs {
+						subdir := filepath.Join(t.path, name)
+						if rule.Match(subdir, true) {
+							queue.push(dirTask{path: subdir, level: t.level + 1})
+						}
+					}
+				}
+				return nil
+			}
+		}
+	}
+
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	state := &DirState{ModTime: fi.ModTime(), Rule: fingerprint}
+	settled := true
+	for {
+		entries, err := f.Readdir(WALK_BATCH)
+		for _, entry := range entries {
+			state.Entries++
+			subdir := filepath.Join(t.path, entry.Name())
+			if entry.IsDir() {
+				state.Subdirs = append(state.Subdirs, entry.Name())
+			}
+			// 非匹配项就不再遍历
+			if !rule.Match(subdir, entry.IsDir()) {
+				continue
+			}
+			// 大小以及修改时间会在目录不变的情况下变化，过滤掉的文件之后可能满足条件
+			if !rule.Accept(entry.IsDir(), entry.Size(), entry.ModTime()) {
+				settled = false
+				continue
+			}
+			if !entry.IsDir() {
+				atomic.AddInt64(&this.Files, 1)
+			}
+			switch fn(&Event{
+				Name:    subdir,
+				ModTime: entry.ModTime(),
+				Size:    entry.Size(),
+				IsDir:   entry.IsDir(),
+				Op:      "LOAD",
+			}) {
+			case ErrWalkAborted:
+				return ErrWalkAborted
+			case ErrSkipDir:
+				continue
+			case ErrPending:
+				settled = false
+			}
+			if entry.IsDir() && descend {
+				queue.push(dirTask{path: subdir, level: t.level + 1})
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&this.Dirs, 1)
+	if this.Cache != nil && settled {
+		return this.Cache.SaveDir(rule.Biz, t.path, state)
+	}
+	return nil
+}
+
+// 仅读取名称，无需逐一获取文件信息
+func countEntries(dir string) (int, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n := 0
+	for {
+		names, err := f.Readdirnames(WALK_BATCH)
+		n += len(names)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func ruleFingerprint(rule *Rule) string {
+	s := fmt.Sprintf("%s|%s|%q|%q|%q|%q|%q|%q|%d|%d|%s|%s|%d",
+		rule.Patterns, rule.Ignores,
+		rule.Includes, rule.Excludes, rule.FileIncludes, rule.FileExcludes, rule.DirIncludes, rule.DirExcludes,
+		rule.MinSize, rule.MaxSize, rule.MinAge, rule.MaxAge, rule.MaxNestingLevel)
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 )
 
 // 完全自主定义
@@ -11,7 +12,9 @@ type AdvancePlugin interface {
 	Name() string
 }
 
+// 热加载时整体替换插件列表，读取方使用快照，与处理中的任务互不影响
 type AdvanceHook struct {
+	mu      sync.RWMutex
 	plugins []AdvancePlugin
 }
 
@@ -20,16 +23,23 @@ func NewAdvanceHook() *AdvanceHook {
 }
 
 func (this *AdvanceHook) Import(plugins ...AdvancePlugin) {
-	this.plugins = plugins
+	snapshot := make([]AdvancePlugin, len(plugins))
+	copy(snapshot, plugins)
+	this.mu.Lock()
+	this.plugins = snapshot
+	this.mu.Unlock()
 }
 
+// 返回的切片不会被后续的Import修改
 func (this *AdvanceHook) GetPlugins() []AdvancePlugin {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
 	return this.plugins
 }
 
 func (this *AdvanceHook) Get(hook string) []AdvancePlugin {
 	var res []AdvancePlugin
-	for _, plugin := range this.plugins {
+	for _, plugin := range this.GetPlugins() {
 		if !reflect.ValueOf(plugin).MethodByName(hook).IsValid() {
 			continue
 		}
@@ -53,6 +63,14 @@ func (this *AdvanceHook) Listen(hook string, params ...interface{}) error {
 	return nil
 }
 
+// 仅对指定插件触发钩子，插件未实现该钩子时直接跳过
+func (this *AdvanceHook) Call(plugin AdvancePlugin, hook string, params ...interface{}) error {
+	if !reflect.ValueOf(plugin).MethodByName(hook).IsValid() {
+		return nil
+	}
+	return this.exec(plugin, hook, params...)
+}
+
 func (this *AdvanceHook) exec(plugin AdvancePlugin, hook string, args ...interface{}) error {
 	f := reflect.ValueOf(plugin).MethodByName(hook)
 	if !f.IsValid() {
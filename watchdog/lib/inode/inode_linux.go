@@ -0,0 +1,20 @@
+package inode
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// 文件标识(设备号:inode)，文件被轮转后即便路径相同标识也会改变
+func Get(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("unsupported file info of %s", path)
+	}
+	return fmt.Sprintf("%d:%d", st.Dev, st.Ino), nil
+}
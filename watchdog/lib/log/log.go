@@ -49,3 +49,12 @@ func NewLogger(path string) Logger {
 
 	return logrusLogger
 }
+
+// 仅输出至控制台，用于配置检查等命令行场景
+func NewConsoleLogger() Logger {
+	logrusLogger := logrus.New()
+	logrusLogger.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+	logrusLogger.SetOutput(os.Stdout)
+	logrusLogger.SetLevel(logrus.WarnLevel)
+	return logrusLogger
+}
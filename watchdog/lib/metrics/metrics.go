@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+const (
+	NAMESPACE = "logagent"
+)
+
+var (
+	// 监听程序捕获的事件数，source为fsnotify或fspolling
+	EventsCaught = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "events_caught_total",
+		Help:      "Number of filesystem events caught by watchers.",
+	}, []string{"biz", "source"})
+
+	// 防抖合并后提交的事件数
+	EventsDebounced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "events_debounced_total",
+		Help:      "Number of events emitted after debouncing.",
+	}, []string{"biz"})
+
+	// 批处理时因重复而被过滤的事件数
+	EventsDuplicated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "events_duplicated_total",
+		Help:      "Number of duplicate events filtered out of a batch.",
+	}, []string{"biz"})
+
+	// 事件通道已满时溢出的事件数，policy为spill或drop
+	EventsOverflowed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "events_overflowed_total",
+		Help:      "Number of events overflowed from a full source queue.",
+	}, []string{"biz", "policy"})
+
+	FilesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "files_processed_total",
+		Help:      "Number of files shipped by all adapters.",
+	}, []string{"biz"})
+
+	FilesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "files_failed_total",
+		Help:      "Number of files failed to process.",
+	}, []string{"biz"})
+
+	FilesRetried = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "files_retried_total",
+		Help:      "Number of files redelivered from the dead letter queue.",
+	}, []string{"biz"})
+
+	// 完整性检测未通过而延迟处理的文件数
+	FilesIncomplete = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "files_incomplete_total",
+		Help:      "Number of files requeued by completeness checks.",
+	}, []string{"biz", "strategy"})
+
+	// 源文件删除后已按策略处理的文件数
+	FilesRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "files_removed_total",
+		Help:      "Number of removed files propagated to adapters.",
+	}, []string{"biz"})
+
+	// 在监控目录内移动且未重复上传的文件数
+	FilesMoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "files_moved_total",
+		Help:      "Number of files moved inside the watch root.",
+	}, []string{"biz"})
+
+	// 读取的原始字节数(每个文件仅统计一次)以及各适配器实际发送的字节数(gzip压缩后)
+	BytesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "bytes_read_total",
+		Help:      "Bytes read from files before compression.",
+	}, []string{"biz"})
+
+	BytesShipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "bytes_shipped_total",
+		Help:      "Bytes shipped to adapters after compression.",
+	}, []string{"biz", "adapter"})
+
+	AdapterLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "adapter_duration_seconds",
+		Help:      "Time spent by an adapter to handle a file.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"biz", "adapter", "result"})
+
+	// 实时监听占用的inotify监听数
+	Watches = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "watches",
+		Help:      "Number of directories watched by fsnotify.",
+	}, []string{"biz"})
+
+	// 监听数耗尽后降级为轮询的子目录数
+	WatchFallbacks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NAMESPACE,
+		Name:      "watch_fallback_dirs",
+		Help:      "Number of subtrees polled because watches were exhausted.",
+	}, []string{"biz"})
+
+	// 监听故障的次数以及恢复后补扫时重新提交的文件数
+	Outages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "watch_outages_total",
+		Help:      "Number of recovered watcher outages.",
+	}, []string{"biz"})
+
+	CaughtUp = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "catchup_files_total",
+		Help:      "Number of files resubmitted by catch-up scans after outages.",
+	}, []string{"biz"})
+
+	PollingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "polling_scan_duration_seconds",
+		Help:      "Time spent by a polling scan.",
+		Buckets:   []float64{.1, .5, 1, 5, 10, 30, 60, 300, 600, 1800},
+	}, []string{"biz"})
+
+	PollingAffected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "polling_affected_files_total",
+		Help:      "Number of changed files found by polling scans.",
+	}, []string{"biz"})
+
+	// 扫描的目录数，result为scanned或skipped(目录未变化)
+	PollingDirs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "polling_dirs_total",
+		Help:      "Number of directories visited by polling scans.",
+	}, []string{"biz", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		EventsCaught,
+		EventsDebounced,
+		EventsDuplicated,
+		EventsOverflowed,
+		FilesProcessed,
+		FilesFailed,
+		FilesRetried,
+		FilesIncomplete,
+		FilesRemoved,
+		FilesMoved,
+		BytesRead,
+		BytesShipped,
+		AdapterLatency,
+		Watches,
+		WatchFallbacks,
+		Outages,
+		CaughtUp,
+		PollingDuration,
+		PollingAffected,
+		PollingDirs,
+	)
+}
+
+func ObserveAdapter(biz string, adapter string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	AdapterLatency.WithLabelValues(biz, adapter, result).Observe(time.Since(start).Seconds())
+}
+
+func ObserveRead(biz string, read int64) {
+	BytesRead.WithLabelValues(biz).Add(float64(read))
+}
+
+func ObserveShipped(biz string, adapter string, shipped int64) {
+	BytesShipped.WithLabelValues(biz, adapter).Add(float64(shipped))
+}
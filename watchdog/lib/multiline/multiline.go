@@ -0,0 +1,84 @@
+package multiline
+
+import (
+	"bytes"
+	"regexp"
+	"time"
+)
+
+const (
+	FLUSH_TIMEOUT = 5 * time.Second // 末尾记录无后续写入时的提交等待时间
+)
+
+// 按行首规则将文本切分为多行记录，如以时间戳开头的堆栈信息、测试步骤输出
+type Splitter struct {
+	start        *regexp.Regexp // 匹配记录的首行
+	cont         *regexp.Regexp // 匹配记录的后续行
+	FlushTimeout time.Duration
+}
+
+// 规则均为空时无需切分，返回nil
+func New(start string, cont string, flush time.Duration) (*Splitter, error) {
+	if start == "" && cont == "" {
+		return nil, nil
+	}
+	s := &Splitter{
+		FlushTimeout: flush,
+	}
+	var err error
+	if start != "" {
+		if s.start, err = regexp.Compile(start); err != nil {
+			return nil, err
+		}
+	}
+	if cont != "" {
+		if s.cont, err = regexp.Compile(cont); err != nil {
+			return nil, err
+		}
+	}
+	if s.FlushTimeout <= 0 {
+		s.FlushTimeout = FLUSH_TIMEOUT
+	}
+	return s, nil
+}
+
+// 判断是否为上一条记录的后续行
+// 匹配首行规则的为新记录，其次依据后续行规则判断，仅配置首行规则时不匹配的均为后续行
+func (this *Splitter) continued(line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	if this.start != nil && this.start.Match(line) {
+		return false
+	}
+	if this.cont != nil {
+		return this.cont.Match(line)
+	}
+	return true
+}
+
+// 切分记录，final为false时末尾的记录可能还有后续行，暂不返回
+// consumed为已切分记录的总字节数
+func (this *Splitter) Split(content []byte, final bool) (records [][]byte, consumed int) {
+	begin := -1
+	pos := 0
+	for pos < len(content) {
+		end := bytes.IndexByte(content[pos:], '\n')
+		if end < 0 {
+			end = len(content)
+		} else {
+			end += pos + 1
+		}
+		if begin < 0 || !this.continued(content[pos:end]) {
+			if begin >= 0 {
+				records = append(records, content[begin:pos])
+				consumed = pos
+			}
+			begin = pos
+		}
+		pos = end
+	}
+	if final && begin >= 0 {
+		records = append(records, content[begin:])
+		consumed = len(content)
+	}
+	return records, consumed
+}
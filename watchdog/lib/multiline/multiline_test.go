@@ -0,0 +1,105 @@
+package multiline
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	TIMESTAMP = `^\d{4}-\d{2}-\d{2}`
+	INDENTED  = `^\s`
+)
+
+func TestNew(t *testing.T) {
+	if s, err := New("", "", 0); s != nil || err != nil {
+		t.Errorf("got %v, %v, want nil splitter without rules", s, err)
+	}
+	if _, err := New("(", "", 0); err == nil {
+		t.Error("got nil error for an invalid start pattern")
+	}
+	if _, err := New("", "[", 0); err == nil {
+		t.Error("got nil error for an invalid continue pattern")
+	}
+	s, err := New(TIMESTAMP, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.FlushTimeout != FLUSH_TIMEOUT {
+		t.Errorf("got flush timeout %s, want %s", s.FlushTimeout, FLUSH_TIMEOUT)
+	}
+	if s, _ := New(TIMESTAMP, "", time.Second); s.FlushTimeout != time.Second {
+		t.Errorf("got flush timeout %s, want %s", s.FlushTimeout, time.Second)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	stack := "2019-01-02 error\n  at a\n  at b\n2019-01-02 info\n"
+	tests := []struct {
+		name     string
+		start    string
+		cont     string
+		content  string
+		final    bool
+		want     []string
+		consumed int
+	}{
+		{"start only, pending last record", TIMESTAMP, "", stack, false,
+			[]string{"2019-01-02 error\n  at a\n  at b\n"}, 31},
+		{"start only, flush last record", TIMESTAMP, "", stack, true,
+			[]string{"2019-01-02 error\n  at a\n  at b\n", "2019-01-02 info\n"}, len(stack)},
+		{"continue only", "", INDENTED, stack, true,
+			[]string{"2019-01-02 error\n  at a\n  at b\n", "2019-01-02 info\n"}, len(stack)},
+		{"start takes precedence over continue", TIMESTAMP, `.`, stack, true,
+			[]string{"2019-01-02 error\n  at a\n  at b\n", "2019-01-02 info\n"}, len(stack)},
+		{"leading lines without start", TIMESTAMP, "", "  orphan\n2019-01-02 a\n", true,
+			[]string{"  orphan\n", "2019-01-02 a\n"}, 22},
+		{"single record is kept until flush", TIMESTAMP, "", "2019-01-02 a\n  b\n", false,
+			nil, 0},
+		{"incomplete last line is flushed", TIMESTAMP, "", "2019-01-02 a\n2019-01-02 b", true,
+			[]string{"2019-01-02 a\n", "2019-01-02 b"}, 25},
+		{"crlf line endings", TIMESTAMP, "", "2019-01-02 a\r\n  b\r\n2019-01-02 c\r\n", false,
+			[]string{"2019-01-02 a\r\n  b\r\n"}, 19},
+		{"empty content", TIMESTAMP, "", "", true, nil, 0},
+	}
+	for _, tt := range tests {
+		s, err := New(tt.start, tt.cont, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, consumed := s.Split([]byte(tt.content), tt.final)
+		if consumed != tt.consumed {
+			t.Errorf("%s: got consumed %d, want %d", tt.name, consumed, tt.consumed)
+		}
+		if len(records) != len(tt.want) {
+			t.Errorf("%s: got %d records %q, want %d", tt.name, len(records), records, len(tt.want))
+			continue
+		}
+		for i := range records {
+			if string(records[i]) != tt.want[i] {
+				t.Errorf("%s: record %d got %q, want %q", tt.name, i, records[i], tt.want[i])
+			}
+		}
+	}
+}
+
+// 未提交的末尾记录在后续内容到达后与之合并切分
+func TestSplitIncremental(t *testing.T) {
+	s, err := New(TIMESTAMP, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("2019-01-02 error\n  at a\n")
+	records, consumed := s.Split(content, false)
+	if len(records) != 0 || consumed != 0 {
+		t.Fatalf("got %q, %d, want the record to be pending", records, consumed)
+	}
+	content = append(content[consumed:], "  at b\n2019-01-02 info\n"...)
+	records, consumed = s.Split(content, false)
+	if len(records) != 1 || string(records[0]) != "2019-01-02 error\n  at a\n  at b\n" {
+		t.Fatalf("got %q", records)
+	}
+	records, _ = s.Split(content[consumed:], true)
+	if len(records) != 1 || string(records[0]) != "2019-01-02 info\n" {
+		t.Fatalf("got %q after flush", records)
+	}
+}
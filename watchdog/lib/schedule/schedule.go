@@ -0,0 +1,136 @@
+package schedule
+
+import (
+	"fmt"
+	"github.com/robfig/cron"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 扫描范围中的{layout}按扫描时间格式化，e.g. {2006-01-02}
+var layoutRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// 定时扫描任务，e.g. "0 2 * * *"为每日凌晨全量扫描，"0 * * * * {2006-01-02}"为每小时扫描当日目录
+type Job struct {
+	Spec  string
+	Scope string // 相对于监控目录的扫描范围，为空时扫描整个监控目录
+	cron.Schedule
+}
+
+// 前5个字段(或@开头的描述符)为cron表达式，其余为扫描范围
+func ParseJob(expr string) (*Job, error) {
+	fields := strings.Fields(expr)
+	n := 5
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		n = 1
+	}
+	if len(fields) < n {
+		return nil, fmt.Errorf("invalid poll schedule %q", expr)
+	}
+	spec := strings.Join(fields[:n], " ")
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid poll schedule %q: %s", expr, err)
+	}
+	return &Job{
+		Spec:     spec,
+		Scope:    strings.Join(fields[n:], " "),
+		Schedule: sched,
+	}, nil
+}
+
+// 扫描范围对应的目录
+func (this *Job) Path(root string, t time.Time) string {
+	if this.Scope == "" {
+		return root
+	}
+	scope := layoutRegexp.ReplaceAllStringFunc(this.Scope, func(s string) string {
+		return t.Format(s[1 : len(s)-1])
+	})
+	return filepath.Join(root, filepath.FromSlash(scope))
+}
+
+func (this *Job) String() string {
+	if this.Scope == "" {
+		return this.Spec
+	}
+	return this.Spec + " " + this.Scope
+}
+
+// 一天中的时间段，结束时间早于开始时间时跨越午夜
+type span struct {
+	start time.Duration
+	end   time.Duration
+}
+
+func (s span) contains(d time.Duration) bool {
+	if s.start <= s.end {
+		return d >= s.start && d < s.end
+	}
+	return d >= s.start || d < s.end
+}
+
+// 允许扫描的时间段，e.g. "20:00-06:00,12:00-13:00"，为空时不限制
+type Window []span
+
+func ParseWindow(expr string) (Window, error) {
+	var w Window
+	for _, part := range strings.Split(expr, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.Split(part, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid poll window %q", part)
+		}
+		var s span
+		for i, dst := range []*time.Duration{&s.start, &s.end} {
+			t, err := time.Parse("15:04", strings.TrimSpace(bounds[i]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid poll window %q: %s", part, err)
+			}
+			*dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		}
+		w = append(w, s)
+	}
+	return w, nil
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+func (w Window) Contains(t time.Time) bool {
+	if len(w) == 0 {
+		return true
+	}
+	d := sinceMidnight(t)
+	for _, s := range w {
+		if s.contains(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// 距下一次进入时间段的时长，已在时间段内时为0
+func (w Window) Wait(t time.Time) time.Duration {
+	if w.Contains(t) {
+		return 0
+	}
+	d := sinceMidnight(t)
+	var wait time.Duration = -1
+	for _, s := range w {
+		delta := s.start - d
+		if delta < 0 {
+			delta += 24 * time.Hour
+		}
+		if wait < 0 || delta < wait {
+			wait = delta
+		}
+	}
+	return wait
+}
@@ -0,0 +1,206 @@
+package state
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/gob"
+	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/dgraph-io/badger"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// 文件最近一次成功投递时的状态
+type Record struct {
+	Size     int64 // 旧版本仅记录修改时间，此时为-1
+	ModTime  time.Time
+	Checksum string
+	// 用于识别监控目录内的移动以及向目标端传递删除
+	Inode      string
+	CreateTime time.Time
+}
+
+func (this *Record) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(this); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func Decode(val []byte) (*Record, error) {
+	record := new(Record)
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(record); err == nil {
+		return record, nil
+	}
+	// 兼容旧版本: 值为修改时间的GobEncode结果
+	var t time.Time
+	if err := t.GobDecode(val); err != nil {
+		return nil, err
+	}
+	return &Record{Size: -1, ModTime: t}, nil
+}
+
+// 统一fspolling与fsnotify的文件变更判定，以路径为Key记录文件状态
+type ChangeDetector struct {
+	db *badger.DB
+}
+
+func NewChangeDetector(db *badger.DB) *ChangeDetector {
+	return &ChangeDetector{
+		db: db,
+	}
+}
+
+func (this *ChangeDetector) Load(path string) (*Record, error) {
+	var record *Record
+	err := this.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(path))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			record, err = Decode(val)
+			return err
+		})
+	})
+	return record, err
+}
+
+// 加载路径本身以及其下所有文件的状态，用于处理目录的删除或移动
+func (this *ChangeDetector) LoadTree(path string) (map[string]*Record, error) {
+	records := make(map[string]*Record)
+	err := this.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte(path)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := string(it.Item().Key())
+			if key != path && !strings.HasPrefix(key, path+string(os.PathSeparator)) {
+				continue
+			}
+			err := it.Item().Value(func(val []byte) error {
+				record, err := Decode(val)
+				if err != nil {
+					return err
+				}
+				records[key] = record
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+func (this *ChangeDetector) Save(txn *badger.Txn, path string, record *Record) error {
+	val, err := record.Encode()
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(path), val)
+}
+
+// 判断文件自上次投递后是否变更，返回文件当前状态(按策略计算校验值)
+// 内容未变但修改时间变化时，更新记录的修改时间，下次仅需比较大小以及修改时间
+func (this *ChangeDetector) Detect(path string, size int64, modTime time.Time, policy string) (*Record, bool) {
+	current := &Record{Size: size, ModTime: modTime}
+	saved, err := this.Load(path)
+	if err != nil {
+		return current, true
+	}
+	sameMeta := saved.ModTime.Equal(modTime) && (saved.Size < 0 || saved.Size == size)
+
+	switch policy {
+	case fsnotify.CHANGE_POLICY_CHECKSUM:
+	case fsnotify.CHANGE_POLICY_BOTH:
+		if sameMeta {
+			return current, false
+		}
+	default:
+		return current, !sameMeta
+	}
+	// 大小不一致，内容必然已变更
+	if saved.Size >= 0 && saved.Size != size {
+		return current, true
+	}
+	if current.Checksum, err = Checksum(path); err != nil || saved.Checksum != current.Checksum {
+		return current, true
+	}
+	if !sameMeta {
+		current.Inode, current.CreateTime = saved.Inode, saved.CreateTime
+		this.db.Update(func(txn *badger.Txn) error {
+			return this.Save(txn, path, current)
+		})
+	}
+	return current, false
+}
+
+func (this *ChangeDetector) Delete(txn *badger.Txn, path string) error {
+	return txn.Delete([]byte(path))
+}
+
+func Checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+const (
+	DIR_PREFIX = "_dir:" // 目录的增量遍历状态
+)
+
+// 基于badger的目录状态缓存，按业务区分，避免同一目录下不同匹配规则间相互影响
+type DirCache struct {
+	db *badger.DB
+}
+
+func NewDirCache(db *badger.DB) *DirCache {
+	return &DirCache{
+		db: db,
+	}
+}
+
+func (this *DirCache) key(biz string, path string) []byte {
+	return []byte(DIR_PREFIX + biz + "|" + path)
+}
+
+func (this *DirCache) LoadDir(biz string, path string) (*fsnotify.DirState, bool) {
+	state := new(fsnotify.DirState)
+	err := this.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(this.key(biz, path))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return gob.NewDecoder(bytes.NewReader(val)).Decode(state)
+		})
+	})
+	if err != nil {
+		return nil, false
+	}
+	return state, true
+}
+
+func (this *DirCache) SaveDir(biz string, path string, state *fsnotify.DirState) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(state); err != nil {
+		return err
+	}
+	return this.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(this.key(biz, path), buf.Bytes())
+	})
+}
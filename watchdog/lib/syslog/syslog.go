@@ -0,0 +1,221 @@
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 消息格式
+const (
+	FORMAT_RFC5424 = "rfc5424"
+	FORMAT_RFC3164 = "rfc3164"
+)
+
+const (
+	MAX_MESSAGE_SIZE = 64 * 1024 // 单条消息的最大字节数，超出部分截断
+	DEFAULT_PRIORITY = 13        // 缺少PRI时按user.notice处理，见RFC3164 4.3.3
+)
+
+var ErrEmptyMessage = errors.New("empty syslog message")
+
+// 解析后的syslog消息，RFC3164中不存在的字段为空
+type Message struct {
+	Format         string    `json:"format"`
+	Facility       int       `json:"facility"`
+	Severity       int       `json:"severity"`
+	Timestamp      time.Time `json:"timestamp"`
+	Hostname       string    `json:"hostname,omitempty"`
+	AppName        string    `json:"app_name,omitempty"`
+	ProcID         string    `json:"proc_id,omitempty"`
+	MsgID          string    `json:"msg_id,omitempty"`
+	StructuredData string    `json:"structured_data,omitempty"`
+	Message        string    `json:"message"`
+}
+
+// 宽松解析，无法识别的部分归入消息正文，仅空消息返回错误
+// now用于补全RFC3164时间戳中缺少的年份，以及时间戳缺失时的缺省值
+func Parse(raw []byte, now time.Time) (*Message, error) {
+	raw = bytes.TrimRight(raw, "\r\n\x00")
+	if len(raw) == 0 {
+		return nil, ErrEmptyMessage
+	}
+	msg := &Message{Format: FORMAT_RFC3164, Timestamp: now}
+	pri, rest := parsePriority(raw)
+	msg.Facility, msg.Severity = pri/8, pri%8
+
+	if len(rest) > 2 && rest[0] == '1' && rest[1] == ' ' {
+		if parse5424(msg, string(rest[2:])) {
+			return msg, nil
+		}
+		msg.Timestamp = now
+	}
+	parse3164(msg, string(rest), now)
+	return msg, nil
+}
+
+func parsePriority(raw []byte) (int, []byte) {
+	if raw[0] != '<' {
+		return DEFAULT_PRIORITY, raw
+	}
+	end := bytes.IndexByte(raw, '>')
+	if end < 2 || end > 4 {
+		return DEFAULT_PRIORITY, raw
+	}
+	pri, err := strconv.Atoi(string(raw[1:end]))
+	if err != nil || pri > 191 {
+		return DEFAULT_PRIORITY, raw
+	}
+	return pri, raw[end+1:]
+}
+
+// VERSION之后: TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parse5424(msg *Message, s string) bool {
+	fields := make([]string, 5)
+	for i := range fields {
+		end := strings.IndexByte(s, ' ')
+		if end < 0 {
+			return false
+		}
+		fields[i], s = nilValue(s[:end]), s[end+1:]
+	}
+	if fields[0] != "" {
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return false
+		}
+		msg.Timestamp = t
+	}
+	msg.Format = FORMAT_RFC5424
+	msg.Hostname, msg.AppName, msg.ProcID, msg.MsgID = fields[1], fields[2], fields[3], fields[4]
+
+	sd, rest := splitStructuredData(s)
+	msg.StructuredData = nilValue(sd)
+	// 正文可能以UTF-8 BOM开头
+	msg.Message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff")
+	return true
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// 结构化数据为"-"或若干[...]，参数值中的"]"需转义
+func splitStructuredData(s string) (string, string) {
+	if !strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ' ')
+		if end < 0 {
+			return s, ""
+		}
+		return s[:end], s[end:]
+	}
+	inValue, escaped := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inValue = !inValue
+		case c == ']' && !inValue:
+			if i+1 == len(s) || s[i+1] != '[' {
+				return s[:i+1], s[i+1:]
+			}
+		}
+	}
+	return s, ""
+}
+
+// TIMESTAMP HOSTNAME TAG[PID]: MSG，时间戳以及主机名均可能缺失
+func parse3164(msg *Message, s string, now time.Time) {
+	if len(s) >= 16 && s[15] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, s[:15], now.Location()); err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			// 跨年时发送方的时间戳可能属于上一年
+			if t.After(now.AddDate(0, 0, 1)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			msg.Timestamp = t
+			s = s[16:]
+			if end := strings.IndexByte(s, ' '); end > 0 && !isTag(s[:end]) {
+				msg.Hostname, s = s[:end], s[end+1:]
+			}
+		}
+	}
+	msg.Message = s
+	// TAG最长32个字符，以"["或":"结束
+	end := strings.IndexAny(s, "[: ")
+	if end <= 0 || end > 32 || s[end] == ' ' {
+		return
+	}
+	tag, rest := s[:end], s[end:]
+	if rest[0] == '[' {
+		end := strings.IndexByte(rest, ']')
+		if end < 0 {
+			return
+		}
+		msg.ProcID, rest = rest[1:end], rest[end+1:]
+	}
+	if !strings.HasPrefix(rest, ":") {
+		msg.ProcID = ""
+		return
+	}
+	msg.AppName = tag
+	msg.Message = strings.TrimPrefix(rest[1:], " ")
+}
+
+// 主机名之后紧跟TAG，而TAG以":"结尾或带有"[PID]"，据此区分缺少主机名的消息
+func isTag(s string) bool {
+	return strings.HasSuffix(s, ":") || strings.Contains(s, "[")
+}
+
+// 读取一条TCP/TLS消息，支持RFC6587的两种分帧方式:
+// 以消息长度开头(octet-counting)，或以换行符分隔(non-transparent-framing)
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] >= '1' && b[0] <= '9' {
+		prefix, err := r.ReadString(' ')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(prefix, " "))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid syslog frame length %q", prefix)
+		}
+		size := n
+		if size > MAX_MESSAGE_SIZE {
+			size = MAX_MESSAGE_SIZE
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+		if n > len(frame) {
+			if _, err := r.Discard(n - len(frame)); err != nil {
+				return nil, err
+			}
+		}
+		return frame, nil
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	if len(line) > MAX_MESSAGE_SIZE {
+		line = line[:MAX_MESSAGE_SIZE]
+	}
+	return line, nil
+}
@@ -0,0 +1,133 @@
+package syslog
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		raw  string
+		want Message
+	}{
+		{
+			"rfc5424",
+			"<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed for lonvick on /dev/pts/8",
+			Message{Format: FORMAT_RFC5424, Facility: 4, Severity: 2, Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				Hostname: "mymachine.example.com", AppName: "su", MsgID: "ID47", Message: "'su root' failed for lonvick on /dev/pts/8"},
+		},
+		{
+			"rfc5424 with structured data and bom",
+			"<165>1 2003-10-11T22:14:15.003Z host app 1234 ID47 [exampleSDID@32473 iut=\"3\" eventSource=\"App\\]lication\"][meta x=\"1\"] \ufeffAn application event",
+			Message{Format: FORMAT_RFC5424, Facility: 20, Severity: 5, Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				Hostname: "host", AppName: "app", ProcID: "1234", MsgID: "ID47",
+				StructuredData: "[exampleSDID@32473 iut=\"3\" eventSource=\"App\\]lication\"][meta x=\"1\"]", Message: "An application event"},
+		},
+		{
+			"rfc5424 nil values without message",
+			"<13>1 - - - - - -",
+			Message{Format: FORMAT_RFC5424, Facility: 1, Severity: 5, Timestamp: now},
+		},
+		{
+			"rfc3164",
+			"<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			Message{Format: FORMAT_RFC3164, Facility: 4, Severity: 2, Timestamp: time.Date(2019, 10, 11, 22, 14, 15, 0, time.UTC).AddDate(-1, 0, 0),
+				Hostname: "mymachine", AppName: "su", Message: "'su root' failed for lonvick on /dev/pts/8"},
+		},
+		{
+			"rfc3164 with pid without hostname",
+			"<13>Jan  2 03:00:00 sshd[42]: Accepted publickey",
+			Message{Format: FORMAT_RFC3164, Facility: 1, Severity: 5, Timestamp: time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC),
+				AppName: "sshd", ProcID: "42", Message: "Accepted publickey"},
+		},
+		{
+			"rfc3164 without timestamp",
+			"<13>kernel: link up",
+			Message{Format: FORMAT_RFC3164, Facility: 1, Severity: 5, Timestamp: now, AppName: "kernel", Message: "link up"},
+		},
+		{
+			"without priority",
+			"plain message\r\n",
+			Message{Format: FORMAT_RFC3164, Facility: 1, Severity: 5, Timestamp: now, Message: "plain message"},
+		},
+		{
+			"invalid priority",
+			"<999>plain message",
+			Message{Format: FORMAT_RFC3164, Facility: 1, Severity: 5, Timestamp: now, Message: "<999>plain message"},
+		},
+		{
+			"invalid rfc5424 timestamp falls back to rfc3164",
+			"<13>1 yesterday host app - - - message",
+			Message{Format: FORMAT_RFC3164, Facility: 1, Severity: 5, Timestamp: now, Message: "1 yesterday host app - - - message"},
+		},
+	}
+	for _, tt := range tests {
+		msg, err := Parse([]byte(tt.raw), now)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !msg.Timestamp.Equal(tt.want.Timestamp) {
+			t.Errorf("%s: timestamp got %s, want %s", tt.name, msg.Timestamp, tt.want.Timestamp)
+		}
+		msg.Timestamp = tt.want.Timestamp
+		if *msg != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *msg, tt.want)
+		}
+	}
+
+	for _, raw := range []string{"", "\r\n", "\x00"} {
+		if _, err := Parse([]byte(raw), now); err != ErrEmptyMessage {
+			t.Errorf("%q: got error %v, want %v", raw, err, ErrEmptyMessage)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	long := strings.Repeat("x", MAX_MESSAGE_SIZE+10)
+	tests := []struct {
+		name    string
+		stream  string
+		want    []string
+		wantErr bool // 读取完所有帧后是否报错(EOF除外)
+	}{
+		{"octet counting", "5 hello11 hello world", []string{"hello", "hello world"}, false},
+		{"octet counting with newline in message", "11 hello\nworld", []string{"hello\nworld"}, false},
+		{"lf framing", "<13>hello\n<13>world\n", []string{"<13>hello\n", "<13>world\n"}, false},
+		{"lf framing without trailing newline", "<13>hello\n<13>world", []string{"<13>hello\n", "<13>world"}, false},
+		{"mixed framing", "5 hello<13>world\n", []string{"hello", "<13>world\n"}, false},
+		{"oversized lf frame is truncated", long + "\n", []string{long[:MAX_MESSAGE_SIZE]}, false},
+		{"oversized octet counting frame is truncated", "65546 " + long + "next\n", []string{long[:MAX_MESSAGE_SIZE], "next\n"}, false},
+		{"truncated octet counting frame", "10 hello", nil, true},
+		{"invalid length", "5x hello\n", nil, true},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.stream))
+		var frames []string
+		var err error
+		for {
+			var frame []byte
+			if frame, err = ReadFrame(r); err != nil {
+				break
+			}
+			frames = append(frames, string(frame))
+		}
+		if (err != io.EOF) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+		if len(frames) != len(tt.want) {
+			t.Errorf("%s: got %d frames, want %d", tt.name, len(frames), len(tt.want))
+			continue
+		}
+		for i := range frames {
+			if frames[i] != tt.want[i] {
+				t.Errorf("%s: frame %d got %.40q, want %.40q", tt.name, i, frames[i], tt.want[i])
+			}
+		}
+	}
+}
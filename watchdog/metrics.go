@@ -0,0 +1,60 @@
+package watchdog
+
+import (
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueLengthDesc = prometheus.NewDesc(
+		metrics.NAMESPACE+"_queue_length",
+		"Number of events buffered in a pipeline channel.",
+		[]string{"queue", "biz"}, nil)
+	queueCapacityDesc = prometheus.NewDesc(
+		metrics.NAMESPACE+"_queue_capacity",
+		"Capacity of a pipeline channel.",
+		[]string{"queue", "biz"}, nil)
+	inflightDesc = prometheus.NewDesc(
+		metrics.NAMESPACE+"_events_inflight",
+		"Number of events not yet completely processed.",
+		nil, nil)
+	badgerSizeDesc = prometheus.NewDesc(
+		metrics.NAMESPACE+"_badger_size_bytes",
+		"Size of the badger state database.",
+		[]string{"type"}, nil)
+)
+
+// 采集时读取流水线各通道的占用情况以及状态库大小
+type pipelineCollector struct {
+	watchDog *Watchdog
+}
+
+func (this *pipelineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLengthDesc
+	ch <- queueCapacityDesc
+	ch <- inflightDesc
+	ch <- badgerSizeDesc
+}
+
+func (this *pipelineCollector) Collect(ch chan<- prometheus.Metric) {
+	wd := this.watchDog
+
+	wd.mu.RLock()
+	for biz, srcChan := range wd.srcQueues {
+		ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(len(srcChan)), "source", biz)
+		ch <- prometheus.MustNewConstMetric(queueCapacityDesc, prometheus.GaugeValue, float64(cap(srcChan)), "source", biz)
+	}
+	wd.mu.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(len(wd.cacheQueue)), "cache", "")
+	ch <- prometheus.MustNewConstMetric(queueCapacityDesc, prometheus.GaugeValue, float64(cap(wd.cacheQueue)), "cache", "")
+	ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(len(wd.taskQueue)), "task", "")
+	ch <- prometheus.MustNewConstMetric(queueCapacityDesc, prometheus.GaugeValue, float64(cap(wd.taskQueue)), "task", "")
+	ch <- prometheus.MustNewConstMetric(inflightDesc, prometheus.GaugeValue, float64(wd.inflight()))
+
+	if wd.db != nil {
+		lsm, vlog := wd.db.Size()
+		ch <- prometheus.MustNewConstMetric(badgerSizeDesc, prometheus.GaugeValue, float64(lsm), "lsm")
+		ch <- prometheus.MustNewConstMetric(badgerSizeDesc, prometheus.GaugeValue, float64(vlog), "vlog")
+	}
+}
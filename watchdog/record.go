@@ -0,0 +1,70 @@
+package watchdog
+
+import (
+	"bytes"
+	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/dgraph-io/badger"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// 非文件来源(如syslog)的一批记录，同样经过CheckFile/Transform钩子后交由各适配器处理
+// 事件名形如syslog://<host>/<app>.log#<序号>，主机即子目录，路径即文件名
+func (this *Watchdog) recordProcessor(fevent *fsnotify.Event) {
+	u, err := url.Parse(fevent.Name)
+	if err != nil {
+		this.Logger.Errorf("Discard the records of %s: %s", fevent.Name, err)
+		return
+	}
+	filename := path.Base(u.Path)
+	content := append(bytes.Join(fevent.Records, []byte("\n")), '\n')
+	file := &handler.FileMeta{
+		Filepath:    fevent.Name,
+		SubDir:      u.Host,
+		Filename:    filename,
+		Ext:         strings.ToLower(path.Ext(filename)),
+		Size:        int64(len(content)),
+		CreateTime:  fevent.ModTime,
+		ModifyTime:  fevent.ModTime,
+		Content:     content,
+		Records:     fevent.Records,
+		LastOp:      fevent,
+		Host:        u.Host,
+		FolderTime:  fevent.ModTime,
+		Incremental: true,
+		Virtual:     true,
+	}
+
+	if err := this.hook.Listen("CheckFile", this, file); err != nil {
+		this.Logger.Warnf("CheckFile hook throw exception: %s", err)
+		return
+	}
+	this.hook.Listen("Transform", this, file)
+
+	adapters, release, ok := this.acquireAdapters(fevent.Biz)
+	if !ok {
+		this.Logger.Warnf("%s is unmounted, discard %s", fevent.Biz, fevent.Name)
+		return
+	}
+	defer release()
+	if err := this.deliver(file, adapters); err != nil {
+		this.Logger.Errorf("Need to rollback records: %s", fevent.Name)
+		this.stats.failure(fevent.Biz, err)
+		this.rollback(file, err)
+		return
+	}
+
+	// 每批记录仅投递一次，成功后无需保留投递记录
+	err = this.db.Update(func(txn *badger.Txn) error {
+		if err := deletePrefix(txn, LEDGER_PREFIX+fevent.Name+"|"); err != nil {
+			return err
+		}
+		return this.dlq.Ack(txn, fevent.Name)
+	})
+	if err != nil {
+		this.Logger.Errorf("Fail to update badger: %s", err)
+	}
+	this.stats.success(fevent.Biz)
+}
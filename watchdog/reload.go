@@ -0,0 +1,246 @@
+package watchdog
+
+import (
+	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/cobolbaby/log-agent/watchdog/lib/hook"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// 插件配置指纹，用于热加载时判断配置是否变更
+type fingerprinter interface {
+	Fingerprint() string
+}
+
+func fingerprint(plugin hook.AdvancePlugin) string {
+	if fp, ok := plugin.(fingerprinter); ok {
+		return fp.Fingerprint()
+	}
+	return ""
+}
+
+// 热加载插件: 停止已移除或配置变更的业务，启动新增或变更后的业务，配置未变的业务不受影响
+// 变更的业务中配置未变的适配器沿用原有实例
+// 变更后的配置校验失败时，继续沿用原有配置
+func (this *Watchdog) Reload(plugins []hook.AdvancePlugin) error {
+	this.reloadMu.Lock()
+	defer this.reloadMu.Unlock()
+
+	select {
+	case <-this.stopping:
+		return fmt.Errorf("WatchDog is shutting down")
+	default:
+	}
+
+	current := make(map[string]hook.AdvancePlugin)
+	for _, plugin := range this.hook.GetPlugins() {
+		current[plugin.Name()] = plugin
+	}
+	latest := make(map[string]hook.AdvancePlugin)
+	for _, plugin := range plugins {
+		latest[plugin.Name()] = plugin
+	}
+
+	var active []hook.AdvancePlugin
+	var failures []string
+	for biz := range current {
+		if _, ok := latest[biz]; ok {
+			continue
+		}
+		this.Logger.Warnf("Reload: remove %s", biz)
+		this.unmount(biz)
+	}
+	for biz, plugin := range latest {
+		old, exists := current[biz]
+		if exists && fingerprint(old) == fingerprint(plugin) {
+			active = append(active, old)
+			continue
+		}
+		stage, err := this.prepare(plugin)
+		if err != nil {
+			this.Logger.Errorf("Reload: fail to prepare %s, %s", biz, err)
+			failures = append(failures, biz)
+			if exists {
+				active = append(active, old)
+			}
+			continue
+		}
+		if exists {
+			this.Logger.Warnf("Reload: restart %s", biz)
+		} else {
+			this.Logger.Warnf("Reload: add %s", biz)
+		}
+		this.mount(biz, stage)
+		active = append(active, plugin)
+	}
+
+	this.mu.Lock()
+	this.hook.Import(active...)
+	this.mu.Unlock()
+
+	if len(failures) > 0 {
+		return fmt.Errorf("fail to reload %v", failures)
+	}
+	return nil
+}
+
+// 在独立的实例中初始化插件，避免初始化失败时影响正在运行的业务
+func (this *Watchdog) prepare(plugin hook.AdvancePlugin) (*Watchdog, error) {
+	stage := NewWatchdog()
+	stage.host = this.host
+	stage.Logger = this.Logger
+	stage.db = this.db
+	stage.dataPath = this.dataPath
+	stage.hook.Import(plugin)
+	stage.SetDefaultHandler(handler.Console)
+
+	biz := plugin.Name()
+	this.mu.RLock()
+	current := this.adapters[biz]
+	this.mu.RUnlock()
+	stage.reusable = map[string][]handler.WatchdogHandler{
+		biz: append([]handler.WatchdogHandler(nil), current...),
+	}
+
+	if err := stage.check(plugin); err != nil {
+		// 初始化过程中新建的适配器不再使用，沿用的适配器仍由原有业务使用
+		stage.closeAdapters(biz, retired(stage.adapters[biz], current), nil)
+		return nil, err
+	}
+	return stage, nil
+}
+
+// 热加载时沿用配置相同的原有适配器，避免重建连接以及丢弃尚未发送的消息，返回false时需新建适配器
+func (this *Watchdog) ReuseHandler(biz string, cfg interface{}) bool {
+	for i, adapter := range this.reusable[biz] {
+		c, ok := adapter.(handler.Configurable)
+		if !ok || !reflect.DeepEqual(c.GetConfig(), cfg) {
+			continue
+		}
+		this.reusable[biz] = append(this.reusable[biz][:i:i], this.reusable[biz][i+1:]...)
+		this.AddHandler(biz, adapter)
+		this.Logger.Infof("Reload: reuse the %s adapter of %s", adapter.GetName(), biz)
+		return true
+	}
+	return false
+}
+
+// 原有适配器中不再使用的部分
+func retired(adapters []handler.WatchdogHandler, active []handler.WatchdogHandler) []handler.WatchdogHandler {
+	var unused []handler.WatchdogHandler
+	for _, adapter := range adapters {
+		reused := false
+		for _, a := range active {
+			if a == adapter {
+				reused = true
+				break
+			}
+		}
+		if !reused {
+			unused = append(unused, adapter)
+		}
+	}
+	return unused
+}
+
+func (this *Watchdog) check(plugin hook.AdvancePlugin) error {
+	for _, h := range []string{"AutoCheck", "AutoInit", "Mount"} {
+		if err := this.hook.Call(plugin, h, this); err != nil {
+			return fmt.Errorf("%s hook throw exception: %s", h, err)
+		}
+	}
+	rule, ok := this.rules[plugin.Name()]
+	if !ok {
+		return fmt.Errorf("no rule was set")
+	}
+	if rule.MonitPath == "" && len(this.sources[plugin.Name()]) == 0 {
+		return fmt.Errorf("neither watch nor source was set")
+	}
+	if rule.MonitPath != "" {
+		if _, err := os.Stat(rule.MonitPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 停止业务监听并移除其配置，尚未处理的事件将被丢弃，待重试的事件转入poisoned区
+func (this *Watchdog) unmount(biz string) {
+	this.mu.Lock()
+	rule, ok := this.rules[biz]
+	adapters, using := this.adapters[biz], this.using[biz]
+	delete(this.rules, biz)
+	delete(this.watchers, biz)
+	delete(this.adapters, biz)
+	delete(this.using, biz)
+	delete(this.sources, biz)
+	delete(this.splitters, biz)
+	this.mu.Unlock()
+	if ok {
+		this.stopRule(rule)
+	}
+	go this.closeAdapters(biz, adapters, using)
+	if this.dlq == nil {
+		return
+	}
+	parked, err := this.dlq.Park(biz, fmt.Sprintf("%s is removed by reload", biz))
+	if err != nil {
+		this.Logger.Errorf("Reload: fail to park the dead letters of %s, %s", biz, err)
+	} else if parked > 0 {
+		this.Logger.Warnf("Reload: park %d dead letters of %s", parked, biz)
+	}
+}
+
+// 替换业务配置并重启监听，替换过程中已捕获的事件直接交由新的适配器处理，沿用的适配器不会被关闭
+func (this *Watchdog) mount(biz string, stage *Watchdog) {
+	rule := stage.rules[biz]
+	this.mu.Lock()
+	old, exists := this.rules[biz]
+	adapters, using := this.adapters[biz], this.using[biz]
+	this.rules[biz] = rule
+	this.watchers[biz] = stage.watchers[biz]
+	this.adapters[biz] = stage.adapters[biz]
+	this.using[biz] = new(sync.WaitGroup)
+	this.sources[biz] = stage.sources[biz]
+	this.mu.Unlock()
+	if exists {
+		this.stopRule(old)
+		go this.closeAdapters(biz, retired(adapters, stage.adapters[biz]), using)
+	}
+	this.startRule(rule)
+}
+
+// 获取业务的适配器，处理完成后需调用release
+func (this *Watchdog) acquireAdapters(biz string) ([]handler.WatchdogHandler, func(), bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	adapters, ok := this.adapters[biz]
+	if !ok {
+		return nil, nil, false
+	}
+	using := this.using[biz]
+	if using == nil {
+		return adapters, func() {}, true
+	}
+	using.Add(1)
+	return adapters, using.Done, true
+}
+
+// 等待使用中的任务结束后释放适配器持有的连接，共享的连接由最后一个使用方关闭
+func (this *Watchdog) closeAdapters(biz string, adapters []handler.WatchdogHandler, using *sync.WaitGroup) {
+	if using != nil {
+		using.Wait()
+	}
+	for _, adapter := range adapters {
+		closer, ok := adapter.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			this.Logger.Warnf("Fail to close the %s adapter of %s, %s", adapter.GetName(), biz, err)
+		}
+	}
+}
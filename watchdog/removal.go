@@ -0,0 +1,256 @@
+package watchdog
+
+import (
+	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/cobolbaby/log-agent/watchdog/lib/inode"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"github.com/dgraph-io/badger"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MOVE_WINDOW = 5 * time.Second // 删除事件在防抖时间之外的等待时间，期间出现相同inode的文件视为移动
+)
+
+// 等待确认的删除，超时未匹配到移动则按业务的删除策略处理
+type removal struct {
+	path  string
+	biz   string
+	root  string
+	timer *time.Timer
+}
+
+// 捕获删除或重命名事件时，登记该路径(目录则为其下所有文件)已投递过的文件
+// 需在防抖之前登记，以保证早于移动后新文件的事件
+func (this *Watchdog) trackRemoval(rule *fsnotify.Rule, e *fsnotify.Event) {
+	if _, err := os.Lstat(e.Name); err == nil {
+		return
+	}
+	records, err := this.detector.LoadTree(e.Name)
+	if err != nil {
+		this.Logger.Errorf("Fail to load the state of %s: %s", e.Name, err)
+		return
+	}
+	this.removalsMu.Lock()
+	defer this.removalsMu.Unlock()
+	for path, record := range records {
+		// 旧版本的记录未保存inode，无法识别移动
+		key := record.Inode
+		if key == "" {
+			key = "@" + path
+		}
+		if prev, ok := this.removals[key]; ok {
+			prev.timer.Stop()
+		}
+		r := &removal{
+			path: path,
+			biz:  rule.Biz,
+			root: rule.RootPath,
+		}
+		r.timer = time.AfterFunc(rule.DebounceTime+MOVE_WINDOW, func() {
+			this.confirmRemoval(key, r)
+		})
+		this.removals[key] = r
+		this.Logger.Debugf("Track the %s of %s", e.Op, path)
+	}
+}
+
+// 等待期间未被认定为移动，则提交删除事件
+func (this *Watchdog) confirmRemoval(key string, r *removal) {
+	this.removalsMu.Lock()
+	if this.removals[key] != r {
+		this.removalsMu.Unlock()
+		return
+	}
+	delete(this.removals, key)
+	this.removalsMu.Unlock()
+
+	select {
+	case this.cacheQueue <- &fsnotify.Event{Name: r.path, Op: "DELETE", Biz: r.biz, RootPath: r.root}:
+	case <-this.stopping:
+	}
+}
+
+// 新文件的inode与待确认删除的文件一致，则认定为监控目录内的移动，迁移其状态而不重复上传
+// 下游按路径区分文件，删除策略不为ignore时仍按删除旧文件、上传新文件处理，以免下游残留旧路径
+func (this *Watchdog) matchMove(file *handler.FileMeta) bool {
+	this.removalsMu.Lock()
+	pending := len(this.removals)
+	this.removalsMu.Unlock()
+	if pending == 0 {
+		return false
+	}
+	id, err := inode.Get(file.Filepath)
+	if err != nil {
+		return false
+	}
+
+	policy := this.deletePolicy(file.LastOp.Biz)
+	this.removalsMu.Lock()
+	r, ok := this.removals[id]
+	if ok && r.path != file.Filepath && r.biz == file.LastOp.Biz {
+		// 旧文件的删除待等待期满后照常提交
+		if policy == fsnotify.DELETE_IGNORE {
+			r.timer.Stop()
+			delete(this.removals, id)
+		}
+	} else {
+		ok = false
+	}
+	this.removalsMu.Unlock()
+	if !ok {
+		return false
+	}
+	if policy != fsnotify.DELETE_IGNORE {
+		this.Logger.Infof("Detect %s moved to %s, remove and upload again as the delete policy is %s", r.path, file.Filepath, policy)
+		return false
+	}
+
+	if err := this.moveState(r.path, file.Filepath); err != nil {
+		this.Logger.Errorf("Fail to move the state of %s to %s: %s", r.path, file.Filepath, err)
+		return false
+	}
+	this.Logger.Infof("Detect %s moved to %s", r.path, file.Filepath)
+	metrics.FilesMoved.WithLabelValues(file.LastOp.Biz).Inc()
+	return true
+}
+
+// 迁移文件状态、投递记录以及tail模式的读取位置
+func (this *Watchdog) moveState(from string, to string) error {
+	return this.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(from))
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set([]byte(to), val); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte(from)); err != nil {
+			return err
+		}
+		for _, prefix := range []string{LEDGER_PREFIX, OFFSET_PREFIX} {
+			if err := movePrefix(txn, prefix+from+"|", prefix+to+"|"); err != nil {
+				return err
+			}
+		}
+		return this.dlq.Ack(txn, from)
+	})
+}
+
+// 依据业务的删除策略通知各适配器，成功后清理该文件的所有状态
+func (this *Watchdog) removeProcessor(fevent *fsnotify.Event) {
+	// 删除后又重新生成的文件按新文件处理
+	if _, err := os.Lstat(fevent.Name); err == nil {
+		return
+	}
+	record, err := this.detector.Load(fevent.Name)
+	if err != nil {
+		return
+	}
+
+	policy := this.deletePolicy(fevent.Biz)
+	if policy != fsnotify.DELETE_IGNORE {
+		adapters, release, ok := this.acquireAdapters(fevent.Biz)
+		if !ok {
+			this.Logger.Warnf("%s is unmounted, discard %s", fevent.Biz, fevent.Name)
+			return
+		}
+		defer release()
+		file := &handler.FileMeta{
+			Filepath:    fevent.Name,
+			SubDir:      subDir(fevent.Name, fevent.RootPath),
+			Filename:    filepath.Base(fevent.Name),
+			Ext:         strings.ToLower(filepath.Ext(fevent.Name)),
+			Size:        record.Size,
+			CreateTime:  record.CreateTime,
+			ModifyTime:  record.ModTime,
+			LastOp:      fevent,
+			Host:        this.host,
+			Incremental: this.tailMode(fevent.Biz),
+		}
+		for _, Adapter := range adapters {
+			Adapter.SetLogger(this.Logger)
+			if err := Adapter.Remove(*file, policy); err != nil {
+				this.Logger.Errorf("Adapter.Remove throw exception: %s", err)
+				this.stats.failure(fevent.Biz, err)
+				this.rollback(file, err)
+				return
+			}
+		}
+	}
+
+	err = this.db.Update(func(txn *badger.Txn) error {
+		if err := this.detector.Delete(txn, fevent.Name); err != nil {
+			return err
+		}
+		for _, prefix := range []string{LEDGER_PREFIX, OFFSET_PREFIX} {
+			if err := deletePrefix(txn, prefix+fevent.Name+"|"); err != nil {
+				return err
+			}
+		}
+		return this.dlq.Ack(txn, fevent.Name)
+	})
+	if err != nil {
+		this.Logger.Errorf("Fail to update badger: %s", err)
+		return
+	}
+	this.Logger.Infof("Remove %s, delete policy: %s", fevent.Name, policy)
+	metrics.FilesRemoved.WithLabelValues(fevent.Biz).Inc()
+}
+
+// 业务的删除策略，缺省仅清理本地状态
+func (this *Watchdog) deletePolicy(biz string) string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if rule, ok := this.rules[biz]; ok && rule.OnDelete != "" {
+		return rule.OnDelete
+	}
+	return fsnotify.DELETE_IGNORE
+}
+
+func movePrefix(txn *badger.Txn, from string, to string) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	var keys, vals [][]byte
+	for it.Seek([]byte(from)); it.ValidForPrefix([]byte(from)); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			it.Close()
+			return err
+		}
+		keys = append(keys, it.Item().KeyCopy(nil))
+		vals = append(vals, val)
+	}
+	it.Close()
+	for i, key := range keys {
+		if err := txn.Set(append([]byte(to), key[len(from):]...), vals[i]); err != nil {
+			return err
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deletePrefix(txn *badger.Txn, prefix string) error {
+	it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+	var keys [][]byte
+	for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
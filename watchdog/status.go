@@ -0,0 +1,262 @@
+package watchdog
+
+import (
+	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"github.com/cobolbaby/log-agent/watchdog/watcher"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 单一业务的运行统计
+type BizStats struct {
+	Processed     uint64
+	Failed        uint64
+	Overflowed    uint64 // 事件通道已满时溢出的事件数
+	LastSuccess   time.Time
+	LastError     string
+	LastErrorTime time.Time
+}
+
+type RuleStatus struct {
+	Watch           string
+	Patterns        string
+	Ignores         string
+	Includes        []string
+	Excludes        []string
+	MaxNestingLevel uint
+	Debounce        string
+	ChangePolicy    string
+	Mode            string
+	Strategy        []string
+	PollInterval    string
+	PollSchedules   []string
+	PollWindow      string
+	Watches         int      // 实时监听占用的inotify监听数
+	FallbackDirs    []string // 监听数耗尽后降级为轮询的子目录
+	LastScan        *watcher.ScanProgress
+	Incidents       []watcher.Incident // 最近的监听故障
+}
+
+type PluginStatus struct {
+	Biz      string
+	Rule     *RuleStatus
+	Adapters []string
+	Stats    BizStats
+}
+
+type QueueStatus struct {
+	Source   map[string]int
+	Cache    int
+	Task     int
+	InFlight int64
+}
+
+type Status struct {
+	Host        string
+	StartTime   time.Time
+	Uptime      string
+	Plugins     []*PluginStatus
+	Queues      QueueStatus
+	DeadLetters int
+	Poisoned    int
+}
+
+type statsRegistry struct {
+	sync.RWMutex
+	bizs map[string]*BizStats
+}
+
+func newStatsRegistry() *statsRegistry {
+	return &statsRegistry{
+		bizs: make(map[string]*BizStats),
+	}
+}
+
+func (this *statsRegistry) get(biz string) *BizStats {
+	stats, ok := this.bizs[biz]
+	if !ok {
+		stats = &BizStats{}
+		this.bizs[biz] = stats
+	}
+	return stats
+}
+
+func (this *statsRegistry) success(biz string) {
+	this.Lock()
+	defer this.Unlock()
+	stats := this.get(biz)
+	stats.Processed++
+	metrics.FilesProcessed.WithLabelValues(biz).Inc()
+	stats.LastSuccess = time.Now()
+}
+
+func (this *statsRegistry) failure(biz string, err error) {
+	this.Lock()
+	defer this.Unlock()
+	stats := this.get(biz)
+	stats.Failed++
+	metrics.FilesFailed.WithLabelValues(biz).Inc()
+	stats.LastError = err.Error()
+	stats.LastErrorTime = time.Now()
+}
+
+func (this *statsRegistry) overflow(biz string) {
+	this.Lock()
+	defer this.Unlock()
+	this.get(biz).Overflowed++
+}
+
+func (this *statsRegistry) snapshot(biz string) BizStats {
+	this.RLock()
+	defer this.RUnlock()
+	if stats, ok := this.bizs[biz]; ok {
+		return *stats
+	}
+	return BizStats{}
+}
+
+// 当前运行状态，供管理接口查询
+func (this *Watchdog) Status() *Status {
+	status := &Status{
+		Host:      this.host,
+		StartTime: this.startTime,
+		Uptime:    time.Since(this.startTime).Round(time.Second).String(),
+		Queues: QueueStatus{
+			Source:   make(map[string]int),
+			Cache:    len(this.cacheQueue),
+			Task:     len(this.taskQueue),
+			InFlight: this.inflight(),
+		},
+	}
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for biz, srcChan := range this.srcQueues {
+		status.Queues.Source[biz] = len(srcChan)
+	}
+
+	for _, plugin := range this.hook.GetPlugins() {
+		biz := plugin.Name()
+		ps := &PluginStatus{
+			Biz:   biz,
+			Stats: this.stats.snapshot(biz),
+		}
+		if rule, ok := this.rules[biz]; ok {
+			ps.Rule = &RuleStatus{
+				Watch:           rule.MonitPath,
+				Patterns:        rule.Patterns,
+				Ignores:         rule.Ignores,
+				Includes:        rule.Includes,
+				Excludes:        rule.Excludes,
+				MaxNestingLevel: rule.MaxNestingLevel,
+				Debounce:        rule.DebounceTime.String(),
+				ChangePolicy:    rule.ChangePolicy,
+				Mode:            rule.Mode,
+				Strategy:        this.watchers[biz],
+				PollInterval:    rule.PollInterval.String(),
+				PollSchedules:   rule.PollSchedules,
+				PollWindow:      rule.PollWindow,
+			}
+			usage := watcher.WatchUsage(biz)
+			ps.Rule.Watches = usage.Watches
+			ps.Rule.FallbackDirs = usage.Fallbacks
+			ps.Rule.Incidents = watcher.Incidents(biz)
+			if scan, ok := watcher.LastScan(biz); ok {
+				ps.Rule.LastScan = &scan
+			}
+		}
+		for _, adapter := range this.adapters[biz] {
+			ps.Adapters = append(ps.Adapters, adapter.GetName())
+		}
+		status.Plugins = append(status.Plugins, ps)
+	}
+	sort.Slice(status.Plugins, func(i, j int) bool { return status.Plugins[i].Biz < status.Plugins[j].Biz })
+
+	if this.dlq != nil {
+		if pending, poisoned, err := this.dlq.Counts(); err == nil {
+			status.DeadLetters = pending
+			status.Poisoned = poisoned
+		}
+	}
+	return status
+}
+
+// 超过重试上限、等待人工处理的事件
+type PoisonedLetter struct {
+	Path        string
+	Biz         string
+	Op          string
+	Attempts    uint
+	LastError   string
+	FirstFailed time.Time
+	LastFailed  time.Time
+}
+
+func (this *Watchdog) PoisonedLetters() ([]*PoisonedLetter, error) {
+	if this.dlq == nil {
+		return nil, nil
+	}
+	letters, err := this.dlq.Poisoned()
+	if err != nil {
+		return nil, err
+	}
+	poisoned := make([]*PoisonedLetter, 0, len(letters))
+	for _, l := range letters {
+		p := &PoisonedLetter{
+			Path:        l.File.Filepath,
+			Attempts:    l.Attempts,
+			LastError:   l.LastError,
+			FirstFailed: l.FirstFailed,
+			LastFailed:  l.LastFailed,
+		}
+		if l.File.LastOp != nil {
+			p.Biz = l.File.LastOp.Biz
+			p.Op = l.File.LastOp.Op
+		}
+		poisoned = append(poisoned, p)
+	}
+	return poisoned, nil
+}
+
+// 重新投递poisoned事件，所属业务需仍处于挂载状态
+func (this *Watchdog) RequeuePoisoned(path string) error {
+	if this.dlq == nil {
+		return ErrLetterNotFound
+	}
+	letter, err := this.dlq.Requeue(path, func(l *DeadLetter) error {
+		if l.File.LastOp == nil {
+			return fmt.Errorf("%s has no event to retry", path)
+		}
+		this.mu.RLock()
+		_, ok := this.adapters[l.File.LastOp.Biz]
+		this.mu.RUnlock()
+		if !ok {
+			return fmt.Errorf("%s is unmounted", l.File.LastOp.Biz)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	this.Logger.Warnf("Requeue poisoned %s event for %s", letter.File.LastOp.Op, path)
+	return nil
+}
+
+// 放弃poisoned事件
+func (this *Watchdog) DiscardPoisoned(path string) error {
+	if this.dlq == nil {
+		return ErrLetterNotFound
+	}
+	letter, err := this.dlq.Discard(path)
+	if err != nil {
+		return err
+	}
+	this.Logger.Warnf("Discard poisoned event for %s", path)
+	// 上传的文件不会再被处理，一并清理暂存目录
+	if e := letter.File.LastOp; e != nil && e.Op == "UPLOAD" {
+		this.removeUpload(e)
+	}
+	return nil
+}
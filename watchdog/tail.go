@@ -0,0 +1,129 @@
+package watchdog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/cobolbaby/log-agent/watchdog/lib/inode"
+	"github.com/dgraph-io/badger"
+	"io"
+	"os"
+)
+
+const (
+	OFFSET_PREFIX  = "_offset:"      // tail模式下文件的读取位置
+	TAIL_MAX_BYTES = 4 * 1024 * 1024 // 单次读取的最大字节数，避免大文件占用过多内存
+)
+
+// 记录tail模式下各文件已投递的位置，以路径+设备号+inode为Key，文件轮转后从头读取
+type TailOffsets struct {
+	db *badger.DB
+}
+
+func NewTailOffsets(db *badger.DB) *TailOffsets {
+	return &TailOffsets{
+		db: db,
+	}
+}
+
+func (this *TailOffsets) prefix(path string) []byte {
+	return []byte(OFFSET_PREFIX + path + "|")
+}
+
+func (this *TailOffsets) key(path string, id string) []byte {
+	return append(this.prefix(path), id...)
+}
+
+func (this *TailOffsets) Load(path string, id string) int64 {
+	var offset int64
+	this.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(this.key(path, id))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			offset = int64(binary.BigEndian.Uint64(val))
+			return nil
+		})
+	})
+	return offset
+}
+
+// 保存读取位置，同时清理该路径下已被轮转的文件记录
+func (this *TailOffsets) Commit(path string, id string, offset int64) error {
+	return this.db.Update(func(txn *badger.Txn) error {
+		key := this.key(path, id)
+		prefix := this.prefix(path)
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		var stale [][]byte
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if k := it.Item().KeyCopy(nil); !bytes.Equal(k, key) {
+				stale = append(stale, k)
+			}
+		}
+		it.Close()
+		for _, k := range stale {
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+		val := make([]byte, 8)
+		binary.BigEndian.PutUint64(val, uint64(offset))
+		return txn.Set(key, val)
+	})
+}
+
+// 读取上次投递位置之后的完整行，末尾未写完的行留待下次读取，flush为true时一并读取
+// 无新增内容时返回nil，next为下次读取的位置
+func (this *TailOffsets) Read(file *handler.FileMeta, flush bool) (chunk *handler.FileMeta, id string, next int64, err error) {
+	if id, err = inode.Get(file.Filepath); err != nil {
+		return nil, "", 0, err
+	}
+	offset := this.Load(file.Filepath, id)
+
+	f, err := os.Open(file.Filepath)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	// 文件被截断，从头读取
+	if fi.Size() < offset {
+		offset = 0
+	}
+	size := fi.Size() - offset
+	if size == 0 {
+		return nil, id, offset, nil
+	}
+	if size > TAIL_MAX_BYTES {
+		size = TAIL_MAX_BYTES
+	}
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, "", 0, err
+	}
+	buf = buf[:n]
+	if !flush {
+		end := bytes.LastIndexByte(buf, '\n')
+		if end < 0 {
+			// 单行超过读取上限时整块提交，避免一直无法推进
+			if len(buf) < TAIL_MAX_BYTES {
+				return nil, id, offset, nil
+			}
+			end = len(buf) - 1
+		}
+		buf = buf[:end+1]
+	}
+
+	chunk = new(handler.FileMeta)
+	*chunk = *file
+	chunk.Incremental = true
+	chunk.Offset = offset
+	chunk.Content = buf
+	chunk.Size = int64(len(buf))
+	return chunk, id, offset + int64(len(buf)), nil
+}
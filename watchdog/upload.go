@@ -0,0 +1,42 @@
+package watchdog
+
+import (
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/cobolbaby/log-agent/watchdog/watcher"
+	"github.com/dgraph-io/badger"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 上传的文件投递成功后移除暂存文件以及投递记录
+func (this *Watchdog) uploaded(fevent *fsnotify.Event) {
+	this.removeUpload(fevent)
+	this.stats.success(fevent.Biz)
+}
+
+// 无法投递的上传文件(校验未通过、业务已移除等)不会再被处理，直接清理以免暂存目录堆积
+func (this *Watchdog) discardUpload(fevent *fsnotify.Event, reason string) {
+	this.Logger.Warnf("Discard the uploaded file %s, %s", fevent.Name, reason)
+	this.removeUpload(fevent)
+}
+
+func (this *Watchdog) removeUpload(fevent *fsnotify.Event) {
+	err := this.db.Update(func(txn *badger.Txn) error {
+		if err := deletePrefix(txn, LEDGER_PREFIX+fevent.Name+"|"); err != nil {
+			return err
+		}
+		return this.dlq.Ack(txn, fevent.Name)
+	})
+	if err != nil {
+		this.Logger.Errorf("Fail to update badger: %s", err)
+	}
+	// 每次上传的暂存目录独立，整体移除即可
+	dir := fevent.Name
+	if strings.HasPrefix(filepath.Base(fevent.RootPath), watcher.INGEST_NONCE) {
+		dir = fevent.RootPath
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		this.Logger.Warnf("Fail to remove the uploaded file %s: %s", fevent.Name, err)
+	}
+}
@@ -1,47 +1,108 @@
 package watchdog
 
 import (
+	"errors"
 	"github.com/cobolbaby/log-agent/watchdog/handler"
+	"github.com/cobolbaby/log-agent/watchdog/lib/completeness"
 	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
 	"github.com/cobolbaby/log-agent/watchdog/lib/hook"
+	"github.com/cobolbaby/log-agent/watchdog/lib/inode"
 	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"github.com/cobolbaby/log-agent/watchdog/lib/multiline"
+	"github.com/cobolbaby/log-agent/watchdog/lib/state"
 	"github.com/cobolbaby/log-agent/watchdog/watcher"
 	"github.com/Jeffail/tunny"
 	"github.com/dgraph-io/badger"
 	"github.com/dgraph-io/badger/options"
 	"github.com/djherbis/times"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	SOURCE_QUEUE_CAP         = 100 // 新消息上报通道容量
-	CACHE_QUEUE_CAP          = 100 // 缓存处理通道容量
-	TASK_QUEUE_CAP           = 2   // 待处理任务通道容量
-	TASK_CONCURRENCY_CONTROL = 100 // 任务并发控制
+	SOURCE_QUEUE_CAP         = 100                    // 新消息上报通道容量
+	CACHE_QUEUE_CAP          = 100                    // 缓存处理通道容量
+	TASK_QUEUE_CAP           = 2                      // 待处理任务通道容量
+	TASK_CONCURRENCY_CONTROL = 100                    // 任务并发控制
+	TASK_BATCH_WINDOW        = 200 * time.Millisecond // 批处理时间窗口
+	TASK_EXIT_GRACE          = 3 * time.Second        // 排空超时后等待执行中任务结束的最短时间
 )
 
 type Watchdog struct {
+	pending  int64 // 防抖、批处理缓存以及执行中的事件数，需保证64位对齐
 	host     string
+	version  string
+	dataPath string
 	Logger   log.Logger
 	watchers map[string][]string
 	rules    map[string]*fsnotify.Rule
 	adapters map[string][]handler.WatchdogHandler // 优先级队列
+	using    map[string]*sync.WaitGroup           // 正在使用各业务适配器的任务，热加载替换后待其结束再释放连接
+	reusable map[string][]handler.WatchdogHandler // 热加载时可沿用的原有适配器
+	sources  map[string][]watcher.Watcher         // 插件自定义的事件来源，如syslog
 	hook     *hook.AdvanceHook
 	db       *badger.DB
+	retry    RetryPolicy
+	dlq      *DeadLetterQueue
+	ledger   *DeliveryLedger
+	detector *state.ChangeDetector
+	spill    *SpillQueue
+	offsets  *TailOffsets
+	// 多行记录切分
+	splitters     map[string]*multiline.Splitter
+	requeueTimers sync.Map // 延迟重新处理的事件，如多行记录的提交、未写完的文件
+	// 待确认的删除，以inode为Key识别移动
+	removals   map[string]*removal
+	removalsMu sync.Mutex
+	stats      *statsRegistry
+	mu         sync.RWMutex // 热加载时保护rules/adapters/watchers/srcQueues
+	reloadMu   sync.Mutex
+	// 启动时间
+	startTime time.Time
+	// 心跳
+	heartbeatSink     HeartbeatSink
+	heartbeatInterval time.Duration
+	// 事件处理流水线
+	pipeline      PipelineOptions
+	overflowScans sync.Map // 已安排补扫的业务
+	srcQueues     map[string]chan *fsnotify.Event
+	cacheQueue    chan *fsnotify.Event
+	taskQueue     chan []*fsnotify.Event
+	stopping      chan struct{}  // 开始停机
+	quit          chan struct{}  // 退出流水线
+	wg            sync.WaitGroup // 流水线协程
 }
 
 func NewWatchdog() *Watchdog {
 	return &Watchdog{
-		watchers: make(map[string][]string),
-		rules:    make(map[string]*fsnotify.Rule),
-		adapters: make(map[string][]handler.WatchdogHandler),
-		hook:     hook.NewAdvanceHook(),
+		watchers:  make(map[string][]string),
+		rules:     make(map[string]*fsnotify.Rule),
+		adapters:  make(map[string][]handler.WatchdogHandler),
+		using:     make(map[string]*sync.WaitGroup),
+		sources:   make(map[string][]watcher.Watcher),
+		hook:      hook.NewAdvanceHook(),
+		stats:     newStatsRegistry(),
+		srcQueues: make(map[string]chan *fsnotify.Event),
+		splitters: make(map[string]*multiline.Splitter),
+		removals:  make(map[string]*removal),
+		stopping:  make(chan struct{}),
+		quit:      make(chan struct{}),
+		pipeline:  DefaultPipelineOptions(),
+		// 未设置发送目标时不推送心跳
+		heartbeatInterval: HEARTBEAT_INTERVAL,
+		retry: RetryPolicy{
+			MaxAttempts: RETRY_MAX_ATTEMPTS,
+			Backoff:     RETRY_BACKOFF,
+			MaxBackoff:  RETRY_MAX_BACKOFF,
+		},
 	}
 }
 
@@ -55,7 +116,13 @@ func (this *Watchdog) SetLogPath(path string) *Watchdog {
 	return this
 }
 
+func (this *Watchdog) SetLogger(logger log.Logger) *Watchdog {
+	this.Logger = logger
+	return this
+}
+
 func (this *Watchdog) SetDataPath(path string) *Watchdog {
+	this.dataPath = path
 
 	// fix: Value log truncate required to run DB. This might result in data loss
 	db, err := badger.Open(
@@ -67,9 +134,21 @@ func (this *Watchdog) SetDataPath(path string) *Watchdog {
 	if err != nil {
 		this.Logger.Fatalf("Fail to execute badger.Open: %s", err)
 	}
-	// defer db.Close()
-
 	this.db = db
+	this.ledger = NewDeliveryLedger(db)
+	this.detector = state.NewChangeDetector(db)
+	this.spill = NewSpillQueue(db)
+	this.offsets = NewTailOffsets(db)
+	return this
+}
+
+// 数据目录，插件可在其下存放暂存文件
+func (this *Watchdog) DataPath() string {
+	return this.dataPath
+}
+
+func (this *Watchdog) SetRetryPolicy(policy RetryPolicy) *Watchdog {
+	this.retry = policy
 	return this
 }
 
@@ -92,6 +171,9 @@ func (this *Watchdog) SetRules(biz string, rule *fsnotify.Rule) *Watchdog {
 
 func (this *Watchdog) AddHandler(biz string, adapter ...handler.WatchdogHandler) *Watchdog {
 	this.adapters[biz] = append(this.adapters[biz], adapter...)
+	if this.using[biz] == nil {
+		this.using[biz] = new(sync.WaitGroup)
+	}
 
 	// 按照Priority排序
 	tmp := this.adapters[biz]
@@ -101,6 +183,12 @@ func (this *Watchdog) AddHandler(biz string, adapter ...handler.WatchdogHandler)
 	return this
 }
 
+// 添加非文件系统的事件来源，产生的事件直接进入缓存通道
+func (this *Watchdog) AddSource(biz string, source ...watcher.Watcher) *Watchdog {
+	this.sources[biz] = append(this.sources[biz], source...)
+	return this
+}
+
 // TODO:用于移除默认的操作
 func (this *Watchdog) RemoveHandler(biz string, adapterName ...string) *Watchdog {
 	return this
@@ -130,6 +218,7 @@ func (this *Watchdog) LoadPlugins(plugins []hook.AdvancePlugin) *Watchdog {
 }
 
 func (this *Watchdog) Run() {
+	this.startTime = time.Now()
 	// 设置默认选项
 	// this.SetDefaultWatchStrategy(watcher.FS_NOTIFY, watcher.FS_POLL)
 	this.SetDefaultHandler(handler.Console)
@@ -146,23 +235,139 @@ func (this *Watchdog) Run() {
 		this.Logger.Fatalf("Mount hook throw exception: %s", err)
 	}
 	// 同时监控多种业务
-	cacheQueueChan := make(chan *fsnotify.Event, CACHE_QUEUE_CAP)
-	taskQueueChan := make(chan []*fsnotify.Event, TASK_QUEUE_CAP)
+	this.cacheQueue = make(chan *fsnotify.Event, this.pipeline.CacheQueueCap)
+	this.taskQueue = make(chan []*fsnotify.Event, this.pipeline.TaskQueueCap)
 	for _, aRule := range this.rules {
-		srcQueueChan := make(chan *fsnotify.Event, SOURCE_QUEUE_CAP)
+		this.startRule(aRule)
+	}
+	// 暴露流水线各通道的占用情况
+	if err := prometheus.Register(&pipelineCollector{watchDog: this}); err != nil {
+		this.Logger.Warnf("Fail to register pipeline metrics: %s", err)
+	}
+	// 采用协程池处理文件事件
+	this.wg.Add(3)
+	go this.transferBatch(this.pipeline.BatchWindow, this.cacheQueue, this.taskQueue)
+	go this.handle(this.taskQueue)
+	// 处理失败的事件按退避策略重新投递
+	this.dlq = NewDeadLetterQueue(this.db, this.retry)
+	go this.retryDeadLetters(this.cacheQueue)
+	// 推送心跳信息
+	if this.heartbeatSink != nil {
+		this.wg.Add(1)
+		go this.heartbeat()
+	}
+}
+
+// 启动单一业务的监听以及事件转发
+func (this *Watchdog) startRule(rule *fsnotify.Rule) {
+	capacity := rule.QueueCap
+	if capacity <= 0 {
+		capacity = this.pipeline.SourceQueueCap
+	}
+	srcQueueChan := make(chan *fsnotify.Event, capacity)
+	splitter, err := multiline.New(rule.MultilineStart, rule.MultilineContinue, rule.MultilineFlush)
+	if err != nil {
+		this.Logger.Errorf("Invalid multiline rule of %s, records will not be split: %s", rule.Biz, err)
+	}
+	this.mu.Lock()
+	this.srcQueues[rule.Biz] = srcQueueChan
+	this.splitters[rule.Biz] = splitter
+	this.mu.Unlock()
+	// 关闭rule.Done即停止该业务的所有监听
+	rule.Done = make(chan struct{})
+	rule.OnOverflow = this.overflowHandler(rule)
+
+	go this.listen(rule, srcQueueChan, this.cacheQueue)
+	// 回填此前溢出至磁盘的事件，背压策略调整后亦需处理完遗留的事件
+	this.wg.Add(1)
+	go this.unspill(rule, srcQueueChan)
+
+	// 针对不同的业务可配置不同的延迟处理时间
+	this.wg.Add(1)
+	if rule.DebounceTime > 0 {
+		go this.debounce(rule, srcQueueChan, this.cacheQueue)
+	} else {
+		go this.transfer(rule, srcQueueChan, this.cacheQueue)
+	}
+}
+
+// 停止单一业务的监听，已捕获的事件仍会继续处理
+func (this *Watchdog) stopRule(rule *fsnotify.Rule) {
+	if rule.Done != nil {
+		close(rule.Done)
+	}
+}
 
-		go this.listen(aRule, srcQueueChan, cacheQueueChan)
+// 停止监听，并在限定时间内处理完已捕获的事件，之后释放连接以及关闭状态库
+func (this *Watchdog) Stop(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	this.Logger.Infof("WatchDog is shutting down, drain timeout: %s", timeout)
 
-		// 针对不同的业务可配置不同的延迟处理时间
-		if aRule.DebounceTime > 0 {
-			go this.debounce(aRule, srcQueueChan, cacheQueueChan)
+	// 停止重试调度以及所有监听程序
+	close(this.stopping)
+	this.mu.RLock()
+	for _, aRule := range this.rules {
+		this.stopRule(aRule)
+	}
+	this.mu.RUnlock()
+
+	// 等待防抖、缓存以及任务队列中的事件处理完毕
+	// 事件在协程间流转时存在短暂的计数空档，故需连续两次确认
+	idleTimes := 0
+	for idleTimes < 2 {
+		if time.Now().After(deadline) {
+			this.Logger.Errorf("WatchDog drain timeout, %d events are still in flight", this.inflight())
+			break
+		}
+		if this.inflight() == 0 {
+			idleTimes++
 		} else {
-			go this.transfer(srcQueueChan, cacheQueueChan)
+			idleTimes = 0
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	// 采用协程池处理文件事件
-	go this.transferBatch(200*time.Millisecond, cacheQueueChan, taskQueueChan)
-	go this.handle(taskQueueChan)
+
+	// 退出处理流水线
+	close(this.quit)
+	exited := make(chan struct{})
+	go func() {
+		this.wg.Wait()
+		close(exited)
+	}()
+	// 排空超时后排队中的任务直接跳过，仍需等待执行中的任务结束
+	wait := time.Until(deadline)
+	if wait < TASK_EXIT_GRACE {
+		wait = TASK_EXIT_GRACE
+	}
+	select {
+	case <-exited:
+	case <-time.After(wait):
+		// 执行中的任务仍在读写数据库以及适配器，此时关闭将导致其异常退出
+		this.Logger.Errorf("WatchDog pipeline exit timeout, %d events are still in flight, skip releasing adapters and closing badger", this.inflight())
+		return errors.New("pipeline exit timeout")
+	}
+
+	// 刷新生产者缓存并关闭连接
+	if err := handler.Release(); err != nil {
+		this.Logger.Errorf("Fail to release adapters: %s", err)
+	}
+	if err := this.db.Close(); err != nil {
+		this.Logger.Errorf("Fail to close badger: %s", err)
+		return err
+	}
+	this.Logger.Info("WatchDog shutdown")
+	return nil
+}
+
+// 尚未处理完成的事件数
+func (this *Watchdog) inflight() int64 {
+	n := atomic.LoadInt64(&this.pending) + int64(len(this.cacheQueue)+len(this.taskQueue))
+	this.mu.RLock()
+	for _, srcChan := range this.srcQueues {
+		n += int64(len(srcChan))
+	}
+	this.mu.RUnlock()
+	return n
 }
 
 // InSlice checks given string in string slice or not.
@@ -176,6 +381,16 @@ func InSlice(v string, sl []string) bool {
 }
 
 func (this *Watchdog) listen(rule *fsnotify.Rule, srcChan chan *fsnotify.Event, cacheChan chan *fsnotify.Event) {
+	this.mu.RLock()
+	sources := this.sources[rule.Biz]
+	this.mu.RUnlock()
+	for _, source := range sources {
+		source.SetLogger(this.Logger).Listen(rule, cacheChan)
+	}
+	// 仅有自定义来源的业务无需监听目录
+	if rule.MonitPath == "" {
+		return
+	}
 	// 先验证一下路径是否存在
 	if _, err := os.Stat(rule.MonitPath); err != nil {
 		this.Logger.Fatalf("Something wrong with monitor path: %s", err)
@@ -191,24 +406,46 @@ func (this *Watchdog) listen(rule *fsnotify.Rule, srcChan chan *fsnotify.Event,
 }
 
 func (this *Watchdog) debounce(rule *fsnotify.Rule, srcChan chan *fsnotify.Event, destChan chan *fsnotify.Event) {
+	defer this.wg.Done()
+
 	var debounceMap sync.Map
+	// 停止监听后，防抖中的事件需立即提交，通道清空后退出
+	flush := make(chan struct{})
+	done := rule.Done
+	draining := false
+	idle := time.NewTicker(time.Second)
+	defer idle.Stop()
 	for {
 		select {
 		case e := <-srcChan:
+			// 删除事件无需防抖，但需先于防抖登记，确保早于移动后新文件的事件
+			if e.Op == "REMOVE" || e.Op == "RENAME" {
+				this.trackRemoval(rule, e)
+				continue
+			}
+			if draining {
+				atomic.AddInt64(&this.pending, 1)
+				this.forward(destChan, e)
+				atomic.AddInt64(&this.pending, -1)
+				continue
+			}
 			eventChan, ok := debounceMap.Load(e.Name)
 			if !ok {
 				this.Logger.Debugf("The debounce channel of %s is not hit", e.Name)
 				// If not, add it to the debounce map
 				eventChan := make(chan *fsnotify.Event, 5)
 				debounceMap.Store(e.Name, eventChan)
+				atomic.AddInt64(&this.pending, 1)
 				this.Logger.Debugf("Store %s to the debounce map", e.Name)
 
 				// Start the debounce handler
-				go this.debounceFsnotifyEvent(rule.DebounceTime, eventChan, func(event *fsnotify.Event) {
+				go this.debounceFsnotifyEvent(rule.DebounceTime, eventChan, flush, func(event *fsnotify.Event) {
 					this.Logger.Infof("Debounce %s event for %s: %s %s", rule.Biz, rule.DebounceTime, event.Op, event.Name)
 					debounceMap.Delete(event.Name)
 					this.Logger.Debugf("Delete %s in the debounce map", event.Name)
-					destChan <- event
+					metrics.EventsDebounced.WithLabelValues(rule.Biz).Inc()
+					this.forward(destChan, event)
+					atomic.AddInt64(&this.pending, -1)
 				})
 
 				eventChan <- e
@@ -218,11 +455,32 @@ func (this *Watchdog) debounce(rule *fsnotify.Rule, srcChan chan *fsnotify.Event
 				eventChan.(chan *fsnotify.Event) <- e
 				this.Logger.Debugf("Publish %s to the debounce channel", e.Name)
 			}
+		case <-done:
+			this.Logger.Infof("Flush %s debounce events", rule.Biz)
+			done = nil
+			draining = true
+			close(flush)
+		case <-idle.C:
+			if draining && len(srcChan) == 0 {
+				this.removeSrcQueue(rule.Biz, srcChan)
+				return
+			}
+		case <-this.quit:
+			return
 		}
 	}
 }
 
-func (this *Watchdog) debounceFsnotifyEvent(delay time.Duration, eventChan chan *fsnotify.Event, cb func(event *fsnotify.Event)) {
+// 业务停止监听且事件转发完毕后，移除其事件通道
+func (this *Watchdog) removeSrcQueue(biz string, srcChan chan *fsnotify.Event) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.srcQueues[biz] == srcChan {
+		delete(this.srcQueues, biz)
+	}
+}
+
+func (this *Watchdog) debounceFsnotifyEvent(delay time.Duration, eventChan chan *fsnotify.Event, flush chan struct{}, cb func(event *fsnotify.Event)) {
 	// try to read from channel, block at most 5s.
 	// if timeout, print time event and go on loop.
 	// if read a message which is not the type we want(we want true, not false),
@@ -246,43 +504,103 @@ func (this *Watchdog) debounceFsnotifyEvent(delay time.Duration, eventChan chan
 			}
 			cb(e)
 			return
+		case <-flush:
+			timer.Stop()
+			// 取通道中最新的事件
+			for len(eventChan) > 0 {
+				e = <-eventChan
+			}
+			cb(e)
+			return
 		}
 	}
 }
 
+// 流水线退出后下游不再读取，放弃转发以免阻塞，未处理的文件在重启后由轮询补扫
+func (this *Watchdog) forward(destChan chan *fsnotify.Event, e *fsnotify.Event) {
+	select {
+	case destChan <- e:
+	case <-this.quit:
+	}
+}
+
 func (this *Watchdog) transferBatch(delay time.Duration, srcChan chan *fsnotify.Event, destChan chan []*fsnotify.Event) {
+	defer this.wg.Done()
+
 	timer := time.NewTicker(delay)
+	defer timer.Stop()
 	var cacheQ []*fsnotify.Event
 	for {
 		select {
 		case e := <-srcChan:
+			atomic.AddInt64(&this.pending, 1)
 			cacheQ = append(cacheQ, e)
-			if len(cacheQ) >= TASK_CONCURRENCY_CONTROL {
-				destChan <- this.filterEvents(cacheQ)
+			if len(cacheQ) >= this.pipeline.BatchSize {
+				select {
+				case destChan <- this.filterEvents(cacheQ):
+				case <-this.quit:
+				}
+				atomic.AddInt64(&this.pending, -int64(len(cacheQ)))
 				cacheQ = nil
 			}
 		case <-timer.C:
 			if len(cacheQ) > 0 {
-				destChan <- this.filterEvents(cacheQ)
+				select {
+				case destChan <- this.filterEvents(cacheQ):
+				case <-this.quit:
+				}
+				atomic.AddInt64(&this.pending, -int64(len(cacheQ)))
 				cacheQ = nil
 			}
+		case <-this.quit:
+			return
 		}
 	}
 }
 
-func (this *Watchdog) transfer(srcChan chan *fsnotify.Event, destChan chan *fsnotify.Event) {
+func (this *Watchdog) transfer(rule *fsnotify.Rule, srcChan chan *fsnotify.Event, destChan chan *fsnotify.Event) {
+	defer this.wg.Done()
+
+	// 停止监听后，通道清空即退出
+	done := rule.Done
+	draining := false
+	idle := time.NewTicker(time.Second)
+	defer idle.Stop()
 	for {
 		select {
 		case e := <-srcChan:
-			destChan <- e
+			if e.Op == "REMOVE" || e.Op == "RENAME" {
+				this.trackRemoval(rule, e)
+				continue
+			}
+			atomic.AddInt64(&this.pending, 1)
+			this.forward(destChan, e)
+			atomic.AddInt64(&this.pending, -1)
+		case <-done:
+			done = nil
+			draining = true
+		case <-idle.C:
+			if draining && len(srcChan) == 0 {
+				this.removeSrcQueue(rule.Biz, srcChan)
+				return
+			}
+		case <-this.quit:
+			return
 		}
 	}
 }
 
 func (this *Watchdog) handle(taskChan chan []*fsnotify.Event) {
-	// 采用线程池的方式处理，有效节省处理大量协程时协程切换的开销
-	pool := tunny.NewFunc(runtime.NumCPU(), func(payload interface{}) interface{} {
+	defer this.wg.Done()
 
+	// 采用线程池的方式处理，有效节省处理大量协程时协程切换的开销
+	pool := tunny.NewFunc(this.pipeline.Workers, func(payload interface{}) interface{} {
+		// 停机时不再处理排队中的任务，未处理的文件在重启后由轮询补扫
+		select {
+		case <-this.quit:
+			return nil
+		default:
+		}
 		this.fileProcessor(payload.(*fsnotify.Event))
 
 		// 延时处理以降低系统IO
@@ -294,6 +612,7 @@ func (this *Watchdog) handle(taskChan chan []*fsnotify.Event) {
 	for {
 		select {
 		case tasks := <-taskChan:
+			atomic.AddInt64(&this.pending, int64(len(tasks)))
 			start := time.Now() // get current time
 
 			var wg sync.WaitGroup
@@ -306,7 +625,10 @@ func (this *Watchdog) handle(taskChan chan []*fsnotify.Event) {
 			}
 			wg.Wait()
 
+			atomic.AddInt64(&this.pending, -int64(len(tasks)))
 			this.Logger.Infof("Finish %d tasks in %s", len(tasks), time.Since(start))
+		case <-this.quit:
+			return
 		}
 	}
 }
@@ -320,7 +642,9 @@ func (this *Watchdog) filterEvents(fevents []*fsnotify.Event) []*fsnotify.Event
 		if _, ok := keys[filename]; !ok {
 			keys[filename] = true
 			l = append(l, fevents[i])
+			continue
 		}
+		metrics.EventsDuplicated.WithLabelValues(fevents[i].Biz).Inc()
 	}
 	return l
 }
@@ -336,15 +660,12 @@ func (this *Watchdog) GetFileMeta(fevent *fsnotify.Event) (*handler.FileMeta, er
 
 	// 文件目录，支持跨平台
 	dirName := filepath.Dir(fevent.Name)
-	// filepath.Clean 自动转化目录分隔符，如 "C:/dev/workspace" => "C:\\dev\\workspace"
-	rootDirName := filepath.Clean(fevent.RootPath)
-	var pathSeparator string
-	if os.IsPathSeparator('\\') {
-		pathSeparator = "\\"
-	} else {
-		pathSeparator = "/"
+	subDirName := subDir(fevent.Name, fevent.RootPath)
+	// 上传的文件沿用来源主机以及上传时指定的子目录
+	host := this.host
+	if fevent.Host != "" {
+		host, subDirName = fevent.Host, fevent.SubDir
 	}
-	subDirName := filepath.ToSlash(strings.Trim(strings.Replace(dirName, rootDirName, "", 1), pathSeparator))
 
 	// 文件创建时间，支持跨平台
 	var fileCreateTime time.Time
@@ -379,64 +700,312 @@ func (this *Watchdog) GetFileMeta(fevent *fsnotify.Event) (*handler.FileMeta, er
 		CreateTime: fileCreateTime,
 		ModifyTime: fi.ModTime(),
 		LastOp:     fevent,
-		Host:       this.host,
+		Host:       host,
 		FolderTime: folderCreateTime,
 	}, nil
 }
 
+// 文件相对于监控根目录的子目录，统一使用"/"分隔
+func subDir(name string, root string) string {
+	dirName := filepath.Dir(name)
+	// filepath.Clean 自动转化目录分隔符，如 "C:/dev/workspace" => "C:\\dev\\workspace"
+	rootDirName := filepath.Clean(root)
+	var pathSeparator string
+	if os.IsPathSeparator('\\') {
+		pathSeparator = "\\"
+	} else {
+		pathSeparator = "/"
+	}
+	return filepath.ToSlash(strings.Trim(strings.Replace(dirName, rootDirName, "", 1), pathSeparator))
+}
+
 func (this *Watchdog) fileProcessor(fevent *fsnotify.Event) {
+	// 删除等待期满且未被认定为移动的文件
+	if fevent.Op == "DELETE" {
+		this.removeProcessor(fevent)
+		return
+	}
+	// syslog等非文件来源的记录
+	if fevent.Op == "RECORD" {
+		this.recordProcessor(fevent)
+		return
+	}
 	// 获取file简要信息
 	fileMeta, err := this.GetFileMeta(fevent)
 	if err != nil {
 		// FindFirstFile D:\\I1000_testlog\\HP\\Matterhorn\\K2786401B\\NULL.txt: The system cannot find the file specified.
 		this.Logger.Warnf("Fail to get origin file: %s", err)
+		// 文件已不存在，则无需再重试
+		if os.IsNotExist(err) {
+			this.db.Update(func(txn *badger.Txn) error {
+				return this.dlq.Ack(txn, fevent.Name)
+			})
+		} else {
+			this.stats.failure(fevent.Biz, err)
+		}
 		// 如果是文件被删除了, 该咋办?
 		if err := this.hook.Listen("Handle404Error", this, fileMeta, fevent); err != nil {
 			this.Logger.Warnf("Handle404Error hook throw exception: %s", err)
 			return
 		}
 	}
-	if fileMeta.Filepath == "" {
+	if fileMeta == nil || fileMeta.Filepath == "" {
 		// this.Logger.Warn("The fileMeta is an empty struct, please check the event: %s %s", fevent.Op, fevent.Name)
 		return
 	}
 
+	// 实时事件未按min_age过滤，静置时间不足的文件延迟至满足后重新处理
+	if fevent.Op == "CREATE" || fevent.Op == "WRITE" {
+		if wait := this.settle(fevent.Biz, fileMeta.ModifyTime); wait > 0 {
+			this.Logger.Debugf("Requeue %s after %s, min_age is not reached", fileMeta.Filepath, wait)
+			this.requeue(fevent, wait)
+			return
+		}
+	}
+
+	// 监控目录内移动的文件沿用原有状态，内容未变更时无需重新上传
+	moved := this.matchMove(fileMeta)
+
+	// 内容未变更的文件无需重复投递，轮询事件在遍历时已做过判定
+	policy := this.changePolicy(fevent.Biz)
+	record := &state.Record{Size: fileMeta.Size, ModTime: fileMeta.ModifyTime}
+	if moved || (fevent.Op != "LOAD" && fevent.Op != "FLUSH" && fevent.Op != "UPLOAD") {
+		var changed bool
+		if record, changed = this.detector.Detect(fileMeta.Filepath, fileMeta.Size, fileMeta.ModifyTime, policy); !changed {
+			this.Logger.Debugf("Skip %s, the content is not changed", fileMeta.Filepath)
+			return
+		}
+	}
+
 	// 支持Agent层级的清洗操作
 	if err := this.hook.Listen("CheckFile", this, fileMeta); err != nil {
+		// 文件尚未写完，延迟后重新处理，避免仅依赖后续的写入事件
+		if e, ok := completeness.IsIncomplete(err); ok {
+			this.Logger.Infof("Requeue %s after %s, %s", fileMeta.Filepath, e.Delay, err)
+			metrics.FilesIncomplete.WithLabelValues(fevent.Biz, e.Strategy).Inc()
+			this.requeue(fevent, e.Delay)
+			return
+		}
+		if err == completeness.ErrMarkerFile {
+			this.Logger.Debugf("Skip the marker file %s", fileMeta.Filepath)
+			if fevent.Op == "UPLOAD" {
+				this.discardUpload(fevent, "it is a marker file")
+			}
+			return
+		}
 		this.Logger.Warnf("CheckFile hook throw exception: %s", err)
-		// 如果报文件不完整，那稍后应该还会有写入事件产生，所以暂不做处理
+		if fevent.Op == "UPLOAD" {
+			this.stats.failure(fevent.Biz, err)
+			this.discardUpload(fevent, err.Error())
+		}
 		return
 	}
 	this.hook.Listen("Transform", this, fileMeta)
 
-	failure := false
-	// 考虑到失败回滚，采用串行更为便利
-	for _, Adapter := range this.adapters[fileMeta.LastOp.Biz] {
-		Adapter.SetLogger(this.Logger)
-		if err := Adapter.Handle(*fileMeta); err != nil {
-			this.Logger.Errorf("Adapter.Handle throw exception: %s", err)
-			failure = true
-			break
+	adapters, release, ok := this.acquireAdapters(fileMeta.LastOp.Biz)
+	// 业务已被热加载移除
+	if !ok {
+		if fevent.Op == "UPLOAD" {
+			this.discardUpload(fevent, fileMeta.LastOp.Biz+" is unmounted")
+			return
+		}
+		this.Logger.Warnf("%s is unmounted, discard %s", fileMeta.LastOp.Biz, fileMeta.Filepath)
+		return
+	}
+	defer release()
+
+	this.mu.RLock()
+	splitter := this.splitters[fevent.Biz]
+	this.mu.RUnlock()
+
+	var failure error
+	// 末尾记录尚未提交时不记录文件状态，以便重启后轮询能够继续处理
+	complete := true
+	// 上传的文件整体投递
+	if this.tailMode(fevent.Biz) && fevent.Op != "UPLOAD" {
+		complete, failure = this.tail(fileMeta, adapters, splitter)
+	} else {
+		if splitter != nil && fileMeta.Ext != ".zip" {
+			failure = this.split(fileMeta, splitter)
+		}
+		if failure == nil {
+			failure = this.deliver(fileMeta, adapters)
 		}
 	}
-	if failure {
+	if failure != nil {
 		this.Logger.Errorf("Need to rollback file: %s", fileMeta.Filepath)
+		this.stats.failure(fileMeta.LastOp.Biz, failure)
 		// 文件处理异常时需要将该文件事件传送至异常处理通道
-		this.rollback(fileMeta)
+		this.rollback(fileMeta, failure)
+		return
+	}
+
+	// 投递成功后即清理暂存的上传文件，无需记录文件状态
+	if fevent.Op == "UPLOAD" {
+		this.uploaded(fevent)
 		return
 	}
 
 	// 记录文件更新状态
+	if record.Checksum == "" && policy != fsnotify.CHANGE_POLICY_MTIME {
+		if record.Checksum, err = state.Checksum(fileMeta.Filepath); err != nil {
+			this.Logger.Warnf("Fail to calculate the checksum of %s: %s", fileMeta.Filepath, err)
+		}
+	}
+	record.CreateTime = fileMeta.CreateTime
+	if record.Inode, err = inode.Get(fileMeta.Filepath); err != nil {
+		this.Logger.Warnf("Fail to get the inode of %s: %s", fileMeta.Filepath, err)
+	}
 	err = this.db.Update(func(txn *badger.Txn) error {
-		t, _ := fileMeta.ModifyTime.GobEncode()
-		return txn.Set([]byte(fevent.Name), t)
+		if complete {
+			if err := this.detector.Save(txn, fevent.Name, record); err != nil {
+				return err
+			}
+		}
+		// 投递记录仅用于重试时跳过已成功的适配器，全部投递成功后即可清理
+		if err := deletePrefix(txn, LEDGER_PREFIX+fevent.Name+"|"); err != nil {
+			return err
+		}
+		return this.dlq.Ack(txn, fevent.Name)
 	})
 	if err != nil {
 		this.Logger.Errorf("Fail to update badger: %s", err)
 	}
+	this.stats.success(fileMeta.LastOp.Biz)
+}
+
+// 依次交由各适配器处理
+func (this *Watchdog) deliver(file *handler.FileMeta, adapters []handler.WatchdogHandler) error {
+	// 读取量按文件统计，增量内容以及非文件来源的记录按实际内容统计
+	read := file.Size
+	if file.Incremental || file.Virtual {
+		read = int64(len(file.Content))
+	}
+	metrics.ObserveRead(file.LastOp.Biz, read)
+
+	// 考虑到失败回滚，采用串行更为便利
+	for _, Adapter := range adapters {
+		// 重试时跳过已确认过当前文件版本的适配器
+		if this.ledger.Delivered(file, Adapter) {
+			this.Logger.Debugf("Skip %s, already delivered by %s", file.Filepath, Adapter.GetName())
+			continue
+		}
+		Adapter.SetLogger(this.Logger)
+		start := time.Now()
+		err := Adapter.Handle(*file)
+		metrics.ObserveAdapter(file.LastOp.Biz, Adapter.GetName(), start, err)
+		if err != nil {
+			this.Logger.Errorf("Adapter.Handle throw exception: %s", err)
+			return err
+		}
+		if err := this.ledger.Record(file, Adapter); err != nil {
+			this.Logger.Errorf("Fail to record the delivery of %s by %s: %s", file.Filepath, Adapter.GetName(), err)
+		}
+	}
+	return nil
 }
 
-func (this *Watchdog) rollback(file *handler.FileMeta) {
+// tail模式下逐块投递新增的行，每块投递成功后再提交读取位置
+// 按多行规则切分时，末尾的记录需等待后续行，超时无写入后再提交，此时complete为false
+func (this *Watchdog) tail(file *handler.FileMeta, adapters []handler.WatchdogHandler, splitter *multiline.Splitter) (complete bool, err error) {
+	flush := splitter != nil && time.Since(file.ModifyTime) >= splitter.FlushTimeout
+	for {
+		chunk, id, next, err := this.offsets.Read(file, flush)
+		if err != nil {
+			return false, err
+		}
+		if chunk == nil {
+			return true, nil
+		}
+		pending := false
+		if splitter != nil {
+			records, consumed := splitter.Split(chunk.Content, flush)
+			// 单条记录超过读取上限时整块提交，避免一直无法推进
+			if len(records) == 0 && len(chunk.Content) >= TAIL_MAX_BYTES {
+				records, consumed = [][]byte{chunk.Content}, len(chunk.Content)
+			}
+			pending = consumed < len(chunk.Content)
+			chunk.Records = records
+			chunk.Content = chunk.Content[:consumed]
+			chunk.Size = int64(consumed)
+			next = chunk.Offset + int64(consumed)
+		}
+		if len(chunk.Content) > 0 {
+			if err := this.deliver(chunk, adapters); err != nil {
+				return false, err
+			}
+			if err := this.offsets.Commit(file.Filepath, id, next); err != nil {
+				return false, err
+			}
+		}
+		if pending {
+			this.scheduleFlush(file.LastOp, splitter.FlushTimeout)
+			return false, nil
+		}
+	}
+}
+
+// 读取整个文件并按多行规则切分
+func (this *Watchdog) split(file *handler.FileMeta, splitter *multiline.Splitter) error {
+	content, err := ioutil.ReadFile(file.Filepath)
+	if err != nil {
+		return err
+	}
+	file.Content = content
+	file.Records, _ = splitter.Split(content, true)
+	return nil
+}
+
+// 末尾记录等待超时后重新触发处理
+func (this *Watchdog) scheduleFlush(fevent *fsnotify.Event, delay time.Duration) {
+	e := new(fsnotify.Event)
+	*e = *fevent
+	e.Op = "FLUSH"
+	this.requeue(e, delay)
+}
+
+// 延迟后重新投递事件，同一文件仅保留最近一次
+func (this *Watchdog) requeue(e *fsnotify.Event, delay time.Duration) {
+	timer := time.AfterFunc(delay, func() {
+		this.requeueTimers.Delete(e.Name)
+		select {
+		case this.cacheQueue <- e:
+		case <-this.stopping:
+		}
+	})
+	if prev, loaded := this.requeueTimers.LoadOrStore(e.Name, timer); loaded {
+		prev.(*time.Timer).Stop()
+		this.requeueTimers.Store(e.Name, timer)
+	}
+}
+
+func (this *Watchdog) settle(biz string, modTime time.Time) time.Duration {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if rule, ok := this.rules[biz]; ok {
+		return rule.Settle(modTime)
+	}
+	return 0
+}
+
+func (this *Watchdog) tailMode(biz string) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	rule, ok := this.rules[biz]
+	return ok && rule.Mode == fsnotify.MODE_TAIL
+}
+
+// 业务的文件变更判定策略，缺省比较大小以及修改时间
+func (this *Watchdog) changePolicy(biz string) string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if rule, ok := this.rules[biz]; ok && rule.ChangePolicy != "" {
+		return rule.ChangePolicy
+	}
+	return fsnotify.CHANGE_POLICY_MTIME
+}
+
+func (this *Watchdog) rollback(file *handler.FileMeta, cause error) {
 	// 	var syncWg sync.WaitGroup
 	// 	for _, Adapter := range this.adapters[file.LastOp.Biz] {
 	// 		syncWg.Add(1)
@@ -448,5 +1017,49 @@ func (this *Watchdog) rollback(file *handler.FileMeta) {
 	// 	}
 	// 	syncWg.Wait()
 
-	// TODO:将处理失败的事件传送至失败通道
+	// 将处理失败的事件写入死信队列，等待重试
+	letter, err := this.dlq.Push(file, cause)
+	if err != nil {
+		this.Logger.Errorf("Fail to push %s to the dead letter queue: %s", file.Filepath, err)
+		return
+	}
+	if letter.Attempts >= this.retry.MaxAttempts {
+		this.Logger.Errorf("Give up %s after %d attempts, parked as poisoned: %s", file.Filepath, letter.Attempts, letter.LastError)
+		return
+	}
+	this.Logger.Warnf("Schedule %s retry #%d at %s", file.Filepath, letter.Attempts, letter.NextRetry.Format(time.RFC3339))
+}
+
+func (this *Watchdog) retryDeadLetters(destChan chan *fsnotify.Event) {
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(RETRY_SCAN_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stopping:
+			return
+		case <-ticker.C:
+			letters, err := this.dlq.Due(time.Now())
+			if err != nil {
+				this.Logger.Errorf("Fail to scan the dead letter queue: %s", err)
+				continue
+			}
+			for _, l := range letters {
+				// 死信仍保留在队列中，停机后不再投递
+				select {
+				case <-this.stopping:
+					return
+				default:
+				}
+				this.Logger.Infof("Retry %s event for %s: %s", l.File.LastOp.Biz, l.File.LastOp.Op, l.File.Filepath)
+				metrics.FilesRetried.WithLabelValues(l.File.LastOp.Biz).Inc()
+				select {
+				case destChan <- l.File.LastOp:
+				case <-this.stopping:
+					return
+				}
+			}
+		}
+	}
 }
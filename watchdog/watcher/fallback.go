@@ -0,0 +1,237 @@
+package watcher
+
+import (
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FALLBACK_POLL_INTERVAL = 10 * time.Second // 监听数耗尽后轮询子目录的时间间隔
+)
+
+// 各业务实时监听的占用情况，供状态查询
+type Usage struct {
+	Watches   int      // inotify监听数
+	Fallbacks []string // 降级为轮询的子目录
+}
+
+type ownedUsage struct {
+	owner *fallbackPoller
+	usage Usage
+}
+
+var (
+	usages   = make(map[string]*ownedUsage)
+	usagesMu sync.Mutex
+)
+
+func WatchUsage(biz string) Usage {
+	usagesMu.Lock()
+	defer usagesMu.Unlock()
+	if u, ok := usages[biz]; ok {
+		return u.usage
+	}
+	return Usage{}
+}
+
+func (this *fallbackPoller) report(usage Usage) {
+	usagesMu.Lock()
+	defer usagesMu.Unlock()
+	usages[this.rule.Biz] = &ownedUsage{owner: this, usage: usage}
+	metrics.Watches.WithLabelValues(this.rule.Biz).Set(float64(usage.Watches))
+	metrics.WatchFallbacks.WithLabelValues(this.rule.Biz).Set(float64(len(usage.Fallbacks)))
+}
+
+// 监听停止后清理占用情况以及指标，热加载时新的监听可能已先行上报，仅清理自身的
+func (this *fallbackPoller) unreport() {
+	usagesMu.Lock()
+	defer usagesMu.Unlock()
+	if u, ok := usages[this.rule.Biz]; !ok || u.owner != this {
+		return
+	}
+	delete(usages, this.rule.Biz)
+	metrics.Watches.DeleteLabelValues(this.rule.Biz)
+	metrics.WatchFallbacks.DeleteLabelValues(this.rule.Biz)
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// 无法添加监听的子目录改为快速轮询，通过比较大小以及修改时间模拟实时监听的事件
+type fallbackPoller struct {
+	logger log.Logger
+	rule   *fsnotify.Rule
+	mu     sync.Mutex
+	ready  bool            // 首次添加监听是否已完成
+	roots  map[string]bool // 子目录 -> 下次扫描是否仅建立基线
+	files  map[string]fileState
+}
+
+func newFallbackPoller(rule *fsnotify.Rule, logger log.Logger) *fallbackPoller {
+	return &fallbackPoller{
+		logger: logger,
+		rule:   rule,
+		roots:  make(map[string]bool),
+		files:  make(map[string]fileState),
+	}
+}
+
+// 启动时已存在的文件由fspolling负责导入，故仅建立基线；运行期间新建的目录则需上报其下所有文件
+func (this *fallbackPoller) add(dir string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for root := range this.roots {
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return
+		}
+	}
+	this.roots[dir] = !this.ready
+	if len(this.roots) == 1 {
+		this.logger.Warnf("Inotify watches of %s are exhausted, fall back to polling %s every %s, consider raising fs.inotify.max_user_watches", this.rule.Biz, dir, FALLBACK_POLL_INTERVAL)
+	} else {
+		this.logger.Debugf("Fall back to polling %s", dir)
+	}
+}
+
+func (this *fallbackPoller) start() {
+	this.mu.Lock()
+	this.ready = true
+	this.mu.Unlock()
+}
+
+func (this *fallbackPoller) dirs() []string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	dirs := make([]string, 0, len(this.roots))
+	for root := range this.roots {
+		dirs = append(dirs, root)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// 按固定间隔轮询各子目录，同时上报监听的占用情况，watcher为nil时表示无法创建inotify实例
+func (this *fallbackPoller) run(watcher *fsnotify.RecursiveWatcher, taskChan chan *fsnotify.Event) {
+	ticker := time.NewTicker(FALLBACK_POLL_INTERVAL)
+	defer ticker.Stop()
+	defer this.unreport()
+	for {
+		dirs := this.dirs()
+		usage := Usage{Fallbacks: dirs}
+		if watcher != nil {
+			usage.Watches = watcher.Count()
+		}
+		this.report(usage)
+
+		for _, dir := range dirs {
+			if err := this.poll(dir, taskChan); err == fsnotify.ErrWalkAborted {
+				return
+			}
+		}
+		select {
+		case <-this.rule.Done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (this *fallbackPoller) poll(root string, taskChan chan *fsnotify.Event) error {
+	this.mu.Lock()
+	quiet := this.roots[root]
+	this.roots[root] = false
+	this.mu.Unlock()
+
+	// 子目录已被删除，上报目录的删除事件后不再轮询
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		this.mu.Lock()
+		delete(this.roots, root)
+		this.mu.Unlock()
+		this.forget(root, nil)
+		this.emit("REMOVE", root, taskChan)
+		this.logger.Infof("Stop polling %s, the directory is removed", root)
+		return nil
+	}
+
+	// 保持与实时监听一致的递归深度
+	level := uint(1)
+	if rel, err := filepath.Rel(this.rule.MonitPath, root); err == nil && rel != "." {
+		level += uint(len(strings.Split(rel, string(filepath.Separator))))
+	}
+	r := new(fsnotify.Rule)
+	*r = *this.rule
+	r.MonitPath = root
+
+	seen := make(map[string]bool)
+	err := fsnotify.WalkDir(r, level, func(e *fsnotify.Event) error {
+		select {
+		case <-this.rule.Done:
+			return fsnotify.ErrWalkAborted
+		default:
+		}
+		if e.IsDir {
+			return nil
+		}
+		seen[e.Name] = true
+		cur := fileState{size: e.Size, modTime: e.ModTime}
+		this.mu.Lock()
+		prev, ok := this.files[e.Name]
+		this.files[e.Name] = cur
+		this.mu.Unlock()
+		if quiet || (ok && prev == cur) {
+			return nil
+		}
+		op := "WRITE"
+		if !ok {
+			op = "CREATE"
+		}
+		this.emit(op, e.Name, taskChan)
+		return nil
+	})
+	if err == fsnotify.ErrWalkAborted {
+		return err
+	}
+	if err != nil {
+		this.logger.Errorf("The error occured during polling %s: %s", root, err)
+		return err
+	}
+	for _, name := range this.forget(root, seen) {
+		this.emit("REMOVE", name, taskChan)
+	}
+	return nil
+}
+
+// 清理子目录下本轮未出现的文件，返回被清理的文件
+func (this *fallbackPoller) forget(root string, seen map[string]bool) []string {
+	prefix := root + string(filepath.Separator)
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var gone []string
+	for name := range this.files {
+		if strings.HasPrefix(name, prefix) && !seen[name] {
+			delete(this.files, name)
+			gone = append(gone, name)
+		}
+	}
+	return gone
+}
+
+func (this *fallbackPoller) emit(op string, name string, taskChan chan *fsnotify.Event) {
+	this.logger.Infof("Catched polling event: %s %s", op, name)
+	metrics.EventsCaught.WithLabelValues(this.rule.Biz, FS_POLL).Inc()
+	this.rule.Publish(taskChan, &fsnotify.Event{
+		Op:       op,
+		Name:     name,
+		Biz:      this.rule.Biz,
+		RootPath: this.rule.RootPath,
+	})
+}
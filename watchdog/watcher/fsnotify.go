@@ -3,19 +3,31 @@ package watcher
 import (
 	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
 	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"github.com/djherbis/times"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	GUARD_INTERVAL = 20 * time.Second // 检查监听目录是否可访问的时间间隔
+	CATCHUP_MARGIN = time.Minute      // 补扫起点提前的时长，容忍网络共享目录与本机的时钟偏差
+)
+
 type FsnotifyWatcher struct {
-	logger log.Logger
-	reset  bool // 是否应该进行重置
+	logger  log.Logger
+	mu      sync.Mutex
+	healthy time.Time // 最近一次确认监听正常的时间
+	outage  *Incident // 尚未恢复的故障，恢复后需重置监听并补扫
 }
 
 func NewFsnotifyWatcher() Watcher {
 	return &FsnotifyWatcher{
-		reset: false,
+		healthy: time.Now(),
 	}
 }
 
@@ -29,68 +41,190 @@ func (this *FsnotifyWatcher) Listen(rule *fsnotify.Rule, taskChan chan *fsnotify
 }
 
 func (this *FsnotifyWatcher) realTimeMonit(rule *fsnotify.Rule, taskChan chan *fsnotify.Event) {
+	poller := newFallbackPoller(rule, this.logger)
 	watcher, err := fsnotify.NewRecursiveWatcher()
 	if err != nil {
-		this.logger.Fatalf("The error occured when create watcher: %s", err)
+		// 无法创建inotify实例时，整个目录降级为轮询
+		this.logger.Errorf("The error occured when create watcher: %s", err)
+		poller.add(rule.MonitPath)
+		poller.start()
+		poller.run(nil, taskChan)
 		return
 	}
 	defer watcher.Close()
+	watcher.OnExhausted = poller.add
 
 	go watcher.NotifyFsEvent(rule, func(e *fsnotify.Event, err error) {
 		if err != nil {
 			this.logger.Errorf("The error occured during monitoring filesystem: %s", err)
-			// GetQueuedCompletionPort: The specified network name is no longer available.
-			if strings.Contains(err.Error(), "The specified network name is no longer available") {
-				this.logger.Errorf("%s fsnotify need to be reset", rule.Biz)
-				this.reset = true
+			// 新建的文件随即被删除等文件级的错误不影响监听
+			// 其余均为监听本身的错误，e.g. GetQueuedCompletionPort: The specified network name is no longer available.
+			if _, ok := err.(*os.PathError); !ok {
+				this.markOutage(rule, err.Error())
 			}
 			return
 		}
 		this.logger.Infof("Catched filesystem event: %s %s", e.Op, e.Name)
-		if e.Op == "CREATE" || e.Op == "WRITE" {
+		// 监听目录本身被删除或移走后，其监听也随之失效
+		if (e.Op == "REMOVE" || e.Op == "RENAME") && filepath.Clean(e.Name) == filepath.Clean(rule.MonitPath) {
+			this.markOutage(rule, "the watch root is "+strings.ToLower(e.Op)+"d")
+		}
+		metrics.EventsCaught.WithLabelValues(rule.Biz, FS_NOTIFY).Inc()
+		// 删除以及重命名事件用于向目标端传递删除，或识别监控目录内的移动
+		if e.Op == "CREATE" || e.Op == "WRITE" || e.Op == "REMOVE" || e.Op == "RENAME" {
 			e.Biz = rule.Biz
 			e.RootPath = rule.RootPath
-			taskChan <- e
+			// 回调阻塞会导致内核事件队列溢出，通道已满时按背压策略处理
+			rule.Publish(taskChan, e)
 		}
 	})
 
 	err = watcher.RecursiveAdd(rule)
 	if err != nil {
-		this.logger.Fatalf("The error occured when add the monitored directory: %s", err)
-		return
+		this.logger.Errorf("The error occured when add the monitored directory: %s", err)
+		poller.add(rule.MonitPath)
 	}
+	poller.start()
+	this.logger.Infof("%s uses %d inotify watches", rule.Biz, watcher.Count())
+	poller.run(watcher, taskChan)
 
-	<-rule.Done
 	this.logger.Errorf("Trigger done channel, Biz: %s, Path: %s", rule.Biz, rule.MonitPath)
 }
 
 // 检测到目录突然没了，则得标记状态
 // 目录突然又出现了，判断之前是否有有异常，如果没有，则不做处理，如果之前报错，则重新注册监听程序
 func (this *FsnotifyWatcher) realTimeMonitGuard(rule *fsnotify.Rule, taskChan chan *fsnotify.Event) {
-	rule.Done = make(chan struct{})
-	go this.realTimeMonit(rule, taskChan)
+	// rule.Done用于停止该业务的监听，每次注册的监听程序使用独立的副本，便于单独重置
+	instance := this.spawn(rule, taskChan)
 
+	ticker := time.NewTicker(GUARD_INTERVAL)
+	defer ticker.Stop()
 	for {
-		time.Sleep(20 * time.Second)
+		select {
+		case <-rule.Done:
+			close(instance.Done)
+			this.logger.Infof("Stop %s all watches.", rule.Biz)
+			return
+		case <-ticker.C:
+		}
 		// fmt.Println("Monitor Watch:", rule.MonitPath)
 		// 以下操作有两个目的:
 		// 1) 保证网络目录重新挂载上之后再进行重置监听的操作
 		// 2) 只有去访问目录，才会触发网络目录访问不到的错，所以访问操作必不可少
 		if _, err := os.Stat(rule.MonitPath); err != nil {
 			this.logger.Errorf("Something wrong with %s, %s", rule.Biz, err)
+			this.markOutage(rule, err.Error())
 			continue
 		}
-		if this.reset {
-			this.reset = false
+		if incident := this.recover(); incident != nil {
 			this.logger.Warnf("Reset %s all watches.", rule.Biz)
 			// 重置之前的监控
-			close(rule.Done)
+			close(instance.Done)
 			this.logger.Warnf("Removes %s all watches.", rule.Biz)
 
-			// 必须要重新生成新通道，否则会将新创建的协程也关闭了
-			rule.Done = make(chan struct{})
-			go this.realTimeMonit(rule, taskChan)
+			instance = this.spawn(rule, taskChan)
 			this.logger.Warnf("Restart %s all watches.", rule.Biz)
+			// 新的监听程序就绪后再补扫，两者重叠的部分由下游的变更判定去重
+			go this.catchUp(rule, incident, taskChan)
 		}
 	}
 }
+
+// 登记故障，故障期间仅以首次发现时为准
+func (this *FsnotifyWatcher) markOutage(rule *fsnotify.Rule, reason string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.outage != nil {
+		return
+	}
+	this.outage = &Incident{
+		Biz:      rule.Biz,
+		Path:     rule.MonitPath,
+		Reason:   reason,
+		Start:    this.healthy,
+		Detected: time.Now(),
+	}
+	this.logger.Errorf("%s fsnotify need to be reset: %s", rule.Biz, reason)
+}
+
+// 监听目录可正常访问，返回待恢复的故障
+func (this *FsnotifyWatcher) recover() *Incident {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.healthy = time.Now()
+	incident := this.outage
+	this.outage = nil
+	if incident != nil {
+		incident.End = this.healthy
+		incident.Duration = incident.End.Sub(incident.Start).Round(time.Second).String()
+	}
+	return incident
+}
+
+// 补扫故障期间修改或新建的文件，以WRITE事件提交，由下游判定是否变更
+// 拷贝工具通常会保留修改时间，故同时比较文件的创建时间(Linux下为ChangeTime)
+func (this *FsnotifyWatcher) catchUp(rule *fsnotify.Rule, incident *Incident, taskChan chan *fsnotify.Event) {
+	since := incident.Start.Add(-CATCHUP_MARGIN)
+	this.logger.Warnf("Start to catch up %s, files modified since %s", rule.Biz, since.Format(time.RFC3339))
+
+	var affectedNum int64
+	walker := &fsnotify.Walker{Workers: rule.ScanWorkers}
+	err := walker.Walk(rule, func(e *fsnotify.Event) error {
+		select {
+		case <-rule.Done:
+			return fsnotify.ErrWalkAborted
+		default:
+		}
+		if e.IsDir || (e.ModTime.Before(since) && !createdSince(e.Name, since)) {
+			return nil
+		}
+		this.logger.Infof("Catched missing event: WRITE %s", e.Name)
+		metrics.EventsCaught.WithLabelValues(rule.Biz, FS_NOTIFY).Inc()
+		rule.Publish(taskChan, &fsnotify.Event{
+			Op:       "WRITE",
+			Name:     e.Name,
+			Biz:      rule.Biz,
+			RootPath: rule.RootPath,
+		})
+		atomic.AddInt64(&affectedNum, 1)
+		return nil
+	})
+	if err == fsnotify.ErrWalkAborted {
+		return
+	}
+	if err != nil {
+		this.logger.Errorf("The error occured during catching up %s: %s", rule.Biz, err)
+	}
+
+	incident.CaughtUp = affectedNum
+	recordIncident(*incident)
+	metrics.Outages.WithLabelValues(rule.Biz).Inc()
+	metrics.CaughtUp.WithLabelValues(rule.Biz).Add(float64(affectedNum))
+	this.logger.Warnf("Incident of %s: %s was unavailable from %s to %s (%s), reason: %s, caught up %d files",
+		rule.Biz, incident.Path, incident.Start.Format(time.RFC3339), incident.End.Format(time.RFC3339),
+		incident.Duration, incident.Reason, affectedNum)
+}
+
+func createdSince(name string, since time.Time) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	t := times.Get(fi)
+	if t.HasBirthTime() { // Win
+		return !t.BirthTime().Before(since)
+	}
+	if t.HasChangeTime() { // 非Win
+		return !t.ChangeTime().Before(since)
+	}
+	return false
+}
+
+// 必须要生成新通道，否则重置时会将新创建的协程也关闭了
+func (this *FsnotifyWatcher) spawn(rule *fsnotify.Rule, taskChan chan *fsnotify.Event) *fsnotify.Rule {
+	r := new(fsnotify.Rule)
+	*r = *rule
+	r.Done = make(chan struct{})
+	go this.realTimeMonit(r, taskChan)
+	return r
+}
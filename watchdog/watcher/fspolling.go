@@ -1,27 +1,55 @@
 package watcher
 
 import (
-	"bytes"
 	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
 	"github.com/cobolbaby/log-agent/watchdog/lib/log"
-	"errors"
-	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"github.com/cobolbaby/log-agent/watchdog/lib/schedule"
+	"github.com/cobolbaby/log-agent/watchdog/lib/state"
 	"github.com/dgraph-io/badger"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	FS_POLL_INTERVAL = 10 * time.Minute // 文件系统轮询时间间隔
+	FS_POLL_INTERVAL       = 10 * time.Minute // 文件系统轮询时间间隔，未配置定时任务时的缺省值
+	SCAN_PROGRESS_INTERVAL = 30 * time.Second // 扫描进度的输出间隔
 )
 
+// 扫描进度，供状态查询
+type ScanProgress struct {
+	Path     string
+	Running  bool
+	Start    time.Time
+	Elapsed  string
+	Dirs     int64 // 完整遍历的目录数
+	Skipped  int64 // 未变化而跳过的目录数
+	Files    int64
+	Affected int64
+}
+
+var progresses sync.Map
+
+// 业务最近一次扫描的进度
+func LastScan(biz string) (ScanProgress, bool) {
+	if p, ok := progresses.Load(biz); ok {
+		return p.(ScanProgress), true
+	}
+	return ScanProgress{}, false
+}
+
 type FspollingWatcher struct {
-	logger log.Logger
-	db     *badger.DB
+	logger   log.Logger
+	detector *state.ChangeDetector
+	dirs     *state.DirCache
 }
 
 func NewFspollingWatcher(db *badger.DB) Watcher {
 	return &FspollingWatcher{
-		db: db,
+		detector: state.NewChangeDetector(db),
+		dirs:     state.NewDirCache(db),
 	}
 }
 
@@ -30,58 +58,177 @@ func (this *FspollingWatcher) SetLogger(logger log.Logger) Watcher {
 	return this
 }
 
+// 启动时全量扫描一次以导入历史数据，之后按轮询间隔以及定时任务扫描，两者取最近的一次
 func (this *FspollingWatcher) Listen(rule *fsnotify.Rule, taskChan chan *fsnotify.Event) {
+	var jobs []*schedule.Job
+	for _, expr := range rule.PollSchedules {
+		job, err := schedule.ParseJob(expr)
+		if err != nil {
+			this.logger.Errorf("Ignore the poll schedule of %s: %s", rule.Biz, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	window, err := schedule.ParseWindow(rule.PollWindow)
+	if err != nil {
+		this.logger.Errorf("Ignore the poll window of %s: %s", rule.Biz, err)
+	}
 
 	go func() {
-		// 目录遍历不受递归层级的限制，作用是在保证高效实时监听的情况下，避免影响历史数据导入
-		r := new(fsnotify.Rule)
-		*r = *rule
-		r.MaxNestingLevel = 0
+		if err := this.scan(rule, rule.MonitPath, window, true, taskChan); err == fsnotify.ErrWalkAborted {
+			return
+		}
 		for {
-			this.logger.Infof("Start to scan %s, Path: %s", rule.Biz, rule.MonitPath)
-
-			affectedNum := 0
-			err := fsnotify.WalkDir(r, 1, func(e *fsnotify.Event) error {
-				if e.IsDir {
-					return nil
+			now := time.Now()
+			var next time.Time
+			var job *schedule.Job
+			if rule.PollInterval > 0 {
+				next = now.Add(rule.PollInterval)
+			}
+			for _, j := range jobs {
+				if t := j.Next(now); next.IsZero() || t.Before(next) {
+					next, job = t, j
 				}
-				// 检测文件是否变更
-				if t, _ := e.ModTime.GobEncode(); this.isSaved([]byte(e.Name), t) {
-					return nil
+			}
+			if next.IsZero() {
+				this.logger.Infof("No more polling for %s", rule.Biz)
+				return
+			}
+			select {
+			case <-rule.Done:
+				return
+			case <-time.After(time.Until(next)):
+			}
+			path := rule.MonitPath
+			if job != nil {
+				path = job.Path(rule.MonitPath, next)
+				this.logger.Infof("Trigger the poll schedule of %s: %s", rule.Biz, job)
+				if _, err := os.Stat(path); err != nil {
+					this.logger.Warnf("Skip to scan %s: %s", path, err)
+					continue
 				}
-				// 完善事件信息, 交给下游处理
-				e.Biz = rule.Biz
-				e.RootPath = rule.RootPath
-				taskChan <- e
-
-				affectedNum++
-				return nil
-			})
-			if err != nil {
-				this.logger.Errorf("The error occured during polling filesystem: %s", err)
 			}
-
-			this.logger.Infof("End to scan %s, AffectedNum: #%d", rule.Biz, affectedNum)
-			time.Sleep(FS_POLL_INTERVAL)
+			if err := this.scan(rule, path, window, true, taskChan); err == fsnotify.ErrWalkAborted {
+				return
+			}
 		}
 	}()
+}
 
+// 遍历一次监听目录，将变更的文件交给下游处理，停止监听时返回ErrWalkAborted
+// 用于事件丢失后立即补扫，故不受扫描时间段的限制，且丢失的可能是原地修改，不跳过未变化的目录
+func (this *FspollingWatcher) Scan(rule *fsnotify.Rule, taskChan chan *fsnotify.Event) error {
+	return this.scan(rule, rule.MonitPath, nil, false, taskChan)
 }
 
-func (this *FspollingWatcher) isSaved(k []byte, v []byte) bool {
-	// check if the same key=value already exists
-	err := this.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(k)
-		if err != nil { // not found
+// 遍历指定目录，超出允许的时间段时暂停，待进入时间段后继续
+func (this *FspollingWatcher) scan(rule *fsnotify.Rule, path string, window schedule.Window, incremental bool, taskChan chan *fsnotify.Event) error {
+	// 目录遍历不受递归层级的限制，作用是在保证高效实时监听的情况下，避免影响历史数据导入
+	r := new(fsnotify.Rule)
+	*r = *rule
+	r.MonitPath = path
+	r.MaxNestingLevel = 0
+
+	if err := this.pause(rule, window); err != nil {
+		return err
+	}
+	this.logger.Infof("Start to scan %s, Path: %s", rule.Biz, path)
+
+	walker := &fsnotify.Walker{Workers: rule.ScanWorkers}
+	if incremental && rule.ScanIncremental {
+		walker.Cache = this.dirs
+	}
+	start := time.Now()
+	var affectedNum int64
+	stop := make(chan struct{})
+	go this.report(rule, path, walker, &affectedNum, start, stop)
+	err := walker.Walk(r, func(e *fsnotify.Event) error {
+		// 停止监听时中断遍历
+		select {
+		case <-rule.Done:
+			return fsnotify.ErrWalkAborted
+		default:
+		}
+		if err := this.pause(rule, window); err != nil {
 			return err
 		}
-		return item.Value(func(val []byte) error {
-			if bytes.Equal(val, v) { // already saved
-				return nil
-			}
-			errmsg := fmt.Sprintf("%s is already updated", v)
-			return errors.New(errmsg)
-		})
+		if e.IsDir {
+			return nil
+		}
+		// 检测文件是否变更
+		if _, changed := this.detector.Detect(e.Name, e.Size, e.ModTime, rule.ChangePolicy); !changed {
+			return nil
+		}
+		// 完善事件信息, 交给下游处理
+		e.Biz = rule.Biz
+		e.RootPath = rule.RootPath
+		taskChan <- e
+		metrics.EventsCaught.WithLabelValues(rule.Biz, FS_POLL).Inc()
+
+		atomic.AddInt64(&affectedNum, 1)
+		// 投递成功前所在目录不做缓存，以便下次扫描时重新检查
+		return fsnotify.ErrPending
 	})
-	return err == nil
+	close(stop)
+	metrics.PollingAffected.WithLabelValues(rule.Biz).Add(float64(affectedNum))
+	metrics.PollingDirs.WithLabelValues(rule.Biz, "scanned").Add(float64(walker.Dirs))
+	metrics.PollingDirs.WithLabelValues(rule.Biz, "skipped").Add(float64(walker.Skipped))
+	if err == fsnotify.ErrWalkAborted {
+		this.logger.Infof("Stop to scan %s, AffectedNum: #%d", rule.Biz, affectedNum)
+		return err
+	}
+	if err != nil {
+		this.logger.Errorf("The error occured during polling filesystem: %s", err)
+	}
+
+	metrics.PollingDuration.WithLabelValues(rule.Biz).Observe(time.Since(start).Seconds())
+	this.logger.Infof("End to scan %s, Dirs: #%d, Skipped: #%d, Files: #%d, AffectedNum: #%d, Elapsed: %s",
+		rule.Biz, walker.Dirs, walker.Skipped, walker.Files, affectedNum, time.Since(start).Round(time.Millisecond))
+	return err
+}
+
+// 定期输出扫描进度，扫描结束后保留最终结果
+func (this *FspollingWatcher) report(rule *fsnotify.Rule, path string, walker *fsnotify.Walker, affected *int64, start time.Time, stop chan struct{}) {
+	snapshot := func(running bool) ScanProgress {
+		return ScanProgress{
+			Path:     path,
+			Running:  running,
+			Start:    start,
+			Elapsed:  time.Since(start).Round(time.Second).String(),
+			Dirs:     atomic.LoadInt64(&walker.Dirs),
+			Skipped:  atomic.LoadInt64(&walker.Skipped),
+			Files:    atomic.LoadInt64(&walker.Files),
+			Affected: atomic.LoadInt64(affected),
+		}
+	}
+	progresses.Store(rule.Biz, snapshot(true))
+	ticker := time.NewTicker(SCAN_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			progresses.Store(rule.Biz, snapshot(false))
+			return
+		case <-ticker.C:
+			p := snapshot(true)
+			progresses.Store(rule.Biz, p)
+			this.logger.Infof("Scan progress of %s: Dirs: #%d, Skipped: #%d, Files: #%d, AffectedNum: #%d, Elapsed: %s",
+				rule.Biz, p.Dirs, p.Skipped, p.Files, p.Affected, p.Elapsed)
+		}
+	}
+}
+
+// 不在允许扫描的时间段内时等待，停止监听时返回ErrWalkAborted
+func (this *FspollingWatcher) pause(rule *fsnotify.Rule, window schedule.Window) error {
+	wait := window.Wait(time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	this.logger.Infof("Pause to scan %s for %s, out of the poll window %s", rule.Biz, wait, rule.PollWindow)
+	select {
+	case <-rule.Done:
+		return fsnotify.ErrWalkAborted
+	case <-time.After(wait):
+		return nil
+	}
 }
@@ -0,0 +1,44 @@
+package watcher
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MAX_INCIDENTS = 10 // 每个业务保留的故障记录数
+)
+
+// 监听故障，如网络共享目录断开、监听目录被删除或内核事件队列溢出
+type Incident struct {
+	Biz      string
+	Path     string
+	Reason   string
+	Start    time.Time // 最近一次确认监听正常的时间，故障期间的文件变更以此为起点补扫
+	Detected time.Time
+	End      time.Time
+	Duration string
+	CaughtUp int64 // 补扫时重新提交的文件数
+}
+
+var incidents = struct {
+	sync.Mutex
+	bizs map[string][]Incident
+}{bizs: make(map[string][]Incident)}
+
+func recordIncident(i Incident) {
+	incidents.Lock()
+	defer incidents.Unlock()
+	list := append(incidents.bizs[i.Biz], i)
+	if len(list) > MAX_INCIDENTS {
+		list = list[len(list)-MAX_INCIDENTS:]
+	}
+	incidents.bizs[i.Biz] = list
+}
+
+// 业务最近的故障记录，按时间先后排列
+func Incidents(biz string) []Incident {
+	incidents.Lock()
+	defer incidents.Unlock()
+	return append([]Incident(nil), incidents.bizs[biz]...)
+}
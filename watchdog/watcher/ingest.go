@@ -0,0 +1,396 @@
+package watcher
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	INGEST_LISTEN   = ":8090"            // 上传接口默认监听地址
+	INGEST_PATH     = "/upload/"         // e.g. PUT /upload/<biz>/<subdir>/<filename>
+	INGEST_MAX_SIZE = 256 * 1024 * 1024  // 单次上传的字节数上限
+	INGEST_MEMORY   = 8 * 1024 * 1024    // 解析multipart时缓存在内存中的字节数，超出部分写入临时文件
+	INGEST_TEMP     = ".upload-"         // 上传中的临时文件前缀，写完后重命名
+	INGEST_NONCE    = "upload-"          // 单次上传的暂存目录前缀，同名文件再次上传时互不覆盖
+	INGEST_TIMEOUT  = 10 * time.Second   // 停止监听时等待上传完成的时间
+	INGEST_HEADER   = "X-Logagent-Host"  // 来源主机，未指定时为对端IP
+	INGEST_TOKEN    = "X-Logagent-Token" // 亦可使用Authorization: Bearer <token>
+)
+
+type IngestConfig struct {
+	Listen   string
+	Token    string
+	Spool    string // 暂存目录，上传的文件按<spool>/<biz>/<host>/<nonce>/<subdir>/<filename>存放
+	MaxSize  int64
+	CertFile string
+	KeyFile  string
+}
+
+// 接收HTTP上传的文件，写入暂存目录后以UPLOAD事件进入流水线，投递成功后删除
+// 各业务共用同一监听地址，按URL中的业务名以及令牌区分
+type IngestWatcher struct {
+	logger log.Logger
+	config *IngestConfig
+}
+
+func NewIngestWatcher(config *IngestConfig) Watcher {
+	if config.Listen == "" {
+		config.Listen = INGEST_LISTEN
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = INGEST_MAX_SIZE
+	}
+	return &IngestWatcher{
+		config: config,
+	}
+}
+
+func (this *IngestWatcher) SetLogger(logger log.Logger) Watcher {
+	this.logger = logger
+	return this
+}
+
+func (this *IngestWatcher) Listen(rule *fsnotify.Rule, taskChan chan *fsnotify.Event) {
+	route := &ingestRoute{
+		logger:   this.logger,
+		config:   this.config,
+		rule:     rule,
+		taskChan: taskChan,
+	}
+	// 重启前未投递的文件重新进入流水线，热加载时暂存的文件仍在流水线中，无需重复投递
+	if _, loaded := recovered.LoadOrStore(route.bizRoot(), true); !loaded {
+		go route.recover()
+	}
+
+	server := ingest.register(route)
+	go func() {
+		<-rule.Done
+		ingest.unregister(server, route)
+	}()
+}
+
+// 单个业务的上传配置
+type ingestRoute struct {
+	logger   log.Logger
+	config   *IngestConfig
+	rule     *fsnotify.Rule
+	taskChan chan *fsnotify.Event
+}
+
+type ingestServer struct {
+	addr   string
+	server *http.Server
+	routes map[string]*ingestRoute
+}
+
+var ingest = &ingestRegistry{servers: make(map[string]*ingestServer)}
+
+// 已恢复过的业务暂存目录，进程内仅在首次监听时恢复
+var recovered sync.Map
+
+// 监听地址 -> 上传服务，首个业务注册时启动，最后一个业务注销时关闭
+type ingestRegistry struct {
+	mu      sync.Mutex
+	servers map[string]*ingestServer
+}
+
+func (this *ingestRegistry) register(route *ingestRoute) *ingestServer {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	addr := route.config.Listen
+	s, ok := this.servers[addr]
+	if !ok {
+		s = &ingestServer{addr: addr, routes: make(map[string]*ingestRoute)}
+		s.server = &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			this.serveHTTP(s, w, r)
+		})}
+		this.servers[addr] = s
+		go func() {
+			route.logger.Infof("Listen uploads on %s", addr)
+			var err error
+			if route.config.CertFile != "" {
+				err = s.server.ListenAndServeTLS(route.config.CertFile, route.config.KeyFile)
+			} else {
+				err = s.server.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				route.logger.Errorf("The upload listener %s exited: %s", addr, err)
+				this.mu.Lock()
+				if this.servers[addr] == s {
+					delete(this.servers, addr)
+				}
+				this.mu.Unlock()
+			}
+		}()
+	}
+	s.routes[route.rule.Biz] = route
+	return s
+}
+
+// 热加载时新配置可能已先行注册，仅移除自身
+func (this *ingestRegistry) unregister(s *ingestServer, route *ingestRoute) {
+	this.mu.Lock()
+	if s.routes[route.rule.Biz] == route {
+		delete(s.routes, route.rule.Biz)
+	}
+	idle := len(s.routes) == 0 && this.servers[s.addr] == s
+	if idle {
+		delete(this.servers, s.addr)
+	}
+	this.mu.Unlock()
+	if !idle {
+		return
+	}
+	route.logger.Infof("Close the upload listener %s", s.addr)
+	ctx, cancel := context.WithTimeout(context.Background(), INGEST_TIMEOUT)
+	defer cancel()
+	s.server.Shutdown(ctx)
+}
+
+func (this *ingestRegistry) route(s *ingestServer, biz string) (*ingestRoute, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	route, ok := s.routes[biz]
+	return route, ok
+}
+
+// PUT /upload/<biz>/<subdir>/<filename> 上传单个文件
+// POST /upload/<biz>/<subdir> 以multipart/form-data上传多个文件
+func (this *ingestRegistry) serveHTTP(s *ingestServer, w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, INGEST_PATH) {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, INGEST_PATH), "/", 2)
+	route, ok := this.route(s, parts[0])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !route.authorized(r) {
+		route.logger.Warnf("Reject the upload of %s from %s, invalid token", route.rule.Biz, r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	var rest string
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, route.config.MaxSize)
+
+	var files []string
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		var file string
+		if file, err = route.put(r, rest); err == nil {
+			files = append(files, file)
+		}
+	case http.MethodPost:
+		files, err = route.post(r, rest)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		route.logger.Warnf("Fail to receive the upload of %s from %s: %s", route.rule.Biz, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"biz": route.rule.Biz, "files": files})
+}
+
+func (this *ingestRoute) bizRoot() string {
+	return filepath.Join(this.config.Spool, safeName(this.rule.Biz, "unknown"))
+}
+
+func (this *ingestRoute) authorized(r *http.Request) bool {
+	token := r.Header.Get(INGEST_TOKEN)
+	if auth := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(this.config.Token)) == 1
+}
+
+func (this *ingestRoute) put(r *http.Request, rest string) (string, error) {
+	subdir, filename := path.Split(rest)
+	subdir, err := cleanSubDir(subdir)
+	if err != nil {
+		return "", err
+	}
+	return this.save(r, subdir, filename, r.Body)
+}
+
+func (this *ingestRoute) post(r *http.Request, rest string) ([]string, error) {
+	subdir, err := cleanSubDir(rest)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.ParseMultipartForm(INGEST_MEMORY); err != nil {
+		return nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
+	var files []string
+	for _, headers := range r.MultipartForm.File {
+		for _, header := range headers {
+			file, err := this.savePart(r, subdir, header)
+			if err != nil {
+				return files, err
+			}
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file in the form")
+	}
+	return files, nil
+}
+
+func (this *ingestRoute) savePart(r *http.Request, subdir string, header *multipart.FileHeader) (string, error) {
+	f, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return this.save(r, subdir, header.Filename, f)
+}
+
+// 先写入临时文件再重命名，避免投递写了一半的文件
+func (this *ingestRoute) save(r *http.Request, subdir string, filename string, body io.Reader) (string, error) {
+	filename = path.Base(filepath.ToSlash(filename))
+	if filename == "" || filename == "." || filename == ".." || filename == "/" || strings.HasPrefix(filename, INGEST_TEMP) {
+		return "", fmt.Errorf("invalid filename %q", filename)
+	}
+	// 主机名用作目录，"."或".."会落入其他业务的暂存目录
+	if raw := strings.TrimSpace(r.Header.Get(INGEST_HEADER)); raw == "." || raw == ".." {
+		return "", fmt.Errorf("invalid host %q", raw)
+	}
+	host := safeName(r.Header.Get(INGEST_HEADER), "")
+	if host == "" {
+		host = r.RemoteAddr
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = safeName(host, "unknown")
+	}
+	bizRoot := this.bizRoot()
+	hostDir := filepath.Join(bizRoot, host)
+	if rel, err := filepath.Rel(bizRoot, filepath.Join(hostDir, filepath.FromSlash(subdir))); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid upload path %s/%s", host, subdir)
+	}
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		return "", err
+	}
+	// 每次上传使用独立的目录，文件名保持不变
+	root, err := ioutil.TempDir(hostDir, INGEST_NONCE)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(root, filepath.FromSlash(subdir))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		os.RemoveAll(root)
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(dir, INGEST_TEMP)
+	if err != nil {
+		os.RemoveAll(root)
+		return "", err
+	}
+	size, err := io.Copy(tmp, body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	dest := filepath.Join(dir, filename)
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		os.RemoveAll(root)
+		return "", err
+	}
+	this.logger.Infof("Receive %s of %s from %s, %d bytes", path.Join(subdir, filename), this.rule.Biz, host, size)
+	metrics.EventsCaught.WithLabelValues(this.rule.Biz, INGEST).Inc()
+	this.emit(dest, root, host, subdir)
+	return path.Join(subdir, filename), nil
+}
+
+func (this *ingestRoute) emit(name string, root string, host string, subdir string) {
+	select {
+	case this.taskChan <- &fsnotify.Event{
+		Name:     name,
+		Op:       "UPLOAD",
+		Biz:      this.rule.Biz,
+		RootPath: root,
+		Host:     host,
+		SubDir:   subdir,
+	}:
+	case <-this.rule.Done:
+	}
+}
+
+// 暂存目录中残留的文件即尚未投递成功的上传，中断的上传则直接清理
+func (this *ingestRoute) recover() {
+	bizRoot := this.bizRoot()
+	count := 0
+	filepath.Walk(bizRoot, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(bizRoot, name)
+		if err != nil {
+			return nil
+		}
+		// <host>/<nonce>/<subdir>/<filename>
+		segs := strings.Split(filepath.ToSlash(rel), "/")
+		if len(segs) < 3 || !strings.HasPrefix(segs[1], INGEST_NONCE) {
+			return nil
+		}
+		host := segs[0]
+		root := filepath.Join(bizRoot, host, segs[1])
+		if strings.HasPrefix(fi.Name(), INGEST_TEMP) {
+			os.RemoveAll(root)
+			return nil
+		}
+		subdir := strings.Join(segs[2:len(segs)-1], "/")
+		this.emit(name, root, host, subdir)
+		count++
+		return nil
+	})
+	if count > 0 {
+		this.logger.Infof("Resume %d uploaded files of %s", count, this.rule.Biz)
+	}
+}
+
+// 子目录仅允许相对路径，禁止跳出暂存目录
+func cleanSubDir(subdir string) (string, error) {
+	subdir = strings.Trim(subdir, "/")
+	if subdir == "" {
+		return "", nil
+	}
+	cleaned := path.Clean(subdir)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") || strings.Contains(subdir, "\\") {
+		return "", fmt.Errorf("invalid subdir %q", subdir)
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,313 @@
+package watcher
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/cobolbaby/log-agent/watchdog/lib/fsnotify"
+	"github.com/cobolbaby/log-agent/watchdog/lib/log"
+	"github.com/cobolbaby/log-agent/watchdog/lib/metrics"
+	"github.com/cobolbaby/log-agent/watchdog/lib/syslog"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SYSLOG_BATCH_SIZE  = 500             // 单批记录数上限
+	SYSLOG_BATCH_BYTES = 1024 * 1024     // 单批字节数上限
+	SYSLOG_BATCH_WAIT  = time.Second     // 记录在批次中的最长等待时间
+	SYSLOG_QUEUE_CAP   = 1024            // 已接收待合批的消息通道容量
+	SYSLOG_RETRY_DELAY = 5 * time.Second // 端口被占用等监听失败时的重试间隔
+)
+
+type SyslogConfig struct {
+	Listen    []string // e.g. udp://0.0.0.0:514, tcp://:514, tls://:6514
+	TLS       *tls.Config
+	BatchSize int
+	BatchWait time.Duration
+}
+
+// 校验监听地址，协议仅支持udp/tcp/tls
+func ParseListenAddr(addr string) (network string, address string, err error) {
+	parts := strings.SplitN(strings.TrimSpace(addr), "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid syslog listen address %q", addr)
+	}
+	switch parts[0] {
+	case "udp", "tcp", "tls":
+	default:
+		return "", "", fmt.Errorf("unknown syslog protocol %q", parts[0])
+	}
+	if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+		return "", "", fmt.Errorf("invalid syslog listen address %q: %s", addr, err)
+	}
+	return parts[0], parts[1], nil
+}
+
+// 以业务以及发送方标记的记录，JSON编码后交由适配器处理
+type syslogRecord struct {
+	Biz      string    `json:"biz"`
+	Host     string    `json:"host"` // 发送方主机名，缺失时为对端IP
+	Remote   string    `json:"remote"`
+	Received time.Time `json:"received"`
+	*syslog.Message
+}
+
+// 同一发送方以及应用的记录合并为一批，作为一个虚拟文件投递
+type syslogBatch struct {
+	host    string
+	app     string
+	records [][]byte
+	size    int
+	first   time.Time
+}
+
+// syslog监听程序，消息经由cacheChan进入流水线，无需防抖
+type SyslogWatcher struct {
+	seq    uint64
+	logger log.Logger
+	config *SyslogConfig
+}
+
+func NewSyslogWatcher(config *SyslogConfig) Watcher {
+	if config.BatchSize <= 0 {
+		config.BatchSize = SYSLOG_BATCH_SIZE
+	}
+	if config.BatchWait <= 0 {
+		config.BatchWait = SYSLOG_BATCH_WAIT
+	}
+	return &SyslogWatcher{
+		config: config,
+	}
+}
+
+func (this *SyslogWatcher) SetLogger(logger log.Logger) Watcher {
+	this.logger = logger
+	return this
+}
+
+func (this *SyslogWatcher) Listen(rule *fsnotify.Rule, taskChan chan *fsnotify.Event) {
+	msgs := make(chan *syslogRecord, SYSLOG_QUEUE_CAP)
+	for _, addr := range this.config.Listen {
+		network, address, err := ParseListenAddr(addr)
+		if err != nil {
+			this.logger.Errorf("Ignore the syslog listener of %s: %s", rule.Biz, err)
+			continue
+		}
+		go this.serve(rule, network, address, msgs)
+	}
+	go this.batch(rule, msgs, taskChan)
+}
+
+// 监听失败或异常退出后重试，直至停止监听
+func (this *SyslogWatcher) serve(rule *fsnotify.Rule, network string, address string, msgs chan *syslogRecord) {
+	for {
+		var err error
+		if network == "udp" {
+			err = this.serveUDP(rule, address, msgs)
+		} else {
+			err = this.serveStream(rule, network, address, msgs)
+		}
+		select {
+		case <-rule.Done:
+			this.logger.Infof("Close %s syslog listener %s://%s", rule.Biz, network, address)
+			return
+		default:
+		}
+		this.logger.Errorf("The %s syslog listener %s://%s exited: %s, retry in %s", rule.Biz, network, address, err, SYSLOG_RETRY_DELAY)
+		select {
+		case <-rule.Done:
+			return
+		case <-time.After(SYSLOG_RETRY_DELAY):
+		}
+	}
+}
+
+func (this *SyslogWatcher) serveUDP(rule *fsnotify.Rule, address string, msgs chan *syslogRecord) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer closeOnDone(rule.Done, conn)()
+	this.logger.Infof("Listen syslog on udp://%s for %s", address, rule.Biz)
+
+	buf := make([]byte, syslog.MAX_MESSAGE_SIZE)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		this.receive(rule, buf[:n], addr, msgs)
+	}
+}
+
+func (this *SyslogWatcher) serveStream(rule *fsnotify.Rule, network string, address string, msgs chan *syslogRecord) error {
+	var ln net.Listener
+	var err error
+	if network == "tls" {
+		if this.config.TLS == nil {
+			return fmt.Errorf("tls listener requires tls_cert and tls_key")
+		}
+		ln, err = tls.Listen("tcp", address, this.config.TLS)
+	} else {
+		ln, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	defer closeOnDone(rule.Done, ln)()
+	this.logger.Infof("Listen syslog on %s://%s for %s", network, address, rule.Biz)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go this.serveConn(rule, conn, msgs)
+	}
+}
+
+func (this *SyslogWatcher) serveConn(rule *fsnotify.Rule, conn net.Conn, msgs chan *syslogRecord) {
+	defer closeOnDone(rule.Done, conn)()
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := syslog.ReadFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				this.logger.Warnf("Close the syslog connection from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		this.receive(rule, frame, conn.RemoteAddr(), msgs)
+	}
+}
+
+func (this *SyslogWatcher) receive(rule *fsnotify.Rule, raw []byte, addr net.Addr, msgs chan *syslogRecord) {
+	now := time.Now()
+	msg, err := syslog.Parse(raw, now)
+	if err != nil {
+		return
+	}
+	remote := addr.String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	host := msg.Hostname
+	if host == "" {
+		host = remote
+	}
+	metrics.EventsCaught.WithLabelValues(rule.Biz, SYSLOG).Inc()
+	select {
+	case msgs <- &syslogRecord{Biz: rule.Biz, Host: host, Remote: remote, Received: now, Message: msg}:
+	case <-rule.Done:
+	}
+}
+
+// 按发送方以及应用合批，达到数量、大小或等待时间上限时提交
+func (this *SyslogWatcher) batch(rule *fsnotify.Rule, msgs chan *syslogRecord, taskChan chan *fsnotify.Event) {
+	batches := make(map[string]*syslogBatch)
+	add := func(r *syslogRecord) {
+		data, err := json.Marshal(r)
+		if err != nil {
+			this.logger.Errorf("Fail to encode the syslog record from %s: %s", r.Remote, err)
+			return
+		}
+		host, app := safeName(r.Host, "unknown"), safeName(r.AppName, "syslog")
+		key := host + "/" + app
+		b, ok := batches[key]
+		if !ok {
+			b = &syslogBatch{host: host, app: app, first: time.Now()}
+			batches[key] = b
+		}
+		b.records = append(b.records, data)
+		b.size += len(data) + 1
+		if len(b.records) >= this.config.BatchSize || b.size >= SYSLOG_BATCH_BYTES {
+			delete(batches, key)
+			this.emit(rule, b, taskChan)
+		}
+	}
+
+	ticker := time.NewTicker(this.config.BatchWait / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-msgs:
+			add(r)
+		case <-ticker.C:
+			for key, b := range batches {
+				if time.Since(b.first) >= this.config.BatchWait {
+					delete(batches, key)
+					this.emit(rule, b, taskChan)
+				}
+			}
+		case <-rule.Done:
+			// 停止监听时提交已接收的记录
+			for len(msgs) > 0 {
+				add(<-msgs)
+			}
+			for _, b := range batches {
+				this.emit(rule, b, taskChan)
+			}
+			return
+		}
+	}
+}
+
+// 以syslog://<host>/<app>.log#<序号>标识一批记录，序号保证死信队列中的Key不会冲突
+// 记录无法通过重新扫描找回，故不经溢出处理，通道已满时阻塞等待，直至停止监听
+func (this *SyslogWatcher) emit(rule *fsnotify.Rule, b *syslogBatch, taskChan chan *fsnotify.Event) {
+	now := time.Now()
+	event := &fsnotify.Event{
+		Name:    fmt.Sprintf("syslog://%s/%s.log#%d-%d", b.host, b.app, now.UnixNano(), atomic.AddUint64(&this.seq, 1)),
+		Op:      "RECORD",
+		Biz:     rule.Biz,
+		ModTime: now,
+		Size:    int64(b.size),
+		Records: b.records,
+	}
+	// 停止监听时仍优先提交已接收的记录
+	select {
+	case taskChan <- event:
+		return
+	default:
+	}
+	select {
+	case taskChan <- event:
+	case <-rule.Done:
+		this.logger.Warnf("Discard %d syslog records of %s from %s, the listener is stopped", len(b.records), rule.Biz, b.host)
+	}
+}
+
+// 停止监听时关闭连接以中断阻塞的读取，返回的函数用于提前释放
+func closeOnDone(done chan struct{}, c io.Closer) func() {
+	exit := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-exit:
+		}
+		c.Close()
+	}()
+	return func() { close(exit) }
+}
+
+// 主机名以及应用名用作路径，仅保留安全的字符，"."以及".."等仅由点构成的名称使用缺省值，开头的点替换为"_"
+func safeName(s string, def string) string {
+	if strings.Trim(s, ".") == "" {
+		return def
+	}
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name[1:]
+	}
+	return name
+}
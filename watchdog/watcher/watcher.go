@@ -10,7 +10,14 @@ type Watcher interface {
 	SetLogger(logger log.Logger) Watcher
 }
 
+// 支持单次遍历的监听程序，用于事件丢失后补扫目录
+type Scanner interface {
+	Scan(rule *fsnotify.Rule, taskChan chan *fsnotify.Event) error
+}
+
 const (
 	FS_NOTIFY = "fsnotify"
 	FS_POLL   = "fspolling"
+	SYSLOG    = "syslog"
+	INGEST    = "ingest"
 )